@@ -5,18 +5,25 @@ import (
 	"flag"
 	"fmt"
 	"os"
+	"path/filepath"
+	"strings"
+	"time"
 
+	"github.com/asecurityteam/runhttp"
 	transportd "github.com/asecurityteam/transportd/pkg"
 	"github.com/asecurityteam/transportd/pkg/components"
 )
 
 func main() {
-	ctx := context.Background()
 	plugins := components.Defaults
+	ctx := transportd.SecretResolversToContext(context.Background(), components.SecretResolvers...)
 
-	// Handle the -h flag and print settings.
+	// Handle the -h flag and print settings. Overlays may be given with any
+	// number of -overlay flags.
 	fs := flag.NewFlagSet("", flag.ContinueOnError)
 	fs.Usage = func() {}
+	var overlayFlags overlayList
+	fs.Var(&overlayFlags, "overlay", "Overlay file to apply to the specification.")
 	err := fs.Parse(os.Args[1:])
 	if err == flag.ErrHelp {
 		help, errHelp := transportd.Help(ctx, plugins...)
@@ -26,11 +33,49 @@ func main() {
 		fmt.Println(help)
 		return
 	}
+	if err != nil {
+		panic(err.Error())
+	}
 
 	// The system will accept either a full OpenAPI specification through
 	// the environment or the name of a file where the specification is
 	// stored. Priority is given to the file if both are present.
 	fileName := os.Getenv("TRANSPORTD_OPENAPI_SPECIFICATION_FILE")
+	// A file based specification may be extended with fragments stored in
+	// one or more directories. Multiple directories are separated in the
+	// same way as PATH.
+	var dirs []string
+	if rawDirs := os.Getenv("TRANSPORTD_OPENAPI_SPECIFICATION_DIRS"); rawDirs != "" {
+		if fileName == "" {
+			panic("TRANSPORTD_OPENAPI_SPECIFICATION_DIRS requires TRANSPORTD_OPENAPI_SPECIFICATION_FILE")
+		}
+		dirs = filepath.SplitList(rawDirs)
+	}
+	// Overlays from the environment are applied before those given as
+	// flags.
+	var overlays []string
+	if rawOverlays := os.Getenv("TRANSPORTD_OPENAPI_SPECIFICATION_OVERLAYS"); rawOverlays != "" {
+		overlays = filepath.SplitList(rawOverlays)
+	}
+	overlays = append(overlays, overlayFlags...)
+	if len(overlays) > 0 && fileName == "" {
+		panic("overlays require TRANSPORTD_OPENAPI_SPECIFICATION_FILE")
+	}
+	files := transportd.SpecificationFiles{Root: fileName, Directories: dirs, Overlays: overlays}
+
+	// The print command writes the fully resolved specification, with
+	// secrets redacted, for review and exits.
+	if fs.Arg(0) == "print" {
+		if fileName == "" {
+			panic("print requires TRANSPORTD_OPENAPI_SPECIFICATION_FILE")
+		}
+		resolved, errResolve := transportd.ResolveSpecification(ctx, files)
+		if errResolve != nil {
+			panic(errResolve.Error())
+		}
+		fmt.Print(string(resolved))
+		return
+	}
 	// For backward compatibility, the previously misspelled env var key
 	// "TRANPSPORTD_OPENAPI_SPECIFICATION_CONTENT" is supported, but
 	// the properly spelled key takes priority.
@@ -38,16 +83,22 @@ func main() {
 	if len(fileContent) == 0 {
 		fileContent = []byte(os.Getenv("TRANPSPORTD_OPENAPI_SPECIFICATION_CONTENT"))
 	}
-	var errRead error
+
+	// Create and run the system. Specifications loaded from a file are
+	// reloaded when the file changes or the process receives a SIGHUP.
+	var rt *runhttp.Runtime
 	if fileName != "" {
-		fileContent, errRead = os.ReadFile(fileName)
-		if errRead != nil {
-			panic(errRead)
+		interval := transportd.DefaultReloadInterval
+		if rawInterval := os.Getenv("TRANSPORTD_OPENAPI_SPECIFICATION_RELOAD_INTERVAL"); rawInterval != "" {
+			interval, err = time.ParseDuration(rawInterval)
+			if err != nil {
+				panic(err.Error())
+			}
 		}
+		rt, err = transportd.NewFromFiles(ctx, files, interval, plugins...)
+	} else {
+		rt, err = transportd.New(ctx, fileContent, plugins...)
 	}
-
-	// Create and run the system.
-	rt, err := transportd.New(ctx, fileContent, plugins...)
 	if err != nil {
 		panic(err.Error())
 	}
@@ -55,3 +106,15 @@ func main() {
 		panic(err.Error())
 	}
 }
+
+// overlayList collects the values of a repeated flag.
+type overlayList []string
+
+func (o *overlayList) String() string {
+	return strings.Join(*o, ",")
+}
+
+func (o *overlayList) Set(value string) error {
+	*o = append(*o, value)
+	return nil
+}
@@ -30,3 +30,19 @@ func (r *StaticBackendRegistry) Load(_ context.Context, backend string) Backend
 	backend = strings.ToUpper(backend)
 	return r.Transports[backend]
 }
+
+var backendsCtxKey = ctxKey("__transportd_backends")
+
+// BackendsFromContext fetches the registry of configured backends. This is
+// available to components while they are constructed so that they can send
+// requests to backends other than the one they decorate. The result is nil if
+// no registry is set.
+func BackendsFromContext(ctx context.Context) BackendRegistry {
+	r, _ := ctx.Value(backendsCtxKey).(BackendRegistry)
+	return r
+}
+
+// BackendsToContext inserts the registry of configured backends.
+func BackendsToContext(ctx context.Context, r BackendRegistry) context.Context {
+	return context.WithValue(ctx, backendsCtxKey, r)
+}
@@ -0,0 +1,308 @@
+package transportd
+
+import (
+	"bytes"
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"net"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/vincent-petithory/dataurl"
+)
+
+const (
+	tlsSetting = "tls"
+)
+
+var (
+	tlsVersions = map[string]uint16{
+		"1.0": tls.VersionTLS10,
+		"1.1": tls.VersionTLS11,
+		"1.2": tls.VersionTLS12,
+		"1.3": tls.VersionTLS13,
+	}
+)
+
+// TLSConfig configures the TLS connections made to the hosts of a backend.
+// Certificate values may be a file path, a PEM encoded string, or a data URL.
+// Files are checked for changes as new connections are made so that rotated
+// certificates are used without a restart.
+type TLSConfig struct {
+	CA             string        `description:"CA bundle used to verify the backend instead of the system roots. A file path, PEM string, or data URL."`
+	Cert           string        `description:"Client certificate presented to the backend. A file path, PEM string, or data URL."`
+	Key            string        `description:"Private key of the client certificate. A file path, PEM string, or data URL."`
+	ServerName     string        `description:"Server name used to verify the backend certificate. Defaults to the host name. Required with a ca for IP address hosts."`
+	MinVersion     string        `description:"Minimum TLS version. One of 1.0, 1.1, 1.2, 1.3."`
+	CipherSuites   []string      `description:"Cipher suites allowed for TLS 1.2 and below, by name. Defaults to the Go defaults."`
+	ReloadInterval time.Duration `description:"Minimum time between checks of certificate files for changes."`
+}
+
+// Name of the config root.
+func (*TLSConfig) Name() string {
+	return tlsSetting
+}
+
+func newTLSConfig() *TLSConfig {
+	return &TLSConfig{
+		MinVersion:     "1.2",
+		CipherSuites:   []string{},
+		ReloadInterval: 10 * time.Second,
+	}
+}
+
+// enabled reports whether any setting differs from the default TLS behavior.
+func (c *TLSConfig) enabled() bool {
+	return c.CA != "" || c.Cert != "" || c.Key != "" || c.ServerName != "" ||
+		c.MinVersion != "1.2" || len(c.CipherSuites) > 0
+}
+
+// pemSource is a PEM value that is either given inline or read from a file.
+// Files are re-read at most once per interval.
+type pemSource struct {
+	path     string
+	interval time.Duration
+	now      func() time.Time
+
+	lock    sync.Mutex
+	data    []byte
+	checked time.Time
+}
+
+func newPEMSource(value string, interval time.Duration) (*pemSource, error) {
+	s := &pemSource{interval: interval, now: time.Now}
+	switch {
+	case strings.HasPrefix(value, "data:"):
+		u, err := dataurl.DecodeString(value)
+		if err != nil {
+			return nil, fmt.Errorf("failed to decode data url: %s", err.Error())
+		}
+		s.data = u.Data
+	case strings.Contains(value, "-----BEGIN"):
+		s.data = []byte(value)
+	default:
+		s.path = value
+		if _, _, err := s.Load(); err != nil {
+			return nil, err
+		}
+	}
+	return s, nil
+}
+
+// Load returns the current value and whether it changed since the last call.
+func (s *pemSource) Load() ([]byte, bool, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if s.path == "" {
+		return s.data, false, nil
+	}
+	now := s.now()
+	if s.data != nil && now.Sub(s.checked) < s.interval {
+		return s.data, false, nil
+	}
+	s.checked = now
+	data, err := os.ReadFile(s.path)
+	if err != nil {
+		if s.data != nil {
+			// Keep using the last good value while a file is being replaced.
+			return s.data, false, nil
+		}
+		return nil, false, err
+	}
+	if s.data != nil && bytes.Equal(data, s.data) {
+		return s.data, false, nil
+	}
+	s.data = data
+	return s.data, true, nil
+}
+
+// backendTLS holds the current certificates of a backend and produces the
+// tls.Config used by its transports.
+type backendTLS struct {
+	conf *TLSConfig
+	ca   *pemSource
+	cert *pemSource
+	key  *pemSource
+
+	lock        sync.Mutex
+	roots       *x509.CertPool
+	certificate *tls.Certificate
+}
+
+func newBackendTLS(conf *TLSConfig) (*backendTLS, error) {
+	b := &backendTLS{conf: conf}
+	var err error
+	if conf.CA != "" {
+		if b.ca, err = newPEMSource(conf.CA, conf.ReloadInterval); err != nil {
+			return nil, fmt.Errorf("failed to load ca: %s", err.Error())
+		}
+		if _, err = b.Roots(); err != nil {
+			return nil, err
+		}
+	}
+	if (conf.Cert == "") != (conf.Key == "") {
+		return nil, fmt.Errorf("cert and key must be set together")
+	}
+	if conf.Cert != "" {
+		if b.cert, err = newPEMSource(conf.Cert, conf.ReloadInterval); err != nil {
+			return nil, fmt.Errorf("failed to load cert: %s", err.Error())
+		}
+		if b.key, err = newPEMSource(conf.Key, conf.ReloadInterval); err != nil {
+			return nil, fmt.Errorf("failed to load key: %s", err.Error())
+		}
+		if _, err = b.Certificate(); err != nil {
+			return nil, err
+		}
+	}
+	return b, nil
+}
+
+// Roots returns the current CA pool.
+func (b *backendTLS) Roots() (*x509.CertPool, error) {
+	data, changed, err := b.ca.Load()
+	if err != nil {
+		return nil, err
+	}
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	if b.roots != nil && !changed {
+		return b.roots, nil
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(data) {
+		if b.roots != nil {
+			return b.roots, nil
+		}
+		return nil, fmt.Errorf("no certificates found in ca")
+	}
+	b.roots = pool
+	return b.roots, nil
+}
+
+// Certificate returns the current client certificate.
+func (b *backendTLS) Certificate() (*tls.Certificate, error) {
+	certData, certChanged, err := b.cert.Load()
+	if err != nil {
+		return nil, err
+	}
+	keyData, keyChanged, err := b.key.Load()
+	if err != nil {
+		return nil, err
+	}
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	if b.certificate != nil && !certChanged && !keyChanged {
+		return b.certificate, nil
+	}
+	certificate, err := tls.X509KeyPair(certData, keyData)
+	if err != nil {
+		// The cert and key files are rarely replaced at the same instant so
+		// a mismatched pair is expected briefly during a rotation.
+		if b.certificate != nil {
+			return b.certificate, nil
+		}
+		return nil, fmt.Errorf("invalid client certificate: %s", err.Error())
+	}
+	b.certificate = &certificate
+	return b.certificate, nil
+}
+
+// ClientConfig generates the tls.Config for the transports of the backend.
+func (b *backendTLS) ClientConfig() (*tls.Config, error) {
+	conf := &tls.Config{ // nolint:gosec
+		ServerName: b.conf.ServerName,
+	}
+	version, ok := tlsVersions[b.conf.MinVersion]
+	if !ok {
+		return nil, fmt.Errorf("unknown minimum version %s", b.conf.MinVersion)
+	}
+	conf.MinVersion = version
+	if len(b.conf.CipherSuites) > 0 {
+		suites, err := cipherSuites(b.conf.CipherSuites)
+		if err != nil {
+			return nil, err
+		}
+		conf.CipherSuites = suites
+	}
+	if b.cert != nil {
+		conf.GetClientCertificate = func(*tls.CertificateRequestInfo) (*tls.Certificate, error) {
+			return b.Certificate()
+		}
+	}
+	if b.ca != nil {
+		// The standard verification only supports a fixed set of roots. It
+		// is replaced with the same checks against the current roots so that
+		// a rotated CA bundle applies to new connections.
+		conf.InsecureSkipVerify = true // nolint:gosec
+		conf.VerifyConnection = b.verifyConnection
+	}
+	return conf, nil
+}
+
+func (b *backendTLS) verifyConnection(cs tls.ConnectionState) error {
+	if len(cs.PeerCertificates) < 1 {
+		return fmt.Errorf("backend presented no certificates")
+	}
+	// The server name of the connection is empty when the host is an IP
+	// address because IP addresses are never sent as the SNI. Verifying
+	// without a name would skip the host check entirely.
+	name := b.conf.ServerName
+	if name == "" {
+		name = cs.ServerName
+	}
+	if name == "" {
+		return fmt.Errorf("no server name to verify the backend certificate against")
+	}
+	roots, err := b.Roots()
+	if err != nil {
+		return err
+	}
+	opts := x509.VerifyOptions{
+		DNSName:       name,
+		Roots:         roots,
+		Intermediates: x509.NewCertPool(),
+	}
+	for _, cert := range cs.PeerCertificates[1:] {
+		opts.Intermediates.AddCert(cert)
+	}
+	_, err = cs.PeerCertificates[0].Verify(opts)
+	return err
+}
+
+// validateTLSHosts ensures that a backend verified against a custom CA has a
+// server name for every host. The verifier cannot learn the address of an IP
+// host from the connection so the name must be configured.
+func validateTLSHosts(conf *TLSConfig, hosts []*url.URL) error {
+	if conf.CA == "" || conf.ServerName != "" {
+		return nil
+	}
+	for _, host := range hosts {
+		if host.Scheme == "https" && net.ParseIP(host.Hostname()) != nil {
+			return fmt.Errorf("servername is required with a ca for the ip address host %s", host.Host)
+		}
+	}
+	return nil
+}
+
+func cipherSuites(names []string) ([]uint16, error) {
+	known := make(map[string]uint16)
+	for _, suite := range tls.CipherSuites() {
+		known[suite.Name] = suite.ID
+	}
+	for _, suite := range tls.InsecureCipherSuites() {
+		known[suite.Name] = suite.ID
+	}
+	result := make([]uint16, 0, len(names))
+	for _, name := range names {
+		id, ok := known[strings.ToUpper(name)]
+		if !ok {
+			return nil, fmt.Errorf("unknown cipher suite %s", name)
+		}
+		result = append(result, id)
+	}
+	return result, nil
+}
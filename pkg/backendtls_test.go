@@ -0,0 +1,263 @@
+package transportd
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/base64"
+	"encoding/pem"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/asecurityteam/transport"
+	"github.com/stretchr/testify/assert"
+)
+
+type testCert struct {
+	cert    *x509.Certificate
+	key     *ecdsa.PrivateKey
+	certPEM string
+	keyPEM  string
+}
+
+// newTestCert generates a certificate signed by the parent, or a self signed
+// CA when the parent is nil.
+func newTestCert(t *testing.T, name string, parent *testCert) *testCert {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	assert.Nil(t, err)
+	serial, _ := rand.Int(rand.Reader, big.NewInt(1<<62))
+	template := &x509.Certificate{
+		SerialNumber: serial,
+		Subject:      pkix.Name{CommonName: name},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+	}
+	if ip := net.ParseIP(name); ip != nil {
+		template.IPAddresses = []net.IP{ip}
+	} else {
+		template.DNSNames = []string{name}
+	}
+	signer, signerKey := template, key
+	if parent == nil {
+		template.IsCA = true
+		template.BasicConstraintsValid = true
+	} else {
+		signer, signerKey = parent.cert, parent.key
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, signer, &key.PublicKey, signerKey)
+	assert.Nil(t, err)
+	cert, _ := x509.ParseCertificate(der)
+	keyDER, _ := x509.MarshalECPrivateKey(key)
+	return &testCert{
+		cert:    cert,
+		key:     key,
+		certPEM: string(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})),
+		keyPEM:  string(pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER})),
+	}
+}
+
+func TestNewPEMSource(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "cert.pem")
+	assert.Nil(t, os.WriteFile(path, []byte("-----BEGIN one"), 0600))
+
+	inline, err := newPEMSource("-----BEGIN inline", time.Second)
+	assert.Nil(t, err)
+	data, _, _ := inline.Load()
+	assert.Equal(t, "-----BEGIN inline", string(data))
+
+	encoded, err := newPEMSource("data:text/plain;base64,"+base64.StdEncoding.EncodeToString([]byte("encoded")), time.Second)
+	assert.Nil(t, err)
+	data, _, _ = encoded.Load()
+	assert.Equal(t, "encoded", string(data))
+
+	file, err := newPEMSource(path, time.Second)
+	assert.Nil(t, err)
+	now := time.Now()
+	file.now = func() time.Time { return now }
+	data, changed, _ := file.Load()
+	assert.Equal(t, "-----BEGIN one", string(data))
+	assert.False(t, changed)
+
+	assert.Nil(t, os.WriteFile(path, []byte("-----BEGIN rotated"), 0600))
+	data, _, _ = file.Load()
+	assert.Equal(t, "-----BEGIN one", string(data), "file was checked before the reload interval")
+	now = now.Add(time.Minute)
+	data, changed, _ = file.Load()
+	assert.Equal(t, "-----BEGIN rotated", string(data))
+	assert.True(t, changed)
+
+	assert.Nil(t, os.Remove(path))
+	now = now.Add(time.Minute)
+	data, _, err = file.Load()
+	assert.Nil(t, err)
+	assert.Equal(t, "-----BEGIN rotated", string(data), "last good value was not kept")
+
+	_, err = newPEMSource(filepath.Join(dir, "missing.pem"), time.Second)
+	assert.NotNil(t, err)
+}
+
+func TestBackendTLSMutual(t *testing.T) {
+	ca := newTestCert(t, "ca", nil)
+	server := newTestCert(t, "backend.internal", ca)
+	client := newTestCert(t, "client", ca)
+
+	pool := x509.NewCertPool()
+	pool.AddCert(ca.cert)
+	serverCert, _ := tls.X509KeyPair([]byte(server.certPEM), []byte(server.keyPEM))
+	ts := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, "client", r.TLS.PeerCertificates[0].Subject.CommonName)
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	ts.TLS = &tls.Config{
+		Certificates: []tls.Certificate{serverCert},
+		ClientAuth:   tls.RequireAndVerifyClientCert,
+		ClientCAs:    pool,
+		MinVersion:   tls.VersionTLS12,
+	}
+	ts.StartTLS()
+	defer ts.Close()
+
+	conf := newTLSConfig()
+	conf.CA = ca.certPEM
+	conf.Cert = client.certPEM
+	conf.Key = client.keyPEM
+	conf.ServerName = "backend.internal"
+	opts, err := transportOptions(newConnectionConfig(), conf, nil)
+	assert.Nil(t, err)
+	rt := transport.New(opts...)
+	req, _ := http.NewRequest(http.MethodGet, ts.URL, http.NoBody)
+	resp, err := rt.RoundTrip(req)
+	assert.Nil(t, err)
+	if err == nil {
+		assert.Equal(t, http.StatusNoContent, resp.StatusCode)
+		_ = resp.Body.Close()
+	}
+
+	other := newTestCert(t, "other", nil)
+	conf.CA = other.certPEM
+	opts, _ = transportOptions(newConnectionConfig(), conf, nil)
+	rt = transport.New(opts...)
+	_, err = rt.RoundTrip(req)
+	assert.NotNil(t, err, "backend signed by an unknown CA was trusted")
+}
+
+func TestBackendTLSIPHost(t *testing.T) {
+	ca := newTestCert(t, "ca", nil)
+	named := newTestCert(t, "backend.internal", ca)
+	addressed := newTestCert(t, "127.0.0.1", ca)
+	for _, tt := range []struct {
+		name       string
+		server     *testCert
+		serverName string
+		wantErr    bool
+	}{
+		{name: "no ip san without servername", server: named, wantErr: true},
+		{name: "no ip san with servername", server: named, serverName: "127.0.0.1", wantErr: true},
+		{name: "ip san without servername", server: addressed, wantErr: true},
+		{name: "ip san with servername", server: addressed, serverName: "127.0.0.1", wantErr: false},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			serverCert, _ := tls.X509KeyPair([]byte(tt.server.certPEM), []byte(tt.server.keyPEM))
+			ts := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				w.WriteHeader(http.StatusNoContent)
+			}))
+			ts.TLS = &tls.Config{Certificates: []tls.Certificate{serverCert}, MinVersion: tls.VersionTLS12}
+			ts.StartTLS()
+			defer ts.Close()
+
+			conf := newTLSConfig()
+			conf.CA = ca.certPEM
+			conf.ServerName = tt.serverName
+			opts, err := transportOptions(newConnectionConfig(), conf, nil)
+			assert.Nil(t, err)
+			req, _ := http.NewRequest(http.MethodGet, ts.URL, http.NoBody)
+			resp, err := transport.New(opts...).RoundTrip(req)
+			assert.Equal(t, tt.wantErr, err != nil, "%v", err)
+			if err == nil {
+				_ = resp.Body.Close()
+			}
+		})
+	}
+}
+
+func TestValidateTLSHosts(t *testing.T) {
+	ip, _ := url.Parse("https://127.0.0.1:8443")
+	named, _ := url.Parse("https://backend.internal")
+	conf := newTLSConfig()
+	assert.Nil(t, validateTLSHosts(conf, []*url.URL{ip}))
+	conf.CA = "ca.pem"
+	assert.Nil(t, validateTLSHosts(conf, []*url.URL{named}))
+	assert.NotNil(t, validateTLSHosts(conf, []*url.URL{named, ip}))
+	conf.ServerName = "127.0.0.1"
+	assert.Nil(t, validateTLSHosts(conf, []*url.URL{named, ip}))
+}
+
+func TestBackendTLSRotation(t *testing.T) {
+	ca := newTestCert(t, "ca", nil)
+	first := newTestCert(t, "first", ca)
+	second := newTestCert(t, "second", ca)
+	dir := t.TempDir()
+	certPath := filepath.Join(dir, "client.crt")
+	keyPath := filepath.Join(dir, "client.key")
+	assert.Nil(t, os.WriteFile(certPath, []byte(first.certPEM), 0600))
+	assert.Nil(t, os.WriteFile(keyPath, []byte(first.keyPEM), 0600))
+
+	conf := newTLSConfig()
+	conf.Cert = certPath
+	conf.Key = keyPath
+	conf.ReloadInterval = 0
+	bt, err := newBackendTLS(conf)
+	assert.Nil(t, err)
+	cert, _ := bt.Certificate()
+	leaf, _ := x509.ParseCertificate(cert.Certificate[0])
+	assert.Equal(t, "first", leaf.Subject.CommonName)
+
+	assert.Nil(t, os.WriteFile(certPath, []byte(second.certPEM), 0600))
+	cert, _ = bt.Certificate()
+	leaf, _ = x509.ParseCertificate(cert.Certificate[0])
+	assert.Equal(t, "first", leaf.Subject.CommonName, "mismatched pair replaced the certificate")
+
+	assert.Nil(t, os.WriteFile(keyPath, []byte(second.keyPEM), 0600))
+	cert, _ = bt.Certificate()
+	leaf, _ = x509.ParseCertificate(cert.Certificate[0])
+	assert.Equal(t, "second", leaf.Subject.CommonName)
+}
+
+func TestBackendTLSInvalidConfig(t *testing.T) {
+	client := newTestCert(t, "client", nil)
+	tests := []struct {
+		name   string
+		modify func(*TLSConfig)
+	}{
+		{name: "cert without key", modify: func(c *TLSConfig) { c.Cert = client.certPEM }},
+		{name: "mismatched pair", modify: func(c *TLSConfig) { c.Cert = client.certPEM; c.Key = newTestCert(t, "other", nil).keyPEM }},
+		{name: "empty ca", modify: func(c *TLSConfig) { c.CA = "-----BEGIN nothing" }},
+		{name: "version", modify: func(c *TLSConfig) { c.MinVersion = "2.0" }},
+		{name: "cipher", modify: func(c *TLSConfig) { c.CipherSuites = []string{"TLS_NOT_REAL"} }},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			conf := newTLSConfig()
+			tt.modify(conf)
+			_, err := transportOptions(newConnectionConfig(), conf, nil)
+			assert.NotNil(t, err)
+		})
+	}
+	conf := newTLSConfig()
+	conf.CipherSuites = []string{"tls_ecdhe_ecdsa_with_aes_128_gcm_sha256"}
+	_, err := transportOptions(newConnectionConfig(), conf, nil)
+	assert.Nil(t, err)
+}
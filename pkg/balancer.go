@@ -0,0 +1,222 @@
+package transportd
+
+import (
+	"fmt"
+	"math/rand"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	// BalancerRoundRobin cycles through hosts in order, visiting each host in
+	// proportion to its weight.
+	BalancerRoundRobin = "roundrobin"
+	// BalancerWeightedRandom selects a random host with a probability that is
+	// proportional to its weight.
+	BalancerWeightedRandom = "weightedrandom"
+	// BalancerLeastOutstanding selects the host with the fewest in-flight
+	// requests relative to its weight.
+	BalancerLeastOutstanding = "leastoutstanding"
+	// BalancerPowerOfTwo selects two random hosts and uses the one with the
+	// fewest in-flight requests relative to its weight.
+	BalancerPowerOfTwo = "poweroftwo"
+)
+
+// upstream tracks the state of a single host within a backend.
+type upstream struct {
+	url         *url.URL
+	weight      int
+	outstanding int64
+	// unhealthy is set to 1 when active health checks remove the host
+	// from rotation.
+	unhealthy int32
+	// ejectedUntil is the time, in Unix nanoseconds, at which a host that
+	// was ejected by outlier detection returns to rotation.
+	ejectedUntil int64
+}
+
+// available reports whether the host may receive traffic.
+func (u *upstream) available() bool {
+	return atomic.LoadInt32(&u.unhealthy) == 0 &&
+		time.Now().UnixNano() >= atomic.LoadInt64(&u.ejectedUntil)
+}
+
+// load is the number of in-flight requests scaled by the weight of the host.
+func (u *upstream) load() float64 {
+	return float64(atomic.LoadInt64(&u.outstanding)) / float64(u.weight)
+}
+
+// balancer selects a host from the set of candidates. Implementations must
+// return nil when given an empty set.
+type balancer interface {
+	Select(hosts []*upstream) *upstream
+}
+
+func newBalancer(name string) (balancer, error) {
+	switch strings.ToLower(name) {
+	case BalancerRoundRobin, "":
+		return &roundRobinBalancer{}, nil
+	case BalancerWeightedRandom:
+		return &weightedRandomBalancer{}, nil
+	case BalancerLeastOutstanding:
+		return &leastOutstandingBalancer{}, nil
+	case BalancerPowerOfTwo:
+		return &powerOfTwoBalancer{}, nil
+	default:
+		return nil, fmt.Errorf("unknown balancer %s", name)
+	}
+}
+
+// roundRobinBalancer implements the smooth weighted round robin algorithm
+// which spreads the selections of heavily weighted hosts across the cycle
+// rather than sending them in bursts.
+type roundRobinBalancer struct {
+	lock    sync.Mutex
+	current map[*upstream]int
+}
+
+func (b *roundRobinBalancer) Select(hosts []*upstream) *upstream {
+	if len(hosts) < 1 {
+		return nil
+	}
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	if b.current == nil {
+		b.current = make(map[*upstream]int, len(hosts))
+	}
+	var selected *upstream
+	total := 0
+	for _, host := range hosts {
+		b.current[host] = b.current[host] + host.weight
+		total = total + host.weight
+		if selected == nil || b.current[host] > b.current[selected] {
+			selected = host
+		}
+	}
+	b.current[selected] = b.current[selected] - total
+	return selected
+}
+
+type weightedRandomBalancer struct{}
+
+func (*weightedRandomBalancer) Select(hosts []*upstream) *upstream {
+	if len(hosts) < 1 {
+		return nil
+	}
+	total := 0
+	for _, host := range hosts {
+		total = total + host.weight
+	}
+	target := rand.Intn(total) // nolint:gosec
+	for _, host := range hosts {
+		target = target - host.weight
+		if target < 0 {
+			return host
+		}
+	}
+	return hosts[len(hosts)-1]
+}
+
+type leastOutstandingBalancer struct{}
+
+func (*leastOutstandingBalancer) Select(hosts []*upstream) *upstream {
+	if len(hosts) < 1 {
+		return nil
+	}
+	// Start the scan at a random offset so that ties do not always resolve
+	// to the first host in the list.
+	offset := rand.Intn(len(hosts)) // nolint:gosec
+	selected := hosts[offset]
+	for x := 1; x < len(hosts); x = x + 1 {
+		host := hosts[(offset+x)%len(hosts)]
+		if host.load() < selected.load() {
+			selected = host
+		}
+	}
+	return selected
+}
+
+type powerOfTwoBalancer struct{}
+
+func (*powerOfTwoBalancer) Select(hosts []*upstream) *upstream {
+	if len(hosts) < 2 {
+		if len(hosts) < 1 {
+			return nil
+		}
+		return hosts[0]
+	}
+	first := rand.Intn(len(hosts))      // nolint:gosec
+	second := rand.Intn(len(hosts) - 1) // nolint:gosec
+	if second >= first {
+		second = second + 1
+	}
+	if hosts[second].load() < hosts[first].load() {
+		return hosts[second]
+	}
+	return hosts[first]
+}
+
+// hostPool is the set of hosts that serve a backend and the balancer used to
+// pick between them.
+type hostPool struct {
+	hosts    []*upstream
+	byHost   map[string]*upstream
+	balancer balancer
+}
+
+func newHostPool(hosts []*url.URL, weights []int, b balancer) *hostPool {
+	p := &hostPool{
+		hosts:    make([]*upstream, 0, len(hosts)),
+		byHost:   make(map[string]*upstream, len(hosts)),
+		balancer: b,
+	}
+	for offset, host := range hosts {
+		u := &upstream{url: host, weight: 1}
+		if len(weights) > 0 {
+			u.weight = weights[offset]
+		}
+		p.hosts = append(p.hosts, u)
+		p.byHost[host.Host] = u
+	}
+	return p
+}
+
+// Next selects the host that should receive the next request. The result is
+// nil if no hosts are available.
+func (p *hostPool) Next() *url.URL {
+	candidates := make([]*upstream, 0, len(p.hosts))
+	for _, host := range p.hosts {
+		if host.available() {
+			candidates = append(candidates, host)
+		}
+	}
+	selected := p.balancer.Select(candidates)
+	if selected == nil {
+		return nil
+	}
+	return selected.url
+}
+
+// outstandingTracker is an http.RoundTripper decorator that counts the
+// in-flight requests for each host in the pool. A request remains in-flight
+// until the response body is closed so that slow or streaming responses are
+// counted for their full duration. Requests for hosts that are not part of
+// the pool pass through without being counted.
+type outstandingTracker struct {
+	Pool    *hostPool
+	Wrapped http.RoundTripper
+}
+
+func (t *outstandingTracker) RoundTrip(req *http.Request) (*http.Response, error) {
+	u, ok := t.Pool.byHost[req.URL.Host]
+	if !ok {
+		return t.Wrapped.RoundTrip(req)
+	}
+	atomic.AddInt64(&u.outstanding, 1)
+	resp, err := t.Wrapped.RoundTrip(req)
+	return ReleaseOnClose(resp, err, func() { atomic.AddInt64(&u.outstanding, -1) })
+}
@@ -0,0 +1,80 @@
+package transportd
+
+import (
+	"net/http"
+	"net/url"
+	"testing"
+
+	"github.com/golang/mock/gomock"
+	"github.com/stretchr/testify/assert"
+)
+
+func testUpstreams(outstanding ...int64) []*upstream {
+	result := make([]*upstream, 0, len(outstanding))
+	for offset, o := range outstanding {
+		u, _ := url.Parse("https://host" + string(rune('a'+offset)))
+		result = append(result, &upstream{url: u, weight: 1, outstanding: o})
+	}
+	return result
+}
+
+func TestBalancersEmpty(t *testing.T) {
+	for _, name := range []string{BalancerRoundRobin, BalancerWeightedRandom, BalancerLeastOutstanding, BalancerPowerOfTwo} {
+		b, err := newBalancer(name)
+		assert.Nil(t, err)
+		assert.Nil(t, b.Select(nil), name)
+		hosts := testUpstreams(0)
+		assert.Equal(t, hosts[0], b.Select(hosts), name)
+	}
+	_, err := newBalancer("unknown")
+	assert.NotNil(t, err)
+}
+
+func TestWeightedRandomBalancer(t *testing.T) {
+	hosts := testUpstreams(0, 0)
+	hosts[0].weight = 0
+	b := &weightedRandomBalancer{}
+	for x := 0; x < 10; x = x + 1 {
+		assert.Equal(t, hosts[1], b.Select(hosts))
+	}
+}
+
+func TestLeastOutstandingBalancer(t *testing.T) {
+	hosts := testUpstreams(5, 1, 3)
+	b := &leastOutstandingBalancer{}
+	for x := 0; x < 10; x = x + 1 {
+		assert.Equal(t, hosts[1], b.Select(hosts))
+	}
+	hosts[2].weight = 10
+	assert.Equal(t, hosts[2], b.Select(hosts))
+}
+
+func TestPowerOfTwoBalancer(t *testing.T) {
+	hosts := testUpstreams(5, 1)
+	b := &powerOfTwoBalancer{}
+	for x := 0; x < 10; x = x + 1 {
+		assert.Equal(t, hosts[1], b.Select(hosts))
+	}
+}
+
+func TestOutstandingTracker(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	u, _ := url.Parse("https://localhost")
+	pool := newHostPool([]*url.URL{u}, nil, &roundRobinBalancer{})
+	wrapped := NewMockRoundTripper(ctrl)
+	tracker := &outstandingTracker{Pool: pool, Wrapped: wrapped}
+	req, _ := http.NewRequest(http.MethodGet, "https://localhost/", http.NoBody)
+
+	wrapped.EXPECT().RoundTrip(req).DoAndReturn(func(*http.Request) (*http.Response, error) {
+		assert.Equal(t, int64(1), pool.hosts[0].outstanding)
+		return &http.Response{StatusCode: http.StatusOK, Body: http.NoBody}, nil
+	})
+	resp, _ := tracker.RoundTrip(req)
+	assert.Equal(t, int64(1), pool.hosts[0].outstanding)
+	_ = resp.Body.Close()
+	assert.Equal(t, int64(0), pool.hosts[0].outstanding)
+	_ = resp.Body.Close()
+	assert.Equal(t, int64(0), pool.hosts[0].outstanding)
+}
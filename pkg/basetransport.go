@@ -2,11 +2,13 @@ package transportd
 
 import (
 	"context"
+	"crypto/tls"
 	"fmt"
 	"net/http"
 	"net/url"
 	"time"
 
+	"github.com/asecurityteam/runhttp"
 	"github.com/asecurityteam/settings"
 	"github.com/asecurityteam/transport"
 )
@@ -15,6 +17,9 @@ const (
 	defaultBackendName = "default"
 	backendsSetting    = "backends"
 	hostSetting        = "host"
+	hostsSetting       = "hosts"
+	weightsSetting     = "weights"
+	balancerSetting    = "balancer"
 	countSetting       = "count"
 	ttlSetting         = "ttl"
 	poolSetting        = "pool"
@@ -22,13 +27,15 @@ const (
 
 type backendWrapper struct {
 	http.RoundTripper
-	host  *url.URL
+	hosts *hostPool
 	count int
 	ttl   time.Duration
 }
 
+// Host selects the destination of the next request using the balancer
+// configured for the backend.
 func (b *backendWrapper) Host() *url.URL {
-	return b.host
+	return b.hosts.Next()
 }
 
 func (b *backendWrapper) Count() int {
@@ -42,6 +49,9 @@ func (b *backendWrapper) TTL() time.Duration {
 // NewBaseTransports generates a mapping of backend names to http.RoundTripper instances.
 // This method is used to handle the top-level x-transportd block and configure a set of
 // base http.RoundTripper instances with some core connection pooling settings applied.
+//
+// Backends with health checking enabled probe their hosts in the background until the
+// given context is canceled.
 func NewBaseTransports(ctx context.Context, s settings.Source) (BackendRegistry, error) {
 	// Determine what backends are available for endpoints.
 	backendsInstalled := settings.NewStringSliceSetting(backendsSetting, "", []string{})
@@ -63,43 +73,109 @@ func NewBaseTransports(ctx context.Context, s settings.Source) (BackendRegistry,
 	}
 	for _, backend := range backends {
 		host := settings.NewStringSetting(hostSetting, "", "")
+		hosts := settings.NewStringSliceSetting(hostsSetting, "", []string{})
+		weights := settings.NewIntSliceSetting(weightsSetting, "", []int{})
+		balancerName := settings.NewStringSetting(balancerSetting, "", BalancerRoundRobin)
 		poolCount := settings.NewIntSetting(countSetting, "", 1)
 		poolTTL := settings.NewDurationSetting(ttlSetting, "", time.Hour)
 		pool := &settings.SettingGroup{
 			NameValue:     poolSetting,
 			SettingValues: []settings.Setting{poolCount, poolTTL},
 		}
+		healthCheck := newHealthCheckConfig()
+		healthCheckG, _ := settings.Convert(healthCheck)
+		outlier := newOutlierConfig()
+		outlierG, _ := settings.Convert(outlier)
+		bulkhead := newBulkheadConfig()
+		bulkheadG, _ := settings.Convert(bulkhead)
+		tlsConf := newTLSConfig()
+		tlsG, _ := settings.Convert(tlsConf)
+		connection := newConnectionConfig()
+		connectionG, _ := settings.Convert(connection)
 		g := &settings.SettingGroup{
 			NameValue:     backend,
-			SettingValues: []settings.Setting{host},
-			GroupValues:   []settings.Group{pool},
+			SettingValues: []settings.Setting{host, hosts, weights, balancerName},
+			GroupValues:   []settings.Group{pool, connectionG, healthCheckG, outlierG, bulkheadG, tlsG},
 		}
 
 		err := settings.LoadGroups(ctx, s, []settings.Group{g})
 		if err != nil {
 			return nil, fmt.Errorf("failed to load backend %s: %s", backend, err.Error())
 		}
-		hostVal, err := url.Parse(*host.StringValue)
-		if err == nil {
-			// Only try to validate the content if parsing passed.
-			err = validateHost(hostVal)
+		hostVals, sockets, err := parseHosts(*host.StringValue, *hosts.StringSliceValue)
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse hosts for backend %s: %s", backend, err.Error())
+		}
+		if err = validateWeights(*weights.IntSliceValue, len(hostVals)); err != nil {
+			return nil, fmt.Errorf("invalid weights for backend %s: %s", backend, err.Error())
+		}
+		b, err := newBalancer(*balancerName.StringValue)
+		if err != nil {
+			return nil, fmt.Errorf("invalid balancer for backend %s: %s", backend, err.Error())
+		}
+		if err = validateHealthCheck(healthCheck); err != nil {
+			return nil, fmt.Errorf("invalid health check for backend %s: %s", backend, err.Error())
+		}
+		if err = validateOutlier(outlier); err != nil {
+			return nil, fmt.Errorf("invalid outlier detection for backend %s: %s", backend, err.Error())
+		}
+		if err = validateBulkhead(bulkhead); err != nil {
+			return nil, fmt.Errorf("invalid bulkhead for backend %s: %s", backend, err.Error())
+		}
+		if err = validateConnection(connection); err != nil {
+			return nil, fmt.Errorf("invalid connection settings for backend %s: %s", backend, err.Error())
+		}
+		if err = validateCleartext(connection, tlsConf, hostVals); err != nil {
+			return nil, fmt.Errorf("invalid connection settings for backend %s: %s", backend, err.Error())
 		}
+		if err = validateTLSHosts(tlsConf, hostVals); err != nil {
+			return nil, fmt.Errorf("invalid tls for backend %s: %s", backend, err.Error())
+		}
+		opts, err := transportOptions(connection, tlsConf, sockets)
 		if err != nil {
-			return nil, fmt.Errorf(
-				"failed to parse host %s for backend %s: %s",
-				*host.StringValue, backend, err.Error(),
-			)
+			return nil, fmt.Errorf("invalid tls for backend %s: %s", backend, err.Error())
 		}
-		f := transport.NewFactory()
+		hostPool := newHostPool(hostVals, *weights.IntSliceValue, b)
+		f := transport.NewFactory(opts...)
 		f = transport.NewRecyclerFactory(
 			f,
 			transport.RecycleOptionTTL(*poolTTL.DurationValue),
 			transport.RecycleOptionTTLJitter(*poolTTL.DurationValue/time.Duration(5)),
 		)
 		f = transport.NewRotatorFactory(f, transport.RotatorOptionInstances(*poolCount.IntValue))
+		base := f()
+		if healthCheck.Path != "" {
+			checker := &healthChecker{
+				Backend:   backend,
+				Pool:      hostPool,
+				Conf:      healthCheck,
+				Transport: base,
+				Logger:    backgroundLogger(ctx),
+				Stats:     runhttp.StatFromContext(ctx),
+			}
+			go checker.Run(ctx)
+		}
+		if outlier.enabled() {
+			base = &outlierDetector{
+				Backend: backend,
+				Pool:    hostPool,
+				Conf:    outlier,
+				Wrapped: base,
+				Logger:  backgroundLogger(ctx),
+				Stats:   runhttp.StatFromContext(ctx),
+			}
+		}
+		var rt http.RoundTripper = &outstandingTracker{Pool: hostPool, Wrapped: base}
+		if bulkhead.MaxConcurrent > 0 {
+			rt = &bulkheadTransport{
+				Backend:  backend,
+				Bulkhead: NewBulkhead(bulkhead.MaxConcurrent, bulkhead.MaxQueue, bulkhead.QueueTimeout),
+				Wrapped:  rt,
+			}
+		}
 		result.Store(ctx, backend, &backendWrapper{
-			RoundTripper: f(),
-			host:         hostVal,
+			RoundTripper: rt,
+			hosts:        hostPool,
 			count:        *poolCount.IntValue,
 			ttl:          *poolTTL.DurationValue,
 		})
@@ -107,6 +183,73 @@ func NewBaseTransports(ctx context.Context, s settings.Source) (BackendRegistry,
 	return result, nil
 }
 
+// transportOptions converts the connection settings of a backend into
+// options for the transport factory.
+func transportOptions(connection *ConnectionConfig, tlsConf *TLSConfig, sockets unixSockets) ([]transport.Option, error) {
+	var clientConf *tls.Config
+	if tlsConf.enabled() {
+		bt, err := newBackendTLS(tlsConf)
+		if err != nil {
+			return nil, err
+		}
+		clientConf, err = bt.ClientConfig()
+		if err != nil {
+			return nil, err
+		}
+	}
+	return connectionOptions(connection, clientConf, sockets), nil
+}
+
+// parseHosts combines the single host and host list settings into one set of
+// validated URLs. Only one of the two settings may be used for a backend. The
+// sockets of any unix socket hosts are returned along with the URLs.
+func parseHosts(host string, hosts []string) ([]*url.URL, unixSockets, error) {
+	if host != "" && len(hosts) > 0 {
+		return nil, nil, fmt.Errorf("only one of %s or %s may be set", hostSetting, hostsSetting)
+	}
+	if len(hosts) < 1 {
+		hosts = []string{host}
+	}
+	result := make([]*url.URL, 0, len(hosts))
+	sockets := make(unixSockets)
+	for _, rawHost := range hosts {
+		hostVal, err := url.Parse(rawHost)
+		if err == nil && hostVal.Scheme == unixScheme {
+			var socket string
+			hostVal, socket, err = parseUnixHost(hostVal)
+			if err == nil {
+				sockets[hostVal.Host] = socket
+			}
+		}
+		if err == nil {
+			// Only try to validate the content if parsing passed.
+			err = validateHost(hostVal)
+		}
+		if err != nil {
+			return nil, nil, fmt.Errorf("failed to parse host %s: %s", rawHost, err.Error())
+		}
+		result = append(result, hostVal)
+	}
+	return result, sockets, nil
+}
+
+// validateWeights ensures that any weights given line up with the hosts.
+// An empty list of weights results in all hosts being weighted equally.
+func validateWeights(weights []int, hosts int) error {
+	if len(weights) < 1 {
+		return nil
+	}
+	if len(weights) != hosts {
+		return fmt.Errorf("found %d weights for %d hosts", len(weights), hosts)
+	}
+	for _, weight := range weights {
+		if weight < 1 {
+			return fmt.Errorf("weight %d must be greater than zero", weight)
+		}
+	}
+	return nil
+}
+
 func validateHost(u *url.URL) error {
 	if u.Scheme == "" {
 		return fmt.Errorf("missing url scheme for %s", u.String())
@@ -122,23 +265,40 @@ func validateHost(u *url.URL) error {
 // Structuring this as a decorator comes with the benefits. For one, it prevents
 // us from needing to perform a request-time lookup of the matched route, extract
 // the relevant extensions, and load the relevant backend data in order to rewrite
-// the requests. Instead, we can rely on a static binding that is attached to the
-// transport itself. Additionally, this decouples our rewrite logic from the
+// the requests. Instead, we can rely on a static binding to the backend that is
+// attached to the transport itself. The backend selects the host for each
+// request. Additionally, this decouples our rewrite logic from the
 // ReverseProxy implementation should we ever need to diverge from it.
+//
+// When Name is set the backend is recorded in the ServedBy of the request.
 type hostRewrite struct {
-	Scheme  string
-	Host    string
+	Name    string
+	Backend Backend
 	Wrapped http.RoundTripper
 }
 
+// NewBackendTransport generates an http.RoundTripper that sends requests to
+// one of the hosts of the backend. This is the same transport that sits at the
+// bottom of every route, without any of the route components.
+func NewBackendTransport(backend Backend) http.RoundTripper {
+	return &hostRewrite{
+		Backend: backend,
+		Wrapped: backend,
+	}
+}
+
 func (r *hostRewrite) RoundTrip(req *http.Request) (*http.Response, error) {
-	req.Host = r.Host
+	host := r.Backend.Host()
+	if host == nil {
+		return newError(http.StatusServiceUnavailable, "no healthy hosts available for backend"), nil
+	}
+	req.Host = hostHeader(host)
 	// RequestURI is considered an error if set to a non-empty string for client
 	// requests. Since we are converting from server to client we need to blank
 	// this value to remain compliant.
 	req.RequestURI = ""
-	req.URL.Host = r.Host
-	req.URL.Scheme = r.Scheme
+	req.URL.Host = host.Host
+	req.URL.Scheme = host.Scheme
 	// Opaque and RawPath are optional fields in all contexts. The default
 	// behavior when they are not defined is to compute the values from the URL
 	// instance. Since we have rewritten key portions of the URL we actually
@@ -146,5 +306,9 @@ func (r *hostRewrite) RoundTrip(req *http.Request) (*http.Response, error) {
 	// stale versions of them.
 	req.URL.Opaque = ""
 	req.URL.RawPath = ""
+	req.URL.Path = upstreamPath(host, req.URL.Path)
+	if served := ServedByFromContext(req.Context()); served != nil && r.Name != "" {
+		served.record(r.Name, req.Host, req.URL.Scheme)
+	}
 	return r.Wrapped.RoundTrip(req)
 }
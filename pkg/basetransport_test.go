@@ -15,22 +15,39 @@ const (
 	testBackend = "test"
 )
 
+func expectBackendDefaults(ctx context.Context, s *MockSource, backend string) {
+	s.EXPECT().Get(ctx, ExtensionKey, backend, hostsSetting).Return(nil, false).AnyTimes()
+	s.EXPECT().Get(ctx, ExtensionKey, backend, weightsSetting).Return(nil, false).AnyTimes()
+	s.EXPECT().Get(ctx, ExtensionKey, backend, balancerSetting).Return(nil, false).AnyTimes()
+	expectBackendGroupDefaults(ctx, s, backend)
+}
+
+func expectBackendGroupDefaults(ctx context.Context, s *MockSource, backend string) {
+	s.EXPECT().Get(ctx, ExtensionKey, backend, healthCheckSetting, gomock.Any()).Return(nil, false).AnyTimes()
+	s.EXPECT().Get(ctx, ExtensionKey, backend, outlierSetting, gomock.Any()).Return(nil, false).AnyTimes()
+	s.EXPECT().Get(ctx, ExtensionKey, backend, bulkheadSetting, gomock.Any()).Return(nil, false).AnyTimes()
+	s.EXPECT().Get(ctx, ExtensionKey, backend, tlsSetting, gomock.Any()).Return(nil, false).AnyTimes()
+	s.EXPECT().Get(ctx, ExtensionKey, backend, connectionSetting, gomock.Any()).Return(nil, false).AnyTimes()
+}
+
 func TestHostRewrite(t *testing.T) {
 	ctrl := gomock.NewController(t)
 	defer ctrl.Finish()
 
 	wrapped := NewMockRoundTripper(ctrl)
+	backend := NewMockBackend(ctrl)
+	u, _ := url.Parse("https://test")
 	rt := &hostRewrite{
-		Scheme:  "https",
-		Host:    "test",
+		Backend: backend,
 		Wrapped: wrapped,
 	}
 	req, _ := http.NewRequest(http.MethodGet, "http://localhost/", http.NoBody)
 
+	backend.EXPECT().Host().Return(u)
 	wrapped.EXPECT().RoundTrip(gomock.Any()).Do(func(req *http.Request) {
-		assert.Equal(t, req.Host, rt.Host)
-		assert.Equal(t, req.URL.Host, rt.Host)
-		assert.Equal(t, req.URL.Scheme, rt.Scheme)
+		assert.Equal(t, req.Host, u.Host)
+		assert.Equal(t, req.URL.Host, u.Host)
+		assert.Equal(t, req.URL.Scheme, u.Scheme)
 		assert.Equal(t, req.RequestURI, "")
 		assert.Equal(t, req.URL.Opaque, "")
 		assert.Equal(t, req.URL.RawPath, "")
@@ -38,6 +55,30 @@ func TestHostRewrite(t *testing.T) {
 	_, _ = rt.RoundTrip(req)
 }
 
+func TestHostRewriteServedBy(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	wrapped := NewMockRoundTripper(ctrl)
+	backend := NewMockBackend(ctrl)
+	u, _ := url.Parse("https://test")
+	rt := &hostRewrite{
+		Name:    "app",
+		Backend: backend,
+		Wrapped: wrapped,
+	}
+	served := &ServedBy{}
+	req, _ := http.NewRequest(http.MethodGet, "http://localhost/", http.NoBody)
+	req = req.WithContext(ServedByToContext(req.Context(), served))
+
+	backend.EXPECT().Host().Return(u)
+	wrapped.EXPECT().RoundTrip(gomock.Any()).Return(nil, nil)
+	_, _ = rt.RoundTrip(req)
+	assert.Equal(t, "app", served.Backend())
+	assert.Equal(t, "test", served.Host())
+	assert.Equal(t, "https", served.Scheme())
+}
+
 func Test_validateHost(t *testing.T) {
 	tests := []struct {
 		name    string
@@ -91,6 +132,7 @@ func TestNewBaseTransportFailToLoadBackendItemPool(t *testing.T) {
 	backend1 := testBackend
 
 	s.EXPECT().Get(ctx, ExtensionKey, backendsSetting).Return([]string{backend1}, true)
+	expectBackendDefaults(ctx, s, backend1)
 	s.EXPECT().Get(ctx, ExtensionKey, backend1, hostSetting).Return("http://localhost", true)
 	s.EXPECT().Get(ctx, ExtensionKey, backend1, poolSetting, countSetting).Return("a", true)
 	_, err := NewBaseTransports(ctx, s)
@@ -106,6 +148,7 @@ func TestNewBaseTransportFailToLoadBackendItemHost(t *testing.T) {
 	backend1 := testBackend
 
 	s.EXPECT().Get(ctx, ExtensionKey, backendsSetting).Return([]string{backend1}, true)
+	expectBackendDefaults(ctx, s, backend1)
 	s.EXPECT().Get(ctx, ExtensionKey, backend1, hostSetting).Return("", true)
 	s.EXPECT().Get(ctx, ExtensionKey, backend1, poolSetting, countSetting).Return(1, true)
 	s.EXPECT().Get(ctx, ExtensionKey, backend1, poolSetting, ttlSetting).Return(time.Hour, true)
@@ -122,6 +165,7 @@ func TestNewBaseTransportSucceed(t *testing.T) {
 	backend1 := testBackend
 
 	s.EXPECT().Get(ctx, ExtensionKey, backendsSetting).Return([]string{backend1}, true)
+	expectBackendDefaults(ctx, s, backend1)
 	s.EXPECT().Get(ctx, ExtensionKey, backend1, hostSetting).Return("https://localhost", true)
 	s.EXPECT().Get(ctx, ExtensionKey, backend1, poolSetting, countSetting).Return(1, true)
 	s.EXPECT().Get(ctx, ExtensionKey, backend1, poolSetting, ttlSetting).Return(time.Hour, true)
@@ -129,3 +173,68 @@ func TestNewBaseTransportSucceed(t *testing.T) {
 	assert.Nil(t, err)
 	assert.NotNil(t, result.Load(ctx, backend1))
 }
+
+func TestNewBaseTransportMultipleHosts(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	ctx := context.Background()
+	s := NewMockSource(ctrl)
+	backend1 := testBackend
+
+	s.EXPECT().Get(ctx, ExtensionKey, backendsSetting).Return([]string{backend1}, true)
+	s.EXPECT().Get(ctx, ExtensionKey, backend1, hostSetting).Return(nil, false)
+	s.EXPECT().Get(ctx, ExtensionKey, backend1, hostsSetting).Return([]string{"https://a", "https://b"}, true)
+	s.EXPECT().Get(ctx, ExtensionKey, backend1, weightsSetting).Return([]int{1, 3}, true)
+	s.EXPECT().Get(ctx, ExtensionKey, backend1, balancerSetting).Return(BalancerRoundRobin, true)
+	s.EXPECT().Get(ctx, ExtensionKey, backend1, poolSetting, countSetting).Return(1, true)
+	s.EXPECT().Get(ctx, ExtensionKey, backend1, poolSetting, ttlSetting).Return(time.Hour, true)
+	expectBackendGroupDefaults(ctx, s, backend1)
+	result, err := NewBaseTransports(ctx, s)
+	assert.Nil(t, err)
+	b := result.Load(ctx, backend1)
+	counts := make(map[string]int)
+	for x := 0; x < 8; x = x + 1 {
+		host := b.Host().Host
+		counts[host] = counts[host] + 1
+	}
+	assert.Equal(t, 2, counts["a"])
+	assert.Equal(t, 6, counts["b"])
+}
+
+func TestNewBaseTransportInvalidHosts(t *testing.T) {
+	tests := []struct {
+		name     string
+		host     interface{}
+		hosts    interface{}
+		weights  interface{}
+		balancer interface{}
+	}{
+		{name: "host and hosts", host: "https://a", hosts: []string{"https://b"}},
+		{name: "invalid host in list", hosts: []string{"https://a", "b"}},
+		{name: "weight count mismatch", hosts: []string{"https://a", "https://b"}, weights: []int{1}},
+		{name: "zero weight", hosts: []string{"https://a"}, weights: []int{0}},
+		{name: "unknown balancer", hosts: []string{"https://a"}, balancer: "random"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctrl := gomock.NewController(t)
+			defer ctrl.Finish()
+
+			ctx := context.Background()
+			s := NewMockSource(ctrl)
+			backend1 := testBackend
+
+			s.EXPECT().Get(ctx, ExtensionKey, backendsSetting).Return([]string{backend1}, true)
+			s.EXPECT().Get(ctx, ExtensionKey, backend1, hostSetting).Return(tt.host, tt.host != nil)
+			s.EXPECT().Get(ctx, ExtensionKey, backend1, hostsSetting).Return(tt.hosts, tt.hosts != nil)
+			s.EXPECT().Get(ctx, ExtensionKey, backend1, weightsSetting).Return(tt.weights, tt.weights != nil)
+			s.EXPECT().Get(ctx, ExtensionKey, backend1, balancerSetting).Return(tt.balancer, tt.balancer != nil)
+			s.EXPECT().Get(ctx, ExtensionKey, backend1, poolSetting, countSetting).Return(1, true)
+			s.EXPECT().Get(ctx, ExtensionKey, backend1, poolSetting, ttlSetting).Return(time.Hour, true)
+			expectBackendGroupDefaults(ctx, s, backend1)
+			_, err := NewBaseTransports(ctx, s)
+			assert.NotNil(t, err)
+		})
+	}
+}
@@ -0,0 +1,74 @@
+package transportd
+
+import (
+	"bytes"
+	"io"
+	"net/http"
+	"sync"
+)
+
+// ReleaseOnClose arranges for release to be called once the response body is
+// closed so that slow, streaming, and upgraded responses hold any resources
+// tied to the request for their full duration. The release happens
+// immediately if the round trip failed or there is no body to close. The body
+// of a 101 Switching Protocols response is the upgraded connection and stays
+// writable.
+func ReleaseOnClose(resp *http.Response, err error, release func()) (*http.Response, error) {
+	if err != nil || resp == nil || resp.Body == nil {
+		release()
+		return resp, err
+	}
+	if conn, ok := resp.Body.(io.ReadWriteCloser); ok && resp.StatusCode == http.StatusSwitchingProtocols {
+		resp.Body = &releaseReadWriteCloser{ReadWriteCloser: conn, release: release}
+		return resp, nil
+	}
+	resp.Body = &releaseReadCloser{ReadCloser: resp.Body, release: release}
+	return resp, nil
+}
+
+type releaseReadCloser struct {
+	io.ReadCloser
+	once    sync.Once
+	release func()
+}
+
+func (c *releaseReadCloser) Close() error {
+	defer c.once.Do(c.release)
+	return c.ReadCloser.Close()
+}
+
+type releaseReadWriteCloser struct {
+	io.ReadWriteCloser
+	once    sync.Once
+	release func()
+}
+
+func (c *releaseReadWriteCloser) Close() error {
+	defer c.once.Do(c.release)
+	return c.ReadWriteCloser.Close()
+}
+
+// PrependBody returns a body that yields the prefix, which was already read
+// from body, followed by the rest of body. When err is not nil the rest is
+// replaced by err so that the reader sees the failure that stopped the first
+// read. Closing the result closes body.
+func PrependBody(prefix []byte, body io.ReadCloser, err error) io.ReadCloser {
+	var rest io.Reader = body
+	if err != nil {
+		rest = &errorReader{err: err}
+	}
+	return &multiReadCloser{Reader: io.MultiReader(bytes.NewReader(prefix), rest), Closer: body}
+}
+
+type errorReader struct {
+	err error
+}
+
+func (r *errorReader) Read([]byte) (int, error) {
+	return 0, r.err
+}
+
+type multiReadCloser struct {
+	io.Reader
+	io.Closer
+}
@@ -0,0 +1,46 @@
+package transportd
+
+import (
+	"errors"
+	"io"
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestReleaseOnClose(t *testing.T) {
+	released := 0
+	release := func() { released = released + 1 }
+
+	_, err := ReleaseOnClose(nil, errors.New("failed"), release)
+	assert.NotNil(t, err)
+	assert.Equal(t, 1, released, "failed round trip was not released")
+
+	resp, err := ReleaseOnClose(&http.Response{StatusCode: http.StatusOK, Body: io.NopCloser(strings.NewReader("body"))}, nil, release)
+	assert.Nil(t, err)
+	assert.Equal(t, 1, released, "released before the body was closed")
+	_ = resp.Body.Close()
+	_ = resp.Body.Close()
+	assert.Equal(t, 2, released)
+
+	conn := nopReadWriteCloser{Reader: strings.NewReader(""), Writer: io.Discard}
+	resp, err = ReleaseOnClose(&http.Response{StatusCode: http.StatusSwitchingProtocols, Body: conn}, nil, release)
+	assert.Nil(t, err)
+	upgraded, ok := resp.Body.(io.ReadWriteCloser)
+	assert.True(t, ok, "upgraded connection is no longer writable")
+	_ = upgraded.Close()
+	assert.Equal(t, 3, released)
+}
+
+func TestPrependBody(t *testing.T) {
+	original := io.NopCloser(strings.NewReader(" rest"))
+	body, _ := io.ReadAll(PrependBody([]byte("prefix"), original, nil))
+	assert.Equal(t, "prefix rest", string(body))
+
+	failure := errors.New("failed")
+	body, err := io.ReadAll(PrependBody([]byte("prefix"), original, failure))
+	assert.Equal(t, failure, err)
+	assert.Equal(t, "prefix", string(body))
+}
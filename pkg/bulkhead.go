@@ -0,0 +1,147 @@
+package transportd
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"sync/atomic"
+	"time"
+
+	"github.com/asecurityteam/runhttp"
+)
+
+const (
+	bulkheadSetting = "bulkhead"
+	// bulkheadInFlightMetric is the number of in-flight requests for a backend.
+	bulkheadInFlightMetric = "transportd.backend.bulkhead.inflight"
+	// bulkheadQueuedMetric is the number of requests waiting for a backend.
+	bulkheadQueuedMetric = "transportd.backend.bulkhead.queued"
+)
+
+var (
+	// ErrBulkheadFull is returned when both the in-flight requests and the
+	// wait queue of a Bulkhead are at capacity.
+	ErrBulkheadFull = errors.New("bulkhead is full")
+	// ErrBulkheadTimeout is returned when a request waits in the queue of a
+	// Bulkhead for longer than the queue timeout.
+	ErrBulkheadTimeout = errors.New("bulkhead queue timeout")
+)
+
+// Bulkhead caps the number of requests that may be in flight at once. Requests
+// over the cap wait in a bounded queue for a limited time.
+type Bulkhead struct {
+	slots        chan struct{}
+	maxQueue     int64
+	queueTimeout time.Duration
+	queued       int64
+}
+
+// NewBulkhead creates a Bulkhead that allows limit requests in flight and up
+// to queue requests waiting for at most timeout.
+func NewBulkhead(limit int, queue int, timeout time.Duration) *Bulkhead {
+	return &Bulkhead{
+		slots:        make(chan struct{}, limit),
+		maxQueue:     int64(queue),
+		queueTimeout: timeout,
+	}
+}
+
+// Acquire reserves a slot for a request. Every successful call must be paired
+// with a call to Release.
+func (b *Bulkhead) Acquire(ctx context.Context) error {
+	select {
+	case b.slots <- struct{}{}:
+		return nil
+	default:
+	}
+	if atomic.AddInt64(&b.queued, 1) > b.maxQueue {
+		atomic.AddInt64(&b.queued, -1)
+		return ErrBulkheadFull
+	}
+	defer atomic.AddInt64(&b.queued, -1)
+	timer := time.NewTimer(b.queueTimeout)
+	defer timer.Stop()
+	select {
+	case b.slots <- struct{}{}:
+		return nil
+	case <-timer.C:
+		return ErrBulkheadTimeout
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// Release returns a slot acquired with Acquire.
+func (b *Bulkhead) Release() {
+	<-b.slots
+}
+
+// InFlight is the number of requests holding a slot.
+func (b *Bulkhead) InFlight() int {
+	return len(b.slots)
+}
+
+// Queued is the number of requests waiting for a slot.
+func (b *Bulkhead) Queued() int {
+	return int(atomic.LoadInt64(&b.queued))
+}
+
+// BulkheadConfig caps the concurrent requests sent to a backend across all of
+// its routes.
+type BulkheadConfig struct {
+	MaxConcurrent int           `description:"Maximum in-flight requests to the backend. Zero disables the bulkhead."`
+	MaxQueue      int           `description:"Maximum requests waiting for an in-flight slot."`
+	QueueTimeout  time.Duration `description:"Maximum time a request waits for an in-flight slot."`
+}
+
+// Name of the config root.
+func (*BulkheadConfig) Name() string {
+	return bulkheadSetting
+}
+
+func newBulkheadConfig() *BulkheadConfig {
+	return &BulkheadConfig{
+		QueueTimeout: time.Second,
+	}
+}
+
+func validateBulkhead(conf *BulkheadConfig) error {
+	if conf.MaxConcurrent == 0 {
+		return nil
+	}
+	if conf.MaxConcurrent < 0 || conf.MaxQueue < 0 {
+		return fmt.Errorf("limits must not be negative")
+	}
+	if conf.MaxQueue > 0 && conf.QueueTimeout <= 0 {
+		return fmt.Errorf("queue timeout must be greater than zero")
+	}
+	return nil
+}
+
+// bulkheadTransport is an http.RoundTripper decorator that rejects requests
+// to a backend that is at capacity. A request holds its slot until the
+// response body is closed.
+type bulkheadTransport struct {
+	Backend  string
+	Bulkhead *Bulkhead
+	Wrapped  http.RoundTripper
+}
+
+func (t *bulkheadTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	stats := runhttp.StatFromContext(req.Context())
+	err := t.Bulkhead.Acquire(req.Context())
+	stats.Gauge(bulkheadQueuedMetric, float64(t.Bulkhead.Queued()), "backend:"+t.Backend)
+	if errors.Is(err, ErrBulkheadFull) || errors.Is(err, ErrBulkheadTimeout) {
+		return newError(http.StatusServiceUnavailable, fmt.Sprintf("backend %s: %s", t.Backend, err.Error())), nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	stats.Gauge(bulkheadInFlightMetric, float64(t.Bulkhead.InFlight()), "backend:"+t.Backend)
+	resp, err := t.Wrapped.RoundTrip(req)
+	return ReleaseOnClose(resp, err, func() {
+		t.Bulkhead.Release()
+		stats.Gauge(bulkheadInFlightMetric, float64(t.Bulkhead.InFlight()), "backend:"+t.Backend)
+	})
+}
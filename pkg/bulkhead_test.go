@@ -0,0 +1,75 @@
+package transportd
+
+import (
+	"context"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/golang/mock/gomock"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestBulkheadFull(t *testing.T) {
+	b := NewBulkhead(1, 0, time.Second)
+	assert.Nil(t, b.Acquire(context.Background()))
+	assert.Equal(t, 1, b.InFlight())
+	assert.Equal(t, ErrBulkheadFull, b.Acquire(context.Background()))
+	b.Release()
+	assert.Nil(t, b.Acquire(context.Background()))
+}
+
+func TestBulkheadQueue(t *testing.T) {
+	b := NewBulkhead(1, 1, time.Second)
+	assert.Nil(t, b.Acquire(context.Background()))
+	done := make(chan error)
+	go func() {
+		done <- b.Acquire(context.Background())
+	}()
+	for b.Queued() < 1 {
+		time.Sleep(time.Millisecond)
+	}
+	assert.Equal(t, ErrBulkheadFull, b.Acquire(context.Background()), "queue exceeded its limit")
+	b.Release()
+	assert.Nil(t, <-done, "queued request did not receive the released slot")
+	assert.Equal(t, 0, b.Queued())
+}
+
+func TestBulkheadQueueTimeout(t *testing.T) {
+	b := NewBulkhead(1, 1, time.Millisecond)
+	assert.Nil(t, b.Acquire(context.Background()))
+	assert.Equal(t, ErrBulkheadTimeout, b.Acquire(context.Background()))
+}
+
+func TestBulkheadTransport(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	wrapped := NewMockRoundTripper(ctrl)
+	bulkhead := NewBulkhead(1, 0, time.Second)
+	rt := &bulkheadTransport{Backend: testBackend, Bulkhead: bulkhead, Wrapped: wrapped}
+	req, _ := http.NewRequest(http.MethodGet, "http://localhost/", http.NoBody)
+
+	wrapped.EXPECT().RoundTrip(req).DoAndReturn(func(*http.Request) (*http.Response, error) {
+		resp, err := rt.RoundTrip(req)
+		assert.Nil(t, err)
+		assert.Equal(t, http.StatusServiceUnavailable, resp.StatusCode)
+		return &http.Response{StatusCode: http.StatusOK, Body: http.NoBody}, nil
+	})
+	resp, err := rt.RoundTrip(req)
+	assert.Nil(t, err)
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Equal(t, 1, bulkhead.InFlight(), "slot released before the body was closed")
+	_ = resp.Body.Close()
+	assert.Equal(t, 0, bulkhead.InFlight())
+}
+
+func TestValidateBulkhead(t *testing.T) {
+	conf := newBulkheadConfig()
+	assert.Nil(t, validateBulkhead(conf))
+	conf.MaxConcurrent = 10
+	conf.MaxQueue = 5
+	assert.Nil(t, validateBulkhead(conf))
+	conf.QueueTimeout = 0
+	assert.NotNil(t, validateBulkhead(conf))
+}
@@ -24,12 +24,29 @@ type ClientFactory struct {
 
 // New generates a decorated http.RoundTripper for the given path and method.
 // This method is used to handle the per-operation x-transportd blocks.
+//
+// Most components are built once for the route and see every request once.
+// Routes that split their traffic, declare match rules, or fail over choose a
+// backend below these components. Each backend gets its own copy of the
+// components that implement BackendPhaseComponent and its own host rewrite.
 func (f *ClientFactory) New(ctx context.Context, s settings.Source, path string, method string) (http.RoundTripper, error) {
 	componentsEnabled := settings.NewStringSliceSetting(enabledSetting, "", []string{})
 	backendSelected := settings.NewStringSetting(backendSetting, "", "")
+	upgradeAllowed := settings.NewBoolSetting(upgradeSetting, "", false)
+	streamingEnabled := settings.NewBoolSetting(streamingSetting, "", streamingOperation(ctx, path, method))
+	split := newSplitConfig()
+	splitG, _ := settings.Convert(split)
+	rulesEnabled := settings.NewStringSliceSetting(rulesSetting, "", []string{})
+	matchG := &settings.SettingGroup{
+		NameValue:     matchSetting,
+		SettingValues: []settings.Setting{rulesEnabled},
+	}
+	failover := newFailoverConfig()
+	failoverG, _ := settings.Convert(failover)
 	enabledG := &settings.SettingGroup{
 		NameValue:     ExtensionKey,
-		SettingValues: []settings.Setting{componentsEnabled, backendSelected},
+		SettingValues: []settings.Setting{componentsEnabled, backendSelected, upgradeAllowed, streamingEnabled},
+		GroupValues:   []settings.Group{splitG, matchG, failoverG},
 	}
 	err := settings.LoadGroups(ctx, s, []settings.Group{enabledG})
 	if err != nil {
@@ -37,11 +54,149 @@ func (f *ClientFactory) New(ctx context.Context, s settings.Source, path string,
 	}
 	enabled := *componentsEnabled.StringSliceValue
 	backend := *backendSelected.StringValue
+	rules := *rulesEnabled.StringSliceValue
+	upgrade := *upgradeAllowed.BoolValue
+	streaming := *streamingEnabled.BoolValue
+
+	if err = validateSplit(split); err != nil {
+		return nil, fmt.Errorf("invalid split for %s.%s: %s", path, method, err.Error())
+	}
+	if err = validateFailover(failover); err != nil {
+		return nil, fmt.Errorf("invalid failover for %s.%s: %s", path, method, err.Error())
+	}
+	chains := make(map[string]http.RoundTripper)
+	chain := func(backend string) (http.RoundTripper, error) {
+		if rt, ok := chains[strings.ToUpper(backend)]; ok {
+			return rt, nil
+		}
+		rt, err := f.newBackendChain(ctx, s, backend, path, method, enabled, upgrade, streaming)
+		if err != nil {
+			return nil, err
+		}
+		chains[strings.ToUpper(backend)] = rt
+		return rt, nil
+	}
+	target := func(backend string) (http.RoundTripper, error) {
+		rt, err := chain(backend)
+		if err != nil || !failover.enabled() {
+			return rt, err
+		}
+		names := []string{backend}
+		transports := []http.RoundTripper{rt}
+		for _, failoverBackend := range failover.Backends {
+			if strings.EqualFold(failoverBackend, backend) {
+				continue
+			}
+			failoverRT, err := chain(failoverBackend)
+			if err != nil {
+				return nil, err
+			}
+			names = append(names, failoverBackend)
+			transports = append(transports, failoverRT)
+		}
+		return newFailoverTransport(path, failover, names, transports), nil
+	}
+
+	rt, err := newFallback(backend, split, target)
+	if err == nil && len(rules) > 0 {
+		rt, err = newMatch(ctx, s, rules, rt, path, method, target)
+	}
+	if err != nil {
+		return nil, err
+	}
+	// Components built for the route are given its primary backend, which is
+	// the first backend of a split.
+	primary := backend
+	if split.enabled() {
+		primary = split.Backends[0]
+	}
+	routeChain, err := f.newChain(ctx, s, primary, path, method, enabled, upgrade, streaming, false)
+	if err != nil {
+		return nil, err
+	}
+	rt = routeChain.Apply(rt)
+	if !streaming {
+		return rt, nil
+	}
+	return &streamingTransport{Wrapped: rt}, nil
+}
+
+// newFallback builds the transport used for requests that match no rule. This
+// is either the single backend of the route or the split between several.
+func newFallback(backend string, split *SplitConfig, target func(string) (http.RoundTripper, error)) (http.RoundTripper, error) {
+	if !split.enabled() {
+		return target(backend)
+	}
+	transports := make([]http.RoundTripper, 0, len(split.Backends))
+	for _, splitBackend := range split.Backends {
+		rt, err := target(splitBackend)
+		if err != nil {
+			return nil, err
+		}
+		transports = append(transports, rt)
+	}
+	return newSplitTransport(split, transports), nil
+}
 
+// newMatch loads the named match rules of a route and selects the backend of
+// each.
+func newMatch(ctx context.Context, s settings.Source, rules []string, fallback http.RoundTripper, path string, method string, target func(string) (http.RoundTripper, error)) (http.RoundTripper, error) {
+	prefixSource := &settings.PrefixSource{
+		Source: s,
+		Prefix: []string{ExtensionKey, matchSetting},
+	}
+	result := &matchTransport{
+		Rules:    make([]*matchRule, 0, len(rules)),
+		Fallback: fallback,
+	}
+	for _, name := range rules {
+		conf := &MatchRuleConfig{}
+		err := settings.LoadGroups(ctx, prefixSource, []settings.Group{matchRuleGroup(name, conf)})
+		if err != nil {
+			return nil, fmt.Errorf("failed to load match rule %s for %s.%s: %s", name, path, method, err.Error())
+		}
+		rule, err := newMatchRule(name, conf)
+		if err != nil {
+			return nil, fmt.Errorf("invalid match rule for %s.%s: %s", path, method, err.Error())
+		}
+		rule.Transport, err = target(conf.Backend)
+		if err != nil {
+			return nil, err
+		}
+		result.Rules = append(result.Rules, rule)
+	}
+	return result, nil
+}
+
+// newBackendChain builds the backend phase components of a route around a
+// single backend. Requests are rewritten to a host of the backend before
+// these components run.
+func (f *ClientFactory) newBackendChain(ctx context.Context, s settings.Source, backend string, path string, method string, enabled []string, upgrade bool, streaming bool) (http.RoundTripper, error) {
 	base := f.Bases.Load(ctx, backend)
 	if base == nil {
 		return nil, fmt.Errorf("backend %s not found for %s.%s", backend, path, method)
 	}
+	chain, err := f.newChain(ctx, s, backend, path, method, enabled, upgrade, streaming, true)
+	if err != nil {
+		return nil, err
+	}
+	chain = append(transport.Chain{func(w http.RoundTripper) http.RoundTripper {
+		return &hostRewrite{
+			Name:    backend,
+			Wrapped: w,
+			Backend: base,
+		}
+	}}, chain...)
+	return chain.Apply(base), nil
+}
+
+// newChain builds the enabled components of a route that belong to the given
+// phase. When the route allows upgrades, components that do not implement
+// RequestPhaseComponent are skipped for upgrade requests. Components of a
+// streaming route are built with the streaming mode set in their context.
+func (f *ClientFactory) newChain(ctx context.Context, s settings.Source, backend string, path string, method string, enabled []string, upgrade bool, streaming bool, backendPhase bool) (transport.Chain, error) {
+	ctx = BackendsToContext(ctx, f.Bases)
+	ctx = StreamingToContext(ctx, streaming)
 
 	loadedComponents := make([]interface{}, len(enabled))
 	for _, c := range f.Components {
@@ -68,21 +223,20 @@ func (f *ClientFactory) New(ctx context.Context, s settings.Source, path string,
 		Source: s,
 		Prefix: []string{ExtensionKey},
 	}
-	chain := make(transport.Chain, 0, len(enabled)+1)
-	chain = append(chain, func(w http.RoundTripper) http.RoundTripper {
-		return &hostRewrite{
-			Wrapped: w,
-			Host:    base.Host().Host,
-			Scheme:  base.Host().Scheme,
-		}
-	})
+	chain := make(transport.Chain, 0, len(enabled))
 	for offset, c := range loadedComponents {
+		if _, ok := c.(BackendPhaseComponent); ok != backendPhase {
+			continue
+		}
 		cD := new(func(http.RoundTripper) http.RoundTripper)
 		err := settings.NewComponent(ctx, prefixSource, c, cD)
 		if err != nil {
 			return nil, fmt.Errorf("failed to load component %s: %s", enabled[offset], err.Error())
 		}
+		if _, ok := c.(RequestPhaseComponent); upgrade && !ok {
+			*cD = bypassUpgrades(*cD)
+		}
 		chain = append(chain, *cD)
 	}
-	return chain.Apply(base), nil
+	return chain, nil
 }
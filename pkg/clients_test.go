@@ -7,6 +7,7 @@ import (
 	"net/url"
 	"testing"
 
+	"github.com/asecurityteam/settings"
 	"github.com/golang/mock/gomock"
 	"github.com/stretchr/testify/assert"
 )
@@ -24,9 +25,11 @@ func (*cfComponentConfig) Name() string {
 }
 
 type cfComponent struct {
-	Conf     *cfComponentConfig
-	Err      error
-	AdaptErr error
+	Conf      *cfComponentConfig
+	Err       error
+	AdaptErr  error
+	Backends  BackendRegistry
+	Streaming bool
 }
 
 func (*cfComponent) Settings() *cfComponentConfig {
@@ -38,10 +41,68 @@ func (c *cfComponent) New(_ context.Context, conf *cfComponentConfig) (func(http
 		return w
 	}, c.Err
 }
-func (c *cfComponent) Adapt(_ context.Context, backend string, path string, method string) (interface{}, error) {
+func (c *cfComponent) Adapt(ctx context.Context, backend string, path string, method string) (interface{}, error) {
+	c.Backends = BackendsFromContext(ctx)
+	c.Streaming = StreamingFromContext(ctx)
 	return c, c.AdaptErr
 }
 
+type routePhaseConfig struct{}
+
+func (*routePhaseConfig) Name() string {
+	return "route"
+}
+
+// routePhaseComponent records the backend of each chain it is built for.
+type routePhaseComponent struct {
+	Backend string
+	Built   *[]string
+}
+
+func (*routePhaseComponent) Settings() *routePhaseConfig {
+	return &routePhaseConfig{}
+}
+
+func (c *routePhaseComponent) New(_ context.Context, _ *routePhaseConfig) (func(http.RoundTripper) http.RoundTripper, error) {
+	*c.Built = append(*c.Built, c.Backend)
+	return func(w http.RoundTripper) http.RoundTripper {
+		return w
+	}, nil
+}
+
+type backendPhaseConfig struct{}
+
+func (*backendPhaseConfig) Name() string {
+	return "backend"
+}
+
+// backendPhaseComponent records the backend of each chain it is built for.
+type backendPhaseComponent struct {
+	Backend string
+	Built   *[]string
+}
+
+func (*backendPhaseComponent) Settings() *backendPhaseConfig {
+	return &backendPhaseConfig{}
+}
+
+func (*backendPhaseComponent) BackendPhase() {}
+
+func (c *backendPhaseComponent) New(_ context.Context, _ *backendPhaseConfig) (func(http.RoundTripper) http.RoundTripper, error) {
+	*c.Built = append(*c.Built, c.Backend)
+	return func(w http.RoundTripper) http.RoundTripper {
+		return w
+	}, nil
+}
+
+func expectRouteDefaults(ctx context.Context, s *MockSource) {
+	s.EXPECT().Get(ctx, ExtensionKey, splitSetting, gomock.Any()).Return(nil, false).AnyTimes()
+	s.EXPECT().Get(ctx, ExtensionKey, matchSetting, rulesSetting).Return(nil, false).AnyTimes()
+	s.EXPECT().Get(ctx, ExtensionKey, failoverSetting, gomock.Any()).Return(nil, false).AnyTimes()
+	s.EXPECT().Get(ctx, ExtensionKey, upgradeSetting).Return(nil, false).AnyTimes()
+	s.EXPECT().Get(ctx, ExtensionKey, streamingSetting).Return(nil, false).AnyTimes()
+}
+
 func TestNewClientFactoryFailedToLoadEnabledList(t *testing.T) {
 	ctrl := gomock.NewController(t)
 	defer ctrl.Finish()
@@ -50,6 +111,7 @@ func TestNewClientFactoryFailedToLoadEnabledList(t *testing.T) {
 	comp := &cfComponent{}
 	br := NewMockBackendRegistry(ctrl)
 	s := NewMockSource(ctrl)
+	expectRouteDefaults(ctx, s)
 	cf := &ClientFactory{
 		Bases:      br,
 		Components: []NewComponent{comp.Adapt},
@@ -68,6 +130,7 @@ func TestNewClientFactoryFailedMissingBackend(t *testing.T) {
 	comp := &cfComponent{}
 	br := NewMockBackendRegistry(ctrl)
 	s := NewMockSource(ctrl)
+	expectRouteDefaults(ctx, s)
 	cf := &ClientFactory{
 		Bases:      br,
 		Components: []NewComponent{comp.Adapt},
@@ -89,6 +152,7 @@ func TestNewClientFactoryFailedComponentFactoryError(t *testing.T) {
 	comp := &cfComponent{AdaptErr: errors.New("")}
 	br := NewMockBackendRegistry(ctrl)
 	s := NewMockSource(ctrl)
+	expectRouteDefaults(ctx, s)
 	cf := &ClientFactory{
 		Bases:      br,
 		Components: []NewComponent{comp.Adapt},
@@ -110,6 +174,7 @@ func TestNewClientFactoryFailedComponentLoadError(t *testing.T) {
 	comp := &cfComponent{Err: errors.New("")}
 	br := NewMockBackendRegistry(ctrl)
 	s := NewMockSource(ctrl)
+	expectRouteDefaults(ctx, s)
 	cf := &ClientFactory{
 		Bases:      br,
 		Components: []NewComponent{comp.Adapt},
@@ -118,7 +183,7 @@ func TestNewClientFactoryFailedComponentLoadError(t *testing.T) {
 	s.EXPECT().Get(ctx, ExtensionKey, enabledSetting).Return([]string{cfComponentName}, true)
 	s.EXPECT().Get(ctx, ExtensionKey, backendSetting).Return("", true)
 	br.EXPECT().Load(ctx, "").Return(rt)
-	s.EXPECT().Get(ctx, ExtensionKey, cfComponentName, "V").Return("a", true)
+	s.EXPECT().Get(gomock.Any(), ExtensionKey, cfComponentName, "V").Return("a", true)
 	_, err := cf.New(ctx, s, "", "")
 	assert.NotNil(t, err)
 }
@@ -133,6 +198,7 @@ func TestNewClientFactoryFailedComponentMissing(t *testing.T) {
 	comp := &cfComponent{}
 	br := NewMockBackendRegistry(ctrl)
 	s := NewMockSource(ctrl)
+	expectRouteDefaults(ctx, s)
 	cf := &ClientFactory{
 		Bases:      br,
 		Components: []NewComponent{comp.Adapt},
@@ -156,6 +222,7 @@ func TestNewClientFactorySuccess(t *testing.T) {
 	comp := &cfComponent{}
 	br := NewMockBackendRegistry(ctrl)
 	s := NewMockSource(ctrl)
+	expectRouteDefaults(ctx, s)
 	cf := &ClientFactory{
 		Bases:      br,
 		Components: []NewComponent{comp.Adapt},
@@ -165,9 +232,318 @@ func TestNewClientFactorySuccess(t *testing.T) {
 	s.EXPECT().Get(ctx, ExtensionKey, backendSetting).Return("", true)
 	br.EXPECT().Load(ctx, "").Return(rt)
 	rt.EXPECT().Host().Return(u).AnyTimes()
-	s.EXPECT().Get(ctx, ExtensionKey, cfComponentName, "V").Return(1, true)
+	s.EXPECT().Get(gomock.Any(), ExtensionKey, cfComponentName, "V").Return(1, true)
 	client, err := cf.New(ctx, s, "", "")
 	assert.Nil(t, err)
 	assert.NotNil(t, client)
 	assert.Equal(t, comp.Conf.V, 1)
+	assert.Equal(t, br, comp.Backends)
+}
+
+func TestNewClientFactorySplit(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	ctx := context.Background()
+	stable := NewMockBackend(ctrl)
+	canary := NewMockBackend(ctrl)
+	comp := &cfComponent{}
+	br := NewMockBackendRegistry(ctrl)
+	s := NewMockSource(ctrl)
+	cf := &ClientFactory{
+		Bases:      br,
+		Components: []NewComponent{comp.Adapt},
+	}
+
+	s.EXPECT().Get(ctx, ExtensionKey, enabledSetting).Return([]string{cfComponentName}, true)
+	s.EXPECT().Get(ctx, ExtensionKey, backendSetting).Return("", true)
+	s.EXPECT().Get(ctx, ExtensionKey, upgradeSetting).Return(nil, false)
+	s.EXPECT().Get(ctx, ExtensionKey, streamingSetting).Return(nil, false)
+	s.EXPECT().Get(ctx, ExtensionKey, splitSetting, "Backends").Return([]string{"stable", "canary"}, true)
+	s.EXPECT().Get(ctx, ExtensionKey, splitSetting, "Weights").Return([]int{95, 5}, true)
+	s.EXPECT().Get(ctx, ExtensionKey, splitSetting, "Header").Return("X-User", true)
+	s.EXPECT().Get(ctx, ExtensionKey, splitSetting, "Cookie").Return(nil, false)
+	s.EXPECT().Get(ctx, ExtensionKey, matchSetting, rulesSetting).Return(nil, false)
+	s.EXPECT().Get(ctx, ExtensionKey, failoverSetting, gomock.Any()).Return(nil, false).AnyTimes()
+	br.EXPECT().Load(ctx, "stable").Return(stable)
+	br.EXPECT().Load(ctx, "canary").Return(canary)
+	s.EXPECT().Get(gomock.Any(), ExtensionKey, cfComponentName, "V").Return(1, true)
+	client, err := cf.New(ctx, s, "", "")
+	assert.Nil(t, err)
+	split, ok := client.(*splitTransport)
+	assert.True(t, ok)
+	assert.Len(t, split.Transports, 2)
+	assert.Equal(t, []int{95, 5}, split.Weights)
+	assert.Equal(t, "X-User", split.Header)
+}
+
+func TestNewClientFactorySplitMissingBackend(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	ctx := context.Background()
+	stable := NewMockBackend(ctrl)
+	comp := &cfComponent{}
+	br := NewMockBackendRegistry(ctrl)
+	s := NewMockSource(ctrl)
+	cf := &ClientFactory{
+		Bases:      br,
+		Components: []NewComponent{comp.Adapt},
+	}
+
+	s.EXPECT().Get(ctx, ExtensionKey, enabledSetting).Return([]string{cfComponentName}, true)
+	s.EXPECT().Get(ctx, ExtensionKey, backendSetting).Return("", true)
+	s.EXPECT().Get(ctx, ExtensionKey, upgradeSetting).Return(nil, false)
+	s.EXPECT().Get(ctx, ExtensionKey, streamingSetting).Return(nil, false)
+	s.EXPECT().Get(ctx, ExtensionKey, splitSetting, "Backends").Return([]string{"stable", "canary"}, true)
+	s.EXPECT().Get(ctx, ExtensionKey, splitSetting, gomock.Any()).Return(nil, false).AnyTimes()
+	s.EXPECT().Get(ctx, ExtensionKey, matchSetting, rulesSetting).Return(nil, false)
+	s.EXPECT().Get(ctx, ExtensionKey, failoverSetting, gomock.Any()).Return(nil, false).AnyTimes()
+	br.EXPECT().Load(ctx, "stable").Return(stable)
+	br.EXPECT().Load(ctx, "canary").Return(nil)
+	_, err := cf.New(ctx, s, "", "")
+	assert.NotNil(t, err)
+}
+
+func TestNewClientFactoryMatch(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	ctx := context.Background()
+	fallback := NewMockBackend(ctrl)
+	v2 := NewMockBackend(ctrl)
+	comp := &cfComponent{}
+	br := NewMockBackendRegistry(ctrl)
+	s := NewMockSource(ctrl)
+	cf := &ClientFactory{
+		Bases:      br,
+		Components: []NewComponent{comp.Adapt},
+	}
+
+	s.EXPECT().Get(ctx, ExtensionKey, enabledSetting).Return([]string{cfComponentName}, true)
+	s.EXPECT().Get(ctx, ExtensionKey, backendSetting).Return("default", true)
+	s.EXPECT().Get(ctx, ExtensionKey, upgradeSetting).Return(nil, false)
+	s.EXPECT().Get(ctx, ExtensionKey, streamingSetting).Return(nil, false)
+	s.EXPECT().Get(ctx, ExtensionKey, splitSetting, gomock.Any()).Return(nil, false).AnyTimes()
+	s.EXPECT().Get(ctx, ExtensionKey, matchSetting, rulesSetting).Return([]string{"version"}, true)
+	s.EXPECT().Get(ctx, ExtensionKey, failoverSetting, gomock.Any()).Return(nil, false).AnyTimes()
+	s.EXPECT().Get(ctx, ExtensionKey, matchSetting, "version", "Header").Return("X-Api-Version", true)
+	s.EXPECT().Get(ctx, ExtensionKey, matchSetting, "version", "Exact").Return("2", true)
+	s.EXPECT().Get(ctx, ExtensionKey, matchSetting, "version", "Backend").Return("v2", true)
+	s.EXPECT().Get(ctx, ExtensionKey, matchSetting, "version", gomock.Any()).Return(nil, false).AnyTimes()
+	br.EXPECT().Load(ctx, "default").Return(fallback)
+	br.EXPECT().Load(ctx, "v2").Return(v2)
+	s.EXPECT().Get(gomock.Any(), ExtensionKey, cfComponentName, "V").Return(1, true)
+	client, err := cf.New(ctx, s, "", "")
+	assert.Nil(t, err)
+	match, ok := client.(*matchTransport)
+	assert.True(t, ok)
+	assert.Len(t, match.Rules, 1)
+	assert.Equal(t, "v2", match.Rules[0].Conf.Backend)
+	assert.Equal(t, "X-Api-Version", match.Rules[0].Conf.Header)
+}
+
+func TestNewClientFactoryMatchInvalidRule(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	ctx := context.Background()
+	fallback := NewMockBackend(ctrl)
+	comp := &cfComponent{}
+	br := NewMockBackendRegistry(ctrl)
+	s := NewMockSource(ctrl)
+	cf := &ClientFactory{
+		Bases:      br,
+		Components: []NewComponent{comp.Adapt},
+	}
+
+	s.EXPECT().Get(ctx, ExtensionKey, enabledSetting).Return([]string{cfComponentName}, true)
+	s.EXPECT().Get(ctx, ExtensionKey, backendSetting).Return("default", true)
+	s.EXPECT().Get(ctx, ExtensionKey, upgradeSetting).Return(nil, false)
+	s.EXPECT().Get(ctx, ExtensionKey, streamingSetting).Return(nil, false)
+	s.EXPECT().Get(ctx, ExtensionKey, splitSetting, gomock.Any()).Return(nil, false).AnyTimes()
+	s.EXPECT().Get(ctx, ExtensionKey, matchSetting, rulesSetting).Return([]string{"version"}, true)
+	s.EXPECT().Get(ctx, ExtensionKey, failoverSetting, gomock.Any()).Return(nil, false).AnyTimes()
+	s.EXPECT().Get(ctx, ExtensionKey, matchSetting, "version", "Backend").Return("v2", true)
+	s.EXPECT().Get(ctx, ExtensionKey, matchSetting, "version", gomock.Any()).Return(nil, false).AnyTimes()
+	br.EXPECT().Load(ctx, "default").Return(fallback)
+	_, err := cf.New(ctx, s, "", "")
+	assert.NotNil(t, err)
+}
+
+func TestNewClientFactoryFailover(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	ctx := context.Background()
+	primary := NewMockBackend(ctrl)
+	secondary := NewMockBackend(ctrl)
+	comp := &cfComponent{}
+	br := NewMockBackendRegistry(ctrl)
+	s := NewMockSource(ctrl)
+	cf := &ClientFactory{
+		Bases:      br,
+		Components: []NewComponent{comp.Adapt},
+	}
+
+	s.EXPECT().Get(ctx, ExtensionKey, enabledSetting).Return([]string{cfComponentName}, true)
+	s.EXPECT().Get(ctx, ExtensionKey, backendSetting).Return("primary", true)
+	s.EXPECT().Get(ctx, ExtensionKey, upgradeSetting).Return(nil, false)
+	s.EXPECT().Get(ctx, ExtensionKey, streamingSetting).Return(nil, false)
+	s.EXPECT().Get(ctx, ExtensionKey, splitSetting, gomock.Any()).Return(nil, false).AnyTimes()
+	s.EXPECT().Get(ctx, ExtensionKey, matchSetting, rulesSetting).Return(nil, false)
+	s.EXPECT().Get(ctx, ExtensionKey, failoverSetting, "Backends").Return([]string{"primary", "secondary"}, true)
+	s.EXPECT().Get(ctx, ExtensionKey, failoverSetting, "Codes").Return([]int{503}, true)
+	s.EXPECT().Get(ctx, ExtensionKey, failoverSetting, gomock.Any()).Return(nil, false).AnyTimes()
+	br.EXPECT().Load(ctx, "primary").Return(primary)
+	br.EXPECT().Load(ctx, "secondary").Return(secondary)
+	s.EXPECT().Get(gomock.Any(), ExtensionKey, cfComponentName, "V").Return(1, true)
+	client, err := cf.New(ctx, s, "", "")
+	assert.Nil(t, err)
+	failover, ok := client.(*failoverTransport)
+	assert.True(t, ok)
+	assert.Equal(t, []string{"primary", "secondary"}, failover.Names)
+	assert.True(t, failover.codes[503])
+}
+
+func TestNewClientFactoryUpgrade(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	ctx := context.Background()
+	rt := NewMockBackend(ctrl)
+	comp := &cfComponent{}
+	br := NewMockBackendRegistry(ctrl)
+	s := NewMockSource(ctrl)
+	cf := &ClientFactory{
+		Bases:      br,
+		Components: []NewComponent{comp.Adapt},
+	}
+
+	s.EXPECT().Get(ctx, ExtensionKey, enabledSetting).Return([]string{cfComponentName}, true)
+	s.EXPECT().Get(ctx, ExtensionKey, backendSetting).Return("", true)
+	s.EXPECT().Get(ctx, ExtensionKey, upgradeSetting).Return(true, true)
+	expectRouteDefaults(ctx, s)
+	br.EXPECT().Load(ctx, "").Return(rt)
+	s.EXPECT().Get(gomock.Any(), ExtensionKey, cfComponentName, "V").Return(1, true)
+	client, err := cf.New(ctx, s, "", "")
+	assert.Nil(t, err)
+	bypass, ok := client.(*upgradeBypass)
+	assert.True(t, ok, "component without a request phase was not bypassed for upgrades")
+	_, ok = bypass.Next.(*hostRewrite)
+	assert.True(t, ok)
+}
+
+func TestNewClientFactoryStreaming(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	ctx := context.Background()
+	rt := NewMockBackend(ctrl)
+	comp := &cfComponent{}
+	br := NewMockBackendRegistry(ctrl)
+	s := NewMockSource(ctrl)
+	cf := &ClientFactory{
+		Bases:      br,
+		Components: []NewComponent{comp.Adapt},
+	}
+
+	s.EXPECT().Get(ctx, ExtensionKey, enabledSetting).Return([]string{cfComponentName}, true)
+	s.EXPECT().Get(ctx, ExtensionKey, backendSetting).Return("", true)
+	s.EXPECT().Get(ctx, ExtensionKey, streamingSetting).Return(true, true)
+	expectRouteDefaults(ctx, s)
+	br.EXPECT().Load(ctx, "").Return(rt)
+	s.EXPECT().Get(gomock.Any(), ExtensionKey, cfComponentName, "V").Return(1, true)
+	client, err := cf.New(ctx, s, "", "")
+	assert.Nil(t, err)
+	_, ok := client.(*streamingTransport)
+	assert.True(t, ok)
+	assert.True(t, comp.Streaming, "component was not built in streaming mode")
+}
+
+func TestNewClientFactoryPhases(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	ctx := context.Background()
+	br := NewStaticBackendRegistry()
+	br.Store(ctx, "stable", NewMockBackend(ctrl))
+	br.Store(ctx, "canary", NewMockBackend(ctrl))
+	br.Store(ctx, "backup", NewMockBackend(ctrl))
+	var routeBuilt, backendBuilt []string
+	cf := &ClientFactory{
+		Bases: br,
+		Components: []NewComponent{
+			func(_ context.Context, backend string, _ string, _ string) (interface{}, error) {
+				return &routePhaseComponent{Backend: backend, Built: &routeBuilt}, nil
+			},
+			func(_ context.Context, backend string, _ string, _ string) (interface{}, error) {
+				return &backendPhaseComponent{Backend: backend, Built: &backendBuilt}, nil
+			},
+		},
+	}
+	s := settings.NewMapSource(map[string]interface{}{
+		ExtensionKey: map[string]interface{}{
+			enabledSetting: []string{"route", "backend"},
+			splitSetting: map[string]interface{}{
+				"backends": []string{"stable", "canary"},
+			},
+			failoverSetting: map[string]interface{}{
+				"backends": []string{"backup"},
+			},
+		},
+	})
+	client, err := cf.New(ctx, s, "/", http.MethodGet)
+	assert.Nil(t, err)
+	assert.NotNil(t, client)
+	assert.Equal(t, []string{"stable"}, routeBuilt, "route components were not built once for the primary backend")
+	assert.Equal(t, []string{"stable", "backup", "canary"}, backendBuilt, "backend components were not built once for each backend")
+}
+
+func TestNewClientFactoryMatchPhases(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	ctx := context.Background()
+	br := NewStaticBackendRegistry()
+	br.Store(ctx, "default", NewMockBackend(ctrl))
+	br.Store(ctx, "v2", NewMockBackend(ctrl))
+	var routeBuilt, backendBuilt []string
+	cf := &ClientFactory{
+		Bases: br,
+		Components: []NewComponent{
+			func(_ context.Context, backend string, _ string, _ string) (interface{}, error) {
+				return &routePhaseComponent{Backend: backend, Built: &routeBuilt}, nil
+			},
+			func(_ context.Context, backend string, _ string, _ string) (interface{}, error) {
+				return &backendPhaseComponent{Backend: backend, Built: &backendBuilt}, nil
+			},
+		},
+	}
+	s := settings.NewMapSource(map[string]interface{}{
+		ExtensionKey: map[string]interface{}{
+			enabledSetting: []string{"route", "backend"},
+			backendSetting: "default",
+			matchSetting: map[string]interface{}{
+				rulesSetting: []string{"version", "beta"},
+				"version": map[string]interface{}{
+					"header":  "X-Api-Version",
+					"exact":   "2",
+					"backend": "v2",
+				},
+				"beta": map[string]interface{}{
+					"cookie":  "beta",
+					"backend": "v2",
+				},
+			},
+		},
+	})
+	client, err := cf.New(ctx, s, "/", http.MethodGet)
+	assert.Nil(t, err)
+	match, ok := client.(*matchTransport)
+	assert.True(t, ok, "route components were not shared by the match rules")
+	assert.Len(t, match.Rules, 2)
+	assert.Equal(t, match.Rules[0].Transport, match.Rules[1].Transport)
+	assert.Equal(t, []string{"default"}, routeBuilt, "route components were not built once")
+	assert.Equal(t, []string{"default", "v2"}, backendBuilt, "backend components were not built once for each backend")
 }
@@ -71,3 +71,14 @@ func (r *ClientTransport) RoundTrip(req *http.Request) (*http.Response, error) {
 	req = req.WithContext(PathParamsToContext(req.Context(), pathParams))
 	return r.Registry.Load(req.Context(), route.Path, route.Method).RoundTrip(req)
 }
+
+// streaming reports whether the client for the request is in streaming mode.
+func (r *ClientTransport) streaming(req *http.Request) bool {
+	route, _, err := r.Router.FindRoute(req)
+	if err != nil {
+		_, ok := r.Registry.Load(req.Context(), unknownKey, unknownKey).(*streamingTransport)
+		return ok
+	}
+	_, ok := r.Registry.Load(req.Context(), route.Path, route.Method).(*streamingTransport)
+	return ok
+}
@@ -8,6 +8,8 @@ import (
 	"net/http"
 	"strconv"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/asecurityteam/runhttp"
@@ -22,6 +24,7 @@ type accessLog struct {
 	ForwardedFor           string   `logevent:"forwarded_for"`
 	DestinationIP          string   `logevent:"dest_ip"`
 	Site                   string   `logevent:"site"`
+	Backend                string   `logevent:"backend"`
 	HTTPRequestContentType string   `logevent:"http_request_content_type"`
 	HTTPMethod             string   `logevent:"http_method"`
 	HTTPReferrer           string   `logevent:"http_referrer"`
@@ -40,9 +43,15 @@ type accessLog struct {
 	Message                string   `logevent:"message,default=access"`
 }
 
+// streamingMessageSize is the most of an error response body that is logged
+// for streaming routes.
+const streamingMessageSize = 4096
+
 type loggingTransport struct {
 	Wrapped         http.RoundTripper
+	Backend         string
 	PrincipalHeader string
+	Streaming       bool
 }
 
 // RoundTrip writes structured access logs for the request.
@@ -56,6 +65,7 @@ func (c *loggingTransport) RoundTrip(r *http.Request) (*http.Response, error) {
 		Port:                   dstPort,
 		SourceIP:               srcIP,
 		Site:                   r.Host,
+		Backend:                c.Backend,
 		Principal:              c.getPrincipal(r),
 		HTTPRequestContentType: r.Header.Get("Content-Type"),
 		HTTPMethod:             r.Method,
@@ -65,13 +75,33 @@ func (c *loggingTransport) RoundTrip(r *http.Request) (*http.Response, error) {
 		URIQuery:               r.URL.Query().Encode(),
 		Scheme:                 r.URL.Scheme,
 	}
+	// Requests may be split or failed over between backends below the
+	// access log so the backend is taken from the one that served it.
+	var served = &transportd.ServedBy{}
+	r = r.WithContext(transportd.ServedByToContext(r.Context(), served))
 	var start = time.Now()
 	var resp, e = c.Wrapped.RoundTrip(r)
 	a.Duration = int(time.Since(start).Nanoseconds() / 1e6)
+	if backend := served.Backend(); backend != "" {
+		a.Backend = backend
+		a.Site = served.Host()
+		a.Scheme = served.Scheme()
+	}
 	if e == nil {
 		a.Status = resp.StatusCode
 		a.HTTPContentType = resp.Header.Get("Content-Type")
-		if resp.StatusCode > 399 {
+		if conn, ok := resp.Body.(io.ReadWriteCloser); ok && resp.StatusCode == http.StatusSwitchingProtocols {
+			// The entry for an upgraded connection is written once the tunnel
+			// closes so that it covers the whole session.
+			resp.Body = &tunnelLog{ReadWriteCloser: conn, ctx: r.Context(), entry: a, start: start}
+			return resp, e
+		}
+		if resp.StatusCode > 399 && c.Streaming {
+			// The body of a streaming route is passed on as it arrives so the
+			// entry is written once it closes with the prefix that was read.
+			resp.Body = &streamLog{ReadCloser: resp.Body, ctx: r.Context(), entry: a}
+			return resp, e
+		} else if resp.StatusCode > 399 {
 			respData, err := io.ReadAll(resp.Body)
 			if err != nil {
 				runhttp.LoggerFromContext(r.Context()).Error(err)
@@ -87,9 +117,85 @@ func (c *loggingTransport) RoundTrip(r *http.Request) (*http.Response, error) {
 	return resp, e
 }
 
+// tunnelLog counts the bytes sent through an upgraded connection and writes
+// the access log entry when the connection is closed. BytesIn counts the bytes
+// sent to the backend and BytesOut those received from it.
+type tunnelLog struct {
+	io.ReadWriteCloser
+	ctx      context.Context
+	entry    accessLog
+	start    time.Time
+	bytesIn  int64
+	bytesOut int64
+	once     sync.Once
+}
+
+func (t *tunnelLog) Read(p []byte) (int, error) {
+	n, err := t.ReadWriteCloser.Read(p)
+	atomic.AddInt64(&t.bytesOut, int64(n))
+	return n, err
+}
+
+func (t *tunnelLog) Write(p []byte) (int, error) {
+	n, err := t.ReadWriteCloser.Write(p)
+	atomic.AddInt64(&t.bytesIn, int64(n))
+	return n, err
+}
+
+func (t *tunnelLog) Close() error {
+	err := t.ReadWriteCloser.Close()
+	t.once.Do(func() {
+		a := t.entry
+		a.Duration = int(time.Since(t.start).Nanoseconds() / 1e6)
+		a.BytesIn = int(atomic.LoadInt64(&t.bytesIn))
+		a.BytesOut = int(atomic.LoadInt64(&t.bytesOut))
+		a.Bytes = a.BytesIn + a.BytesOut
+		runhttp.LoggerFromContext(t.ctx).Info(a)
+	})
+	return err
+}
+
+// streamLog captures up to streamingMessageSize bytes of a streamed error
+// body as it is read and writes the access log entry when the body is closed.
+type streamLog struct {
+	io.ReadCloser
+	ctx     context.Context
+	entry   accessLog
+	lock    sync.Mutex
+	message bytes.Buffer
+	once    sync.Once
+}
+
+func (s *streamLog) Read(p []byte) (int, error) {
+	n, err := s.ReadCloser.Read(p)
+	s.lock.Lock()
+	if remaining := streamingMessageSize - s.message.Len(); remaining > 0 {
+		_, _ = s.message.Write(p[:min(n, remaining)])
+	}
+	s.lock.Unlock()
+	return n, err
+}
+
+func (s *streamLog) Close() error {
+	err := s.ReadCloser.Close()
+	s.once.Do(func() {
+		a := s.entry
+		s.lock.Lock()
+		a.Message = s.message.String()
+		s.lock.Unlock()
+		runhttp.LoggerFromContext(s.ctx).Info(a)
+	})
+	return err
+}
+
 // getPrincipal takes the comma delimited list of potential principal headers and returns the first non-empty header value
 func (c *loggingTransport) getPrincipal(r *http.Request) string {
-	potentialHeaders := strings.Split(c.PrincipalHeader, ",")
+	return firstHeaderValue(r, c.PrincipalHeader)
+}
+
+// firstHeaderValue takes a comma delimited list of header names and returns the first non-empty header value
+func firstHeaderValue(r *http.Request, headers string) string {
+	potentialHeaders := strings.Split(headers, ",")
 	for _, header := range potentialHeaders {
 		cleanHeader := strings.TrimSpace(header)
 		principal := r.Header.Get(cleanHeader)
@@ -111,11 +217,13 @@ func (*AccessLogConfig) Name() string {
 }
 
 // AccessLogComponent is a logging plugin.
-type AccessLogComponent struct{}
+type AccessLogComponent struct {
+	Backend string
+}
 
 // AccessLog satisfies the NewComponent signature.
-func AccessLog(_ context.Context, _ string, _ string, _ string) (interface{}, error) {
-	return &AccessLogComponent{}, nil
+func AccessLog(_ context.Context, backend string, _ string, _ string) (interface{}, error) {
+	return &AccessLogComponent{Backend: backend}, nil
 }
 
 // Settings generates a config populated with defaults.
@@ -125,9 +233,13 @@ func (m *AccessLogComponent) Settings() *AccessLogConfig {
 	}
 }
 
+// RequestPhase marks the component as safe to run for upgrade requests.
+func (*AccessLogComponent) RequestPhase() {}
+
 // New generates the middleware.
-func (*AccessLogComponent) New(ctx context.Context, conf *AccessLogConfig) (func(http.RoundTripper) http.RoundTripper, error) {
+func (c *AccessLogComponent) New(ctx context.Context, conf *AccessLogConfig) (func(http.RoundTripper) http.RoundTripper, error) {
+	streaming := transportd.StreamingFromContext(ctx)
 	return func(next http.RoundTripper) http.RoundTripper {
-		return &loggingTransport{Wrapped: next, PrincipalHeader: conf.PrincipalHeader}
+		return &loggingTransport{Wrapped: next, Backend: c.Backend, PrincipalHeader: conf.PrincipalHeader, Streaming: streaming}
 	}, nil
 }
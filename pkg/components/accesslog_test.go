@@ -2,12 +2,17 @@ package components
 
 import (
 	"context"
+	"fmt"
+	"io"
 	"net"
 	"net/http"
 	"net/http/httptest"
+	"net/http/httputil"
+	"strings"
 	"testing"
 
 	"github.com/asecurityteam/logevent"
+	transportd "github.com/asecurityteam/transportd/pkg"
 	"github.com/golang/mock/gomock"
 	"github.com/stretchr/testify/assert"
 )
@@ -38,10 +43,12 @@ func TestAccessLog(t *testing.T) {
 	req = req.WithContext(logevent.NewContext(req.Context(), logger))
 	logger.EXPECT().Info(gomock.Any()).Do(func(event interface{}) {
 		assert.IsType(t, accessLog{}, event, "middleware did not perform an access log")
+		assert.Equal(t, "backend", event.(accessLog).Backend)
 	})
 	rt.EXPECT().RoundTrip(gomock.Any()).Return(simpleResponse(), nil).AnyTimes()
 	wrapped := &loggingTransport{
 		Wrapped: rt,
+		Backend: "backend",
 	}
 	_, _ = wrapped.RoundTrip(req)
 }
@@ -107,3 +114,154 @@ func TestPrincipalLogging(t *testing.T) {
 		})
 	}
 }
+
+type nopReadWriteCloser struct {
+	io.Reader
+	io.Writer
+}
+
+func (nopReadWriteCloser) Close() error {
+	return nil
+}
+
+func TestAccessLogUpgrade(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	logger := NewMockLogger(ctrl)
+	rt := NewMockRoundTripper(ctrl)
+
+	req := httptest.NewRequest(http.MethodGet, "https://localhost/", http.NoBody)
+	req = req.WithContext(
+		context.WithValue(req.Context(), http.LocalAddrContextKey, &net.IPAddr{Zone: "", IP: net.ParseIP("127.0.0.1")}),
+	)
+	req = req.WithContext(logevent.NewContext(req.Context(), logger))
+	resp := simpleResponse()
+	resp.StatusCode = http.StatusSwitchingProtocols
+	resp.Body = nopReadWriteCloser{Reader: strings.NewReader("response"), Writer: io.Discard}
+	rt.EXPECT().RoundTrip(gomock.Any()).Return(resp, nil)
+	wrapped := &loggingTransport{
+		Wrapped: rt,
+		Backend: "backend",
+	}
+	resp, err := wrapped.RoundTrip(req)
+	assert.Nil(t, err)
+	conn, ok := resp.Body.(io.ReadWriteCloser)
+	assert.True(t, ok, "upgraded connection is no longer writable")
+
+	_, _ = conn.Write([]byte("request"))
+	_, _ = io.ReadAll(conn)
+	logger.EXPECT().Info(gomock.Any()).Do(func(event interface{}) {
+		a := event.(accessLog)
+		assert.Equal(t, http.StatusSwitchingProtocols, a.Status)
+		assert.Equal(t, len("request"), a.BytesIn)
+		assert.Equal(t, len("response"), a.BytesOut)
+		assert.Equal(t, len("request")+len("response"), a.Bytes)
+	})
+	_ = conn.Close()
+	_ = conn.Close()
+}
+
+func TestAccessLogStreamingError(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	logger := NewMockLogger(ctrl)
+	rt := NewMockRoundTripper(ctrl)
+
+	req := httptest.NewRequest(http.MethodGet, "https://localhost/", http.NoBody)
+	req = req.WithContext(
+		context.WithValue(req.Context(), http.LocalAddrContextKey, &net.IPAddr{Zone: "", IP: net.ParseIP("127.0.0.1")}),
+	)
+	req = req.WithContext(logevent.NewContext(req.Context(), logger))
+	body := strings.Repeat("a", streamingMessageSize*2)
+	resp := simpleResponse()
+	resp.StatusCode = http.StatusInternalServerError
+	resp.Body = io.NopCloser(strings.NewReader(body))
+	rt.EXPECT().RoundTrip(gomock.Any()).Return(resp, nil)
+	c := &AccessLogComponent{Backend: "backend"}
+	f, err := c.New(transportd.StreamingToContext(context.Background(), true), c.Settings())
+	assert.Nil(t, err)
+	resp, err = f(rt).RoundTrip(req)
+	assert.Nil(t, err)
+	got, _ := io.ReadAll(resp.Body)
+	assert.Equal(t, body, string(got), "logged prefix was not passed on")
+
+	logger.EXPECT().Info(gomock.Any()).Do(func(event interface{}) {
+		a := event.(accessLog)
+		assert.Equal(t, http.StatusInternalServerError, a.Status)
+		assert.Equal(t, body[:streamingMessageSize], a.Message)
+	})
+	_ = resp.Body.Close()
+	_ = resp.Body.Close()
+}
+
+const accessLogFailoverSpec = `
+openapi: 3.0.0
+info:
+  version: 1.0.0
+  title: Failover API
+x-transportd:
+  backends:
+    - primary
+    - backup
+  primary:
+    host: "%s"
+  backup:
+    host: "%s"
+paths:
+  /:
+    get:
+      responses:
+        "200":
+          description: "Success"
+      x-transportd:
+        backend: primary
+        enabled:
+          - "accesslog"
+          - "ratelimit"
+        ratelimit:
+          rate: 0.001
+          burst: 1
+        failover:
+          backends:
+            - backup
+`
+
+func TestAccessLogFailover(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	primary := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	defer primary.Close()
+	backup := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write([]byte("backup"))
+	}))
+	defer backup.Close()
+
+	rt, err := transportd.NewTransport(context.Background(), []byte(fmt.Sprintf(accessLogFailoverSpec, primary.URL, backup.URL)), Defaults...)
+	if !assert.Nil(t, err) {
+		return
+	}
+	logger := NewMockLogger(ctrl)
+	logger.EXPECT().Info(gomock.Any()).Do(func(event interface{}) {
+		assert.Equal(t, "backup", event.(accessLog).Backend)
+		assert.Equal(t, http.StatusOK, event.(accessLog).Status)
+	})
+	proxy := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		r = r.WithContext(logevent.NewContext(r.Context(), logger))
+		(&httputil.ReverseProxy{Director: func(*http.Request) {}, Transport: rt}).ServeHTTP(w, r)
+	}))
+	defer proxy.Close()
+
+	resp, err := http.Get(proxy.URL)
+	if !assert.Nil(t, err) {
+		return
+	}
+	body, _ := io.ReadAll(resp.Body)
+	_ = resp.Body.Close()
+	assert.Equal(t, http.StatusOK, resp.StatusCode, "failover attempt was rate limited")
+	assert.Equal(t, "backup", string(body))
+}
@@ -0,0 +1,229 @@
+package components
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/asecurityteam/runhttp"
+	transportd "github.com/asecurityteam/transportd/pkg"
+)
+
+const (
+	// AdaptiveAIMD grows the limit by one while the limit is in use and cuts
+	// it by the backoff ratio whenever a request fails or is slower than the
+	// timeout.
+	AdaptiveAIMD = "aimd"
+	// AdaptiveGradient scales the limit by the ratio of the long term
+	// average latency to the latency of each request so that the limit
+	// shrinks as soon as queueing delay appears at the backend.
+	AdaptiveGradient = "gradient"
+)
+
+// AdaptiveConcurrencyConfig contains settings for adaptive concurrency limits.
+type AdaptiveConcurrencyConfig struct {
+	Algorithm    string        `description:"Algorithm used to adjust the limit. One of aimd or gradient."`
+	InitialLimit int           `description:"Concurrency limit before any requests are measured."`
+	MinLimit     int           `description:"Lowest value of the concurrency limit."`
+	MaxLimit     int           `description:"Highest value of the concurrency limit."`
+	BackoffRatio float64       `description:"Multiplier applied to the limit on failure when using aimd."`
+	Timeout      time.Duration `description:"Latency above which a request counts as a failure when using aimd."`
+	Tolerance    float64       `description:"Ratio of latency to the long term average that is tolerated before the limit shrinks when using gradient."`
+	Smoothing    float64       `description:"Weight given to each new limit computed when using gradient."`
+	LimitMetric  string        `description:"Name of the concurrency limit gauge."`
+	ShedMetric   string        `description:"Name of the rejected request count metric."`
+}
+
+// Name of the configuration root.
+func (*AdaptiveConcurrencyConfig) Name() string {
+	return "adaptiveconcurrency"
+}
+
+// AdaptiveConcurrencyComponent implements the settings.Component interface.
+type AdaptiveConcurrencyComponent struct {
+	Backend string
+	Path    string
+}
+
+// AdaptiveConcurrency satisfies the NewComponent signature.
+func AdaptiveConcurrency(_ context.Context, backend string, path string, _ string) (interface{}, error) {
+	return &AdaptiveConcurrencyComponent{Backend: backend, Path: path}, nil
+}
+
+// Settings generates a config populated with defaults.
+func (*AdaptiveConcurrencyComponent) Settings() *AdaptiveConcurrencyConfig {
+	return &AdaptiveConcurrencyConfig{
+		Algorithm:    AdaptiveGradient,
+		InitialLimit: 20,
+		MinLimit:     1,
+		MaxLimit:     1000,
+		BackoffRatio: 0.9,
+		Timeout:      5 * time.Second,
+		Tolerance:    1.5,
+		Smoothing:    0.2,
+		LimitMetric:  "http.client.adaptiveconcurrency.limit",
+		ShedMetric:   "http.client.adaptiveconcurrency.rejected",
+	}
+}
+
+// New generates the middleware.
+func (c *AdaptiveConcurrencyComponent) New(_ context.Context, conf *AdaptiveConcurrencyConfig) (func(http.RoundTripper) http.RoundTripper, error) { // nolint
+	if conf.MinLimit < 1 || conf.MaxLimit < conf.MinLimit {
+		return nil, fmt.Errorf("adaptive concurrency limits must be greater than zero with max no less than min")
+	}
+	if conf.InitialLimit < conf.MinLimit || conf.InitialLimit > conf.MaxLimit {
+		return nil, fmt.Errorf("adaptive concurrency initial limit must be between min and max")
+	}
+	var algorithm limitAlgorithm
+	switch strings.ToLower(conf.Algorithm) {
+	case AdaptiveAIMD:
+		if conf.BackoffRatio <= 0 || conf.BackoffRatio >= 1 {
+			return nil, fmt.Errorf("adaptive concurrency backoff ratio must be between 0 and 1")
+		}
+		if conf.Timeout <= 0 {
+			return nil, fmt.Errorf("adaptive concurrency timeout must be greater than zero")
+		}
+		algorithm = &aimdLimit{BackoffRatio: conf.BackoffRatio, Timeout: conf.Timeout}
+	case AdaptiveGradient:
+		if conf.Tolerance < 1 {
+			return nil, fmt.Errorf("adaptive concurrency tolerance must be at least 1")
+		}
+		if conf.Smoothing <= 0 || conf.Smoothing > 1 {
+			return nil, fmt.Errorf("adaptive concurrency smoothing must be between 0 and 1")
+		}
+		algorithm = &gradientLimit{Tolerance: conf.Tolerance, Smoothing: conf.Smoothing}
+	default:
+		return nil, fmt.Errorf("unknown adaptive concurrency algorithm %s", conf.Algorithm)
+	}
+	return func(next http.RoundTripper) http.RoundTripper {
+		return &adaptiveTransport{
+			Backend:   c.Backend,
+			Path:      c.Path,
+			Conf:      conf,
+			Algorithm: algorithm,
+			Wrapped:   next,
+			limit:     float64(conf.InitialLimit),
+		}
+	}, nil
+}
+
+// limitAlgorithm computes a new limit from the result of a request.
+type limitAlgorithm interface {
+	Update(limit float64, inflight int, rtt time.Duration, failed bool) float64
+}
+
+// aimdLimit implements additive increase and multiplicative decrease.
+type aimdLimit struct {
+	BackoffRatio float64
+	Timeout      time.Duration
+}
+
+func (a *aimdLimit) Update(limit float64, inflight int, rtt time.Duration, failed bool) float64 {
+	if failed || rtt > a.Timeout {
+		return limit * a.BackoffRatio
+	}
+	// Only grow the limit when it is actually being used. Otherwise a lightly
+	// loaded route would grow the limit without bound.
+	if float64(inflight)*2 >= limit {
+		return limit + 1
+	}
+	return limit
+}
+
+// gradientLimit is a simplified form of the gradient algorithm from
+// Netflix's concurrency-limits library. The long term latency is an
+// exponentially weighted average that changes slowly so that it represents
+// the latency of the backend when it is not queueing.
+type gradientLimit struct {
+	Tolerance float64
+	Smoothing float64
+
+	longRTT float64
+}
+
+// gradientWarmup is the weight of each sample in the long term average.
+const gradientWarmup = 0.01
+
+func (g *gradientLimit) Update(limit float64, inflight int, rtt time.Duration, failed bool) float64 {
+	if failed {
+		return limit
+	}
+	sample := float64(rtt)
+	if g.longRTT == 0 {
+		g.longRTT = sample
+	}
+	g.longRTT = g.longRTT*(1-gradientWarmup) + sample*gradientWarmup
+	// The limit is not allowed to grow while it is not in use.
+	if float64(inflight)*2 < limit {
+		return limit
+	}
+	gradient := math.Max(0.5, math.Min(1, g.Tolerance*g.longRTT/sample))
+	// The square root of the limit is added as headroom so that the limit can
+	// grow when latency is steady.
+	next := limit*gradient + math.Sqrt(limit)
+	return limit*(1-g.Smoothing) + next*g.Smoothing
+}
+
+type adaptiveTransport struct {
+	Backend   string
+	Path      string
+	Conf      *AdaptiveConcurrencyConfig
+	Algorithm limitAlgorithm
+	Wrapped   http.RoundTripper
+
+	lock     sync.Mutex
+	limit    float64
+	inflight int
+}
+
+// acquire reserves a slot if the current limit allows it.
+func (t *adaptiveTransport) acquire() (bool, int) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	if t.inflight >= int(t.limit) {
+		return false, int(t.limit)
+	}
+	t.inflight = t.inflight + 1
+	return true, int(t.limit)
+}
+
+// release frees a slot and feeds the result of the request into the
+// algorithm.
+func (t *adaptiveTransport) release(rtt time.Duration, failed bool, sample bool) int {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	if sample {
+		limit := t.Algorithm.Update(t.limit, t.inflight, rtt, failed)
+		t.limit = math.Max(float64(t.Conf.MinLimit), math.Min(float64(t.Conf.MaxLimit), limit))
+	}
+	t.inflight = t.inflight - 1
+	return int(t.limit)
+}
+
+func (t *adaptiveTransport) RoundTrip(r *http.Request) (*http.Response, error) {
+	stats := runhttp.StatFromContext(r.Context())
+	tags := []string{"client_dependency:" + t.Backend, "client_path:" + t.Path}
+	ok, limit := t.acquire()
+	if !ok {
+		stats.Count(t.Conf.ShedMetric, 1, tags...)
+		return newError(http.StatusServiceUnavailable, fmt.Sprintf("adaptive concurrency limit of %d reached", limit)), nil
+	}
+	start := time.Now()
+	resp, err := t.Wrapped.RoundTrip(r)
+	// The round trip time is measured to the response headers so that long
+	// response bodies do not look like backend latency. The slot is held
+	// until the body is closed.
+	rtt := time.Since(start)
+	// Requests canceled by the caller say nothing about the backend.
+	sample := err == nil || !errors.Is(err, context.Canceled)
+	failed := err != nil || resp.StatusCode >= http.StatusInternalServerError
+	return transportd.ReleaseOnClose(resp, err, func() {
+		limit := t.release(rtt, failed, sample)
+		stats.Gauge(t.Conf.LimitMetric, float64(limit), tags...)
+	})
+}
@@ -0,0 +1,82 @@
+package components
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/golang/mock/gomock"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestAIMDLimit(t *testing.T) {
+	a := &aimdLimit{BackoffRatio: 0.5, Timeout: time.Second}
+	assert.Equal(t, 10.0, a.Update(10, 1, time.Millisecond, false), "limit grew while unused")
+	assert.Equal(t, 11.0, a.Update(10, 5, time.Millisecond, false))
+	assert.Equal(t, 5.0, a.Update(10, 5, time.Millisecond, true))
+	assert.Equal(t, 5.0, a.Update(10, 5, 2*time.Second, false))
+}
+
+func TestGradientLimit(t *testing.T) {
+	g := &gradientLimit{Tolerance: 1, Smoothing: 1}
+	limit := 16.0
+	for x := 0; x < 10; x = x + 1 {
+		limit = g.Update(limit, int(limit), 10*time.Millisecond, false)
+	}
+	assert.True(t, limit > 16, "limit did not grow with steady latency")
+	grown := limit
+	limit = g.Update(limit, int(limit), 100*time.Millisecond, false)
+	assert.True(t, limit < grown, "limit did not shrink when latency increased")
+}
+
+func TestAdaptiveConcurrencySheds(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	wrapped := NewMockRoundTripper(ctrl)
+	c := &AdaptiveConcurrencyComponent{Backend: "backend", Path: "/"}
+	conf := c.Settings()
+	conf.Algorithm = AdaptiveAIMD
+	conf.InitialLimit = 1
+	f, err := c.New(context.Background(), conf)
+	assert.Nil(t, err)
+	rt := f(wrapped).(*adaptiveTransport)
+	req, _ := http.NewRequest(http.MethodGet, "http://localhost/", http.NoBody)
+
+	wrapped.EXPECT().RoundTrip(req).DoAndReturn(func(*http.Request) (*http.Response, error) {
+		resp, err := rt.RoundTrip(req)
+		assert.Nil(t, err)
+		assert.Equal(t, http.StatusServiceUnavailable, resp.StatusCode)
+		return simpleResponse(), nil
+	})
+	resp, err := rt.RoundTrip(req)
+	assert.Nil(t, err)
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Equal(t, 1, rt.inflight, "slot released before the body was closed")
+	_ = resp.Body.Close()
+	assert.Equal(t, 0, rt.inflight)
+	assert.Equal(t, 2.0, rt.limit, "limit did not grow while in use")
+
+	wrapped.EXPECT().RoundTrip(req).Return(nil, context.Canceled)
+	_, _ = rt.RoundTrip(req)
+	assert.Equal(t, 2.0, rt.limit, "canceled request changed the limit")
+
+	wrapped.EXPECT().RoundTrip(req).Return(nil, errors.New("connection refused"))
+	_, _ = rt.RoundTrip(req)
+	assert.Equal(t, 1.8, rt.limit)
+	assert.Equal(t, 0, rt.inflight)
+}
+
+func TestAdaptiveConcurrencyInvalidConfig(t *testing.T) {
+	c := &AdaptiveConcurrencyComponent{}
+	conf := c.Settings()
+	conf.Algorithm = "vegas"
+	_, err := c.New(context.Background(), conf)
+	assert.NotNil(t, err)
+	conf = c.Settings()
+	conf.InitialLimit = conf.MaxLimit + 1
+	_, err = c.New(context.Background(), conf)
+	assert.NotNil(t, err)
+}
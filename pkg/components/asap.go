@@ -59,6 +59,9 @@ func (m *ASAPValidateComponent) Settings() *ASAPValidateConfig {
 	return &ASAPValidateConfig{}
 }
 
+// RequestPhase marks the component as safe to run for upgrade requests.
+func (*ASAPValidateComponent) RequestPhase() {}
+
 // New generates the middleware.
 func (m *ASAPValidateComponent) New(ctx context.Context, conf *ASAPValidateConfig) (func(http.RoundTripper) http.RoundTripper, error) {
 	if len(conf.AllowedIssuers) < 1 {
@@ -125,6 +128,9 @@ func (m *ASAPTokenComponent) Settings() *ASAPTokenConfig {
 	return &ASAPTokenConfig{}
 }
 
+// RequestPhase marks the component as safe to run for upgrade requests.
+func (*ASAPTokenComponent) RequestPhase() {}
+
 // New generates the middleware.
 func (*ASAPTokenComponent) New(ctx context.Context, conf *ASAPTokenConfig) (func(http.RoundTripper) http.RoundTripper, error) {
 	if len(conf.PrivateKey) < 1 {
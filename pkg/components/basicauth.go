@@ -41,6 +41,9 @@ func (m *BasicAuthComponent) Settings() *BasicAuthConfig {
 	return &BasicAuthConfig{}
 }
 
+// RequestPhase marks the component as safe to run for upgrade requests.
+func (*BasicAuthComponent) RequestPhase() {}
+
 // New generates the middleware.
 func (*BasicAuthComponent) New(ctx context.Context, conf *BasicAuthConfig) (func(http.RoundTripper) http.RoundTripper, error) {
 	if len(conf.Username) < 1 {
@@ -0,0 +1,560 @@
+package components
+
+import (
+	"bytes"
+	"container/list"
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/asecurityteam/runhttp"
+	transportd "github.com/asecurityteam/transportd/pkg"
+)
+
+const (
+	cacheHit         = "HIT"
+	cacheMiss        = "MISS"
+	cacheStale       = "STALE"
+	cacheRevalidated = "REVALIDATED"
+	cacheBypass      = "BYPASS"
+)
+
+// cacheableStatus contains the status codes that may be stored. These are
+// the codes defined as cacheable by default in RFC 9110.
+var cacheableStatus = map[int]bool{
+	http.StatusOK:                   true,
+	http.StatusNonAuthoritativeInfo: true,
+	http.StatusNoContent:            true,
+	http.StatusMultipleChoices:      true,
+	http.StatusMovedPermanently:     true,
+	http.StatusPermanentRedirect:    true,
+	http.StatusNotFound:             true,
+	http.StatusMethodNotAllowed:     true,
+	http.StatusGone:                 true,
+	http.StatusRequestURITooLong:    true,
+	http.StatusNotImplemented:       true,
+}
+
+// notModifiedHeaders are the headers copied from a cached response into a
+// 304 response.
+var notModifiedHeaders = []string{"Cache-Control", "Content-Location", "Date", "ETag", "Expires", "Last-Modified", "Vary"}
+
+// CacheConfig contains settings for the response cache.
+type CacheConfig struct {
+	MaxEntries           int           `description:"Maximum number of responses kept in the cache."`
+	MaxSize              int           `description:"Maximum total size, in bytes, of the responses kept in the cache."`
+	TTL                  time.Duration `description:"Time a response is fresh. Overrides the Cache-Control and Expires headers of the backend when set."`
+	StaleWhileRevalidate time.Duration `description:"Time a stale response may be served while it is refreshed in the background when the backend does not set stale-while-revalidate."`
+	StaleIfError         time.Duration `description:"Time a stale response may be served when the backend fails when the backend does not set stale-if-error."`
+	Header               string        `description:"Name of the response header that reports the cache result."`
+	Metric               string        `description:"Name of the cache result count metric."`
+}
+
+// Name of the configuration root.
+func (*CacheConfig) Name() string {
+	return "cache"
+}
+
+// CacheComponent implements the settings.Component interface.
+type CacheComponent struct {
+	Backend string
+	Path    string
+}
+
+// Cache satisfies the NewComponent signature.
+func Cache(_ context.Context, backend string, path string, _ string) (interface{}, error) {
+	return &CacheComponent{Backend: backend, Path: path}, nil
+}
+
+// Settings generates a config populated with defaults.
+func (*CacheComponent) Settings() *CacheConfig {
+	return &CacheConfig{
+		MaxEntries: 1000,
+		MaxSize:    64 * 1024 * 1024,
+		Header:     "X-Cache",
+		Metric:     "http.client.cache",
+	}
+}
+
+// New generates the middleware.
+func (c *CacheComponent) New(ctx context.Context, conf *CacheConfig) (func(http.RoundTripper) http.RoundTripper, error) { // nolint
+	if conf.MaxEntries < 1 || conf.MaxSize < 1 {
+		return nil, fmt.Errorf("cache maxentries and maxsize must be greater than zero")
+	}
+	if conf.TTL < 0 || conf.StaleWhileRevalidate < 0 || conf.StaleIfError < 0 {
+		return nil, fmt.Errorf("cache durations must not be negative")
+	}
+	if transportd.StreamingFromContext(ctx) {
+		// A streamed response cannot be stored without buffering it.
+		return func(next http.RoundTripper) http.RoundTripper { return next }, nil
+	}
+	return func(next http.RoundTripper) http.RoundTripper {
+		return &cacheTransport{
+			Backend: c.Backend,
+			Path:    c.Path,
+			Conf:    conf,
+			Wrapped: next,
+			store:   newCacheStore(conf.MaxEntries, conf.MaxSize),
+			now:     time.Now,
+		}
+	}, nil
+}
+
+// cacheControl is the set of parsed Cache-Control directives.
+type cacheControl map[string]string
+
+func parseCacheControl(h http.Header) cacheControl {
+	cc := cacheControl{}
+	for _, value := range h.Values("Cache-Control") {
+		for _, directive := range strings.Split(value, ",") {
+			directive = strings.TrimSpace(directive)
+			if directive == "" {
+				continue
+			}
+			name, arg, _ := strings.Cut(directive, "=")
+			cc[strings.ToLower(strings.TrimSpace(name))] = strings.Trim(strings.TrimSpace(arg), `"`)
+		}
+	}
+	return cc
+}
+
+func (cc cacheControl) has(directive string) bool {
+	_, ok := cc[directive]
+	return ok
+}
+
+// seconds returns the duration value of a directive.
+func (cc cacheControl) seconds(directive string) (time.Duration, bool) {
+	v, ok := cc[directive]
+	if !ok {
+		return 0, false
+	}
+	n, err := strconv.Atoi(v)
+	if err != nil || n < 0 {
+		return 0, false
+	}
+	return time.Duration(n) * time.Second, true
+}
+
+// cacheEntry is a stored response. Entries are never modified once stored.
+type cacheEntry struct {
+	key        string
+	status     int
+	header     http.Header
+	body       []byte
+	stored     time.Time
+	expires    time.Time
+	swr        time.Duration
+	sie        time.Duration
+	varyByName []string
+}
+
+func (e *cacheEntry) size() int {
+	size := len(e.body)
+	for name, values := range e.header {
+		size = size + len(name)
+		for _, value := range values {
+			size = size + len(value)
+		}
+	}
+	return size
+}
+
+type varyRecord struct {
+	names []string
+	refs  int
+}
+
+// cacheStore is an LRU set of responses bounded by both entry count and
+// total size. Responses are indexed by the request URI and the values of the
+// request headers named by the Vary header of the response.
+type cacheStore struct {
+	lock         sync.Mutex
+	maxEntries   int
+	maxSize      int
+	size         int
+	order        *list.List
+	entries      map[string]*list.Element
+	vary         map[string]*varyRecord
+	revalidating map[string]bool
+}
+
+func newCacheStore(maxEntries int, maxSize int) *cacheStore {
+	return &cacheStore{
+		maxEntries:   maxEntries,
+		maxSize:      maxSize,
+		order:        list.New(),
+		entries:      make(map[string]*list.Element),
+		vary:         make(map[string]*varyRecord),
+		revalidating: make(map[string]bool),
+	}
+}
+
+func cacheKey(primary string, names []string, h http.Header) string {
+	var b strings.Builder
+	b.WriteString(primary)
+	for _, name := range names {
+		b.WriteString("\x00")
+		b.WriteString(name)
+		b.WriteString("=")
+		b.WriteString(strings.Join(h.Values(name), ","))
+	}
+	return b.String()
+}
+
+func (s *cacheStore) Get(primary string, h http.Header) *cacheEntry {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	record, ok := s.vary[primary]
+	if !ok {
+		return nil
+	}
+	e, ok := s.entries[cacheKey(primary, record.names, h)]
+	if !ok {
+		return nil
+	}
+	s.order.MoveToFront(e)
+	return e.Value.(*cacheEntry)
+}
+
+func (s *cacheStore) Put(primary string, h http.Header, entry *cacheEntry) {
+	size := entry.size()
+	if size > s.maxSize {
+		return
+	}
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	entry.key = cacheKey(primary, entry.varyByName, h)
+	if e, ok := s.entries[entry.key]; ok {
+		s.remove(e)
+	}
+	record, ok := s.vary[primary]
+	if !ok {
+		record = &varyRecord{}
+		s.vary[primary] = record
+	}
+	// The most recent response decides which headers select a variant. Older
+	// variants that were stored under different headers become unreachable
+	// and age out of the cache.
+	record.names = entry.varyByName
+	record.refs = record.refs + 1
+	s.entries[entry.key] = s.order.PushFront(entry)
+	s.size = s.size + size
+	for s.order.Len() > s.maxEntries || s.size > s.maxSize {
+		s.remove(s.order.Back())
+	}
+}
+
+// remove drops an entry from the cache. The caller must hold the lock.
+func (s *cacheStore) remove(e *list.Element) {
+	entry := s.order.Remove(e).(*cacheEntry)
+	delete(s.entries, entry.key)
+	s.size = s.size - entry.size()
+	primary, _, _ := strings.Cut(entry.key, "\x00")
+	if record, ok := s.vary[primary]; ok {
+		record.refs = record.refs - 1
+		if record.refs < 1 {
+			delete(s.vary, primary)
+		}
+	}
+}
+
+// StartRevalidation reports whether the caller should refresh the entry. Only
+// one refresh of an entry runs at a time.
+func (s *cacheStore) StartRevalidation(key string) bool {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if s.revalidating[key] {
+		return false
+	}
+	s.revalidating[key] = true
+	return true
+}
+
+func (s *cacheStore) EndRevalidation(key string) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	delete(s.revalidating, key)
+}
+
+type cacheTransport struct {
+	Backend string
+	Path    string
+	Conf    *CacheConfig
+	Wrapped http.RoundTripper
+
+	store *cacheStore
+	now   func() time.Time
+}
+
+func (t *cacheTransport) RoundTrip(r *http.Request) (*http.Response, error) {
+	if r.Method != http.MethodGet {
+		return t.Wrapped.RoundTrip(r)
+	}
+	reqCC := parseCacheControl(r.Header)
+	if reqCC.has("no-store") {
+		resp, err := t.Wrapped.RoundTrip(r)
+		if err == nil {
+			t.report(r.Context(), resp, cacheBypass)
+		}
+		return resp, err
+	}
+	primary := r.URL.RequestURI()
+	now := t.now()
+	entry := t.store.Get(primary, r.Header)
+	if entry != nil && !reqCC.has("no-cache") {
+		if now.Before(entry.expires) {
+			return t.serve(r, entry, cacheHit), nil
+		}
+		if now.Before(entry.expires.Add(entry.swr)) {
+			if t.store.StartRevalidation(entry.key) {
+				go t.revalidate(r, primary, entry)
+			}
+			return t.serve(r, entry, cacheStale), nil
+		}
+	}
+
+	out := r
+	validated := false
+	if entry != nil && r.Header.Get("If-None-Match") == "" && r.Header.Get("If-Modified-Since") == "" {
+		out, validated = withValidators(r, entry)
+	}
+	resp, err := t.Wrapped.RoundTrip(out)
+	if entry != nil && (err != nil || resp.StatusCode >= http.StatusInternalServerError) && now.Before(entry.expires.Add(entry.sie)) {
+		if err == nil {
+			_, _ = io.Copy(io.Discard, resp.Body)
+			_ = resp.Body.Close()
+		}
+		return t.serve(r, entry, cacheStale), nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if validated && resp.StatusCode == http.StatusNotModified {
+		_ = resp.Body.Close()
+		refreshed := t.refresh(primary, r.Header, entry, resp.Header)
+		return t.serve(r, refreshed, cacheRevalidated), nil
+	}
+	t.maybeStore(r, primary, resp)
+	t.report(r.Context(), resp, cacheMiss)
+	return resp, nil
+}
+
+// withValidators copies a request and adds the conditional headers needed
+// to revalidate an entry. The result is false if the entry has no
+// validators.
+func withValidators(r *http.Request, entry *cacheEntry) (*http.Request, bool) {
+	etag := entry.header.Get("ETag")
+	lastModified := entry.header.Get("Last-Modified")
+	if etag == "" && lastModified == "" {
+		return r, false
+	}
+	out := r.Clone(r.Context())
+	if etag != "" {
+		out.Header.Set("If-None-Match", etag)
+	}
+	if lastModified != "" {
+		out.Header.Set("If-Modified-Since", lastModified)
+	}
+	return out, true
+}
+
+// revalidate refreshes a stale entry in the background.
+func (t *cacheTransport) revalidate(r *http.Request, primary string, entry *cacheEntry) {
+	defer t.store.EndRevalidation(entry.key)
+	r = r.Clone(context.WithoutCancel(r.Context()))
+	r.Header.Del("If-None-Match")
+	r.Header.Del("If-Modified-Since")
+	out, validated := withValidators(r, entry)
+	resp, err := t.Wrapped.RoundTrip(out)
+	if err != nil {
+		return
+	}
+	defer resp.Body.Close()
+	if validated && resp.StatusCode == http.StatusNotModified {
+		t.refresh(primary, r.Header, entry, resp.Header)
+		return
+	}
+	t.maybeStore(r, primary, resp)
+	_, _ = io.Copy(io.Discard, resp.Body)
+}
+
+// refresh stores a copy of the entry with the headers of a 304 response
+// merged in and a new freshness lifetime.
+func (t *cacheTransport) refresh(primary string, h http.Header, entry *cacheEntry, update http.Header) *cacheEntry {
+	header := entry.header.Clone()
+	for name, values := range update {
+		header[name] = values
+	}
+	refreshed := &cacheEntry{
+		status:     entry.status,
+		header:     header,
+		body:       entry.body,
+		varyByName: entry.varyByName,
+	}
+	if !t.fresh(refreshed, false) {
+		return entry
+	}
+	t.store.Put(primary, h, refreshed)
+	return refreshed
+}
+
+// fresh computes the freshness lifetime of an entry from its headers. The
+// result is false if the entry must not be stored.
+func (t *cacheTransport) fresh(entry *cacheEntry, authorized bool) bool {
+	cc := parseCacheControl(entry.header)
+	if cc.has("no-store") || cc.has("no-cache") || cc.has("private") {
+		return false
+	}
+	// Responses to requests with credentials are only shared when the
+	// backend says so.
+	if authorized && !cc.has("public") && !cc.has("s-maxage") && !cc.has("must-revalidate") {
+		return false
+	}
+	now := t.now()
+	ttl := t.Conf.TTL
+	if ttl == 0 {
+		if v, ok := cc.seconds("s-maxage"); ok {
+			ttl = v
+		} else if v, ok := cc.seconds("max-age"); ok {
+			ttl = v
+		} else if expires, err := http.ParseTime(entry.header.Get("Expires")); err == nil {
+			date, err := http.ParseTime(entry.header.Get("Date"))
+			if err != nil {
+				date = now
+			}
+			ttl = expires.Sub(date)
+		}
+	}
+	if ttl <= 0 {
+		return false
+	}
+	entry.stored = now
+	entry.expires = now.Add(ttl)
+	entry.swr = t.Conf.StaleWhileRevalidate
+	if v, ok := cc.seconds("stale-while-revalidate"); ok {
+		entry.swr = v
+	}
+	entry.sie = t.Conf.StaleIfError
+	if v, ok := cc.seconds("stale-if-error"); ok {
+		entry.sie = v
+	}
+	if cc.has("must-revalidate") || cc.has("proxy-revalidate") {
+		entry.swr = 0
+		entry.sie = 0
+	}
+	return true
+}
+
+// maybeStore adds the response to the cache if it is allowed. The body of
+// the response is replaced with a buffered copy when it is stored.
+func (t *cacheTransport) maybeStore(r *http.Request, primary string, resp *http.Response) {
+	if !cacheableStatus[resp.StatusCode] || resp.ContentLength > int64(t.Conf.MaxSize) {
+		return
+	}
+	var varyByName []string
+	for _, value := range resp.Header.Values("Vary") {
+		for _, name := range strings.Split(value, ",") {
+			name = strings.TrimSpace(name)
+			if name == "*" {
+				return
+			}
+			if name != "" {
+				varyByName = append(varyByName, http.CanonicalHeaderKey(name))
+			}
+		}
+	}
+	entry := &cacheEntry{status: resp.StatusCode, header: resp.Header.Clone(), varyByName: varyByName}
+	if !t.fresh(entry, r.Header.Get("Authorization") != "") {
+		return
+	}
+	body, err := io.ReadAll(io.LimitReader(resp.Body, int64(t.Conf.MaxSize)+1))
+	if err != nil || len(body) > t.Conf.MaxSize {
+		// Hand back what was read, followed by the rest of the body or the
+		// read error, without storing anything.
+		resp.Body = transportd.PrependBody(body, resp.Body, err)
+		return
+	}
+	_ = resp.Body.Close()
+	resp.Body = io.NopCloser(bytes.NewReader(body))
+	entry.body = body
+	t.store.Put(primary, r.Header, entry)
+}
+
+// serve builds a response from an entry. Conditional requests that match the
+// entry receive a 304.
+func (t *cacheTransport) serve(r *http.Request, entry *cacheEntry, result string) *http.Response {
+	var resp *http.Response
+	if notModified(r, entry) {
+		header := http.Header{}
+		for _, name := range notModifiedHeaders {
+			if values := entry.header.Values(name); len(values) > 0 {
+				header[http.CanonicalHeaderKey(name)] = values
+			}
+		}
+		resp = &http.Response{
+			Status:     http.StatusText(http.StatusNotModified),
+			StatusCode: http.StatusNotModified,
+			Header:     header,
+			Body:       http.NoBody,
+		}
+	} else {
+		resp = &http.Response{
+			Status:        http.StatusText(entry.status),
+			StatusCode:    entry.status,
+			Header:        entry.header.Clone(),
+			Body:          io.NopCloser(bytes.NewReader(entry.body)),
+			ContentLength: int64(len(entry.body)),
+		}
+	}
+	resp.Proto, resp.ProtoMajor, resp.ProtoMinor = r.Proto, r.ProtoMajor, r.ProtoMinor
+	resp.Request = r
+	resp.Header.Set("Age", strconv.Itoa(int(t.now().Sub(entry.stored).Seconds())))
+	t.report(r.Context(), resp, result)
+	return resp
+}
+
+func (t *cacheTransport) report(ctx context.Context, resp *http.Response, result string) {
+	if t.Conf.Header != "" {
+		resp.Header.Set(t.Conf.Header, result)
+	}
+	runhttp.StatFromContext(ctx).Count(
+		t.Conf.Metric, 1,
+		"client_dependency:"+t.Backend, "client_path:"+t.Path, "result:"+strings.ToLower(result),
+	)
+}
+
+// notModified evaluates the conditional headers of a request against an
+// entry.
+func notModified(r *http.Request, entry *cacheEntry) bool {
+	if entry.status != http.StatusOK {
+		return false
+	}
+	if inm := r.Header.Get("If-None-Match"); inm != "" {
+		etag := strings.TrimPrefix(entry.header.Get("ETag"), "W/")
+		if etag == "" {
+			return false
+		}
+		for _, candidate := range strings.Split(inm, ",") {
+			candidate = strings.TrimSpace(candidate)
+			if candidate == "*" || strings.TrimPrefix(candidate, "W/") == etag {
+				return true
+			}
+		}
+		return false
+	}
+	ims, err := http.ParseTime(r.Header.Get("If-Modified-Since"))
+	if err != nil {
+		return false
+	}
+	lastModified, err := http.ParseTime(entry.header.Get("Last-Modified"))
+	if err != nil {
+		return false
+	}
+	return !lastModified.After(ims)
+}
@@ -0,0 +1,275 @@
+package components
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	transportd "github.com/asecurityteam/transportd/pkg"
+	"github.com/golang/mock/gomock"
+	"github.com/stretchr/testify/assert"
+)
+
+func cacheResponse(status int, body string, header http.Header) *http.Response {
+	if header == nil {
+		header = http.Header{}
+	}
+	return &http.Response{
+		StatusCode: status,
+		Header:     header,
+		Body:       io.NopCloser(strings.NewReader(body)),
+	}
+}
+
+func readBody(t *testing.T, resp *http.Response) string {
+	b, err := io.ReadAll(resp.Body)
+	assert.Nil(t, err)
+	return string(b)
+}
+
+func TestCacheHit(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	wrapped := NewMockRoundTripper(ctrl)
+	now := time.Unix(0, 0)
+	c := &CacheComponent{Backend: "backend", Path: "/"}
+	f, err := c.New(context.Background(), c.Settings())
+	assert.Nil(t, err)
+	rt := f(wrapped).(*cacheTransport)
+	rt.now = func() time.Time { return now }
+	req, _ := http.NewRequest(http.MethodGet, "http://localhost/a?b=c", http.NoBody)
+
+	wrapped.EXPECT().RoundTrip(req).Return(cacheResponse(http.StatusOK, "body", http.Header{"Cache-Control": []string{"max-age=60"}}), nil)
+	resp, err := rt.RoundTrip(req)
+	assert.Nil(t, err)
+	assert.Equal(t, cacheMiss, resp.Header.Get("X-Cache"))
+	assert.Equal(t, "body", readBody(t, resp))
+
+	now = now.Add(30 * time.Second)
+	resp, err = rt.RoundTrip(req)
+	assert.Nil(t, err)
+	assert.Equal(t, cacheHit, resp.Header.Get("X-Cache"))
+	assert.Equal(t, "30", resp.Header.Get("Age"))
+	assert.Equal(t, "body", readBody(t, resp))
+}
+
+func TestCacheNotStored(t *testing.T) {
+	tests := []struct {
+		name   string
+		header http.Header
+		status int
+	}{
+		{name: "no-store", header: http.Header{"Cache-Control": []string{"no-store, max-age=60"}}, status: http.StatusOK},
+		{name: "private", header: http.Header{"Cache-Control": []string{"private, max-age=60"}}, status: http.StatusOK},
+		{name: "no freshness", header: http.Header{}, status: http.StatusOK},
+		{name: "vary all", header: http.Header{"Cache-Control": []string{"max-age=60"}, "Vary": []string{"*"}}, status: http.StatusOK},
+		{name: "uncacheable status", header: http.Header{"Cache-Control": []string{"max-age=60"}}, status: http.StatusInternalServerError},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctrl := gomock.NewController(t)
+			defer ctrl.Finish()
+
+			wrapped := NewMockRoundTripper(ctrl)
+			now := time.Unix(0, 0)
+			c := &CacheComponent{Backend: "backend", Path: "/"}
+			f, err := c.New(context.Background(), c.Settings())
+			assert.Nil(t, err)
+			rt := f(wrapped).(*cacheTransport)
+			rt.now = func() time.Time { return now }
+			req, _ := http.NewRequest(http.MethodGet, "http://localhost/", http.NoBody)
+			wrapped.EXPECT().RoundTrip(gomock.Any()).DoAndReturn(func(*http.Request) (*http.Response, error) {
+				return cacheResponse(tt.status, "body", tt.header.Clone()), nil
+			}).Times(2)
+			_, _ = rt.RoundTrip(req)
+			resp, _ := rt.RoundTrip(req)
+			assert.Equal(t, cacheMiss, resp.Header.Get("X-Cache"))
+		})
+	}
+}
+
+func TestCacheVary(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	wrapped := NewMockRoundTripper(ctrl)
+	now := time.Unix(0, 0)
+	c := &CacheComponent{Backend: "backend", Path: "/"}
+	f, err := c.New(context.Background(), c.Settings())
+	assert.Nil(t, err)
+	rt := f(wrapped).(*cacheTransport)
+	rt.now = func() time.Time { return now }
+	header := http.Header{"Cache-Control": []string{"max-age=60"}, "Vary": []string{"Accept"}}
+	jsonReq, _ := http.NewRequest(http.MethodGet, "http://localhost/", http.NoBody)
+	jsonReq.Header.Set("Accept", "application/json")
+	textReq, _ := http.NewRequest(http.MethodGet, "http://localhost/", http.NoBody)
+	textReq.Header.Set("Accept", "text/plain")
+
+	wrapped.EXPECT().RoundTrip(jsonReq).Return(cacheResponse(http.StatusOK, "json", header.Clone()), nil)
+	wrapped.EXPECT().RoundTrip(textReq).Return(cacheResponse(http.StatusOK, "text", header.Clone()), nil)
+	_, _ = rt.RoundTrip(jsonReq)
+	_, _ = rt.RoundTrip(textReq)
+
+	resp, _ := rt.RoundTrip(jsonReq)
+	assert.Equal(t, cacheHit, resp.Header.Get("X-Cache"))
+	assert.Equal(t, "json", readBody(t, resp))
+	resp, _ = rt.RoundTrip(textReq)
+	assert.Equal(t, cacheHit, resp.Header.Get("X-Cache"))
+	assert.Equal(t, "text", readBody(t, resp))
+}
+
+func TestCacheConditional(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	wrapped := NewMockRoundTripper(ctrl)
+	now := time.Unix(0, 0)
+	c := &CacheComponent{Backend: "backend", Path: "/"}
+	f, err := c.New(context.Background(), c.Settings())
+	assert.Nil(t, err)
+	rt := f(wrapped).(*cacheTransport)
+	rt.now = func() time.Time { return now }
+	req, _ := http.NewRequest(http.MethodGet, "http://localhost/", http.NoBody)
+	wrapped.EXPECT().RoundTrip(req).Return(cacheResponse(http.StatusOK, "body", http.Header{
+		"Cache-Control": []string{"max-age=60"},
+		"Etag":          []string{`"v1"`},
+	}), nil)
+	_, _ = rt.RoundTrip(req)
+
+	conditional, _ := http.NewRequest(http.MethodGet, "http://localhost/", http.NoBody)
+	conditional.Header.Set("If-None-Match", `W/"v1"`)
+	resp, err := rt.RoundTrip(conditional)
+	assert.Nil(t, err)
+	assert.Equal(t, http.StatusNotModified, resp.StatusCode)
+	assert.Equal(t, `"v1"`, resp.Header.Get("ETag"))
+}
+
+func TestCacheRevalidate(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	wrapped := NewMockRoundTripper(ctrl)
+	now := time.Unix(0, 0)
+	c := &CacheComponent{Backend: "backend", Path: "/"}
+	f, err := c.New(context.Background(), c.Settings())
+	assert.Nil(t, err)
+	rt := f(wrapped).(*cacheTransport)
+	rt.now = func() time.Time { return now }
+	req, _ := http.NewRequest(http.MethodGet, "http://localhost/", http.NoBody)
+	wrapped.EXPECT().RoundTrip(req).Return(cacheResponse(http.StatusOK, "body", http.Header{
+		"Cache-Control": []string{"max-age=60"},
+		"Etag":          []string{`"v1"`},
+	}), nil)
+	_, _ = rt.RoundTrip(req)
+
+	now = now.Add(time.Minute)
+	wrapped.EXPECT().RoundTrip(gomock.Any()).DoAndReturn(func(r *http.Request) (*http.Response, error) {
+		assert.Equal(t, `"v1"`, r.Header.Get("If-None-Match"))
+		return cacheResponse(http.StatusNotModified, "", http.Header{"Cache-Control": []string{"max-age=120"}}), nil
+	})
+	resp, err := rt.RoundTrip(req)
+	assert.Nil(t, err)
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Equal(t, cacheRevalidated, resp.Header.Get("X-Cache"))
+	assert.Equal(t, "body", readBody(t, resp))
+
+	now = now.Add(90 * time.Second)
+	resp, _ = rt.RoundTrip(req)
+	assert.Equal(t, cacheHit, resp.Header.Get("X-Cache"), "revalidation did not extend freshness")
+}
+
+func TestCacheStaleWhileRevalidate(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	wrapped := NewMockRoundTripper(ctrl)
+	now := time.Unix(0, 0)
+	c := &CacheComponent{Backend: "backend", Path: "/"}
+	f, err := c.New(context.Background(), c.Settings())
+	assert.Nil(t, err)
+	rt := f(wrapped).(*cacheTransport)
+	rt.now = func() time.Time { return now }
+	req, _ := http.NewRequest(http.MethodGet, "http://localhost/", http.NoBody)
+	wrapped.EXPECT().RoundTrip(req).Return(cacheResponse(http.StatusOK, "old", http.Header{
+		"Cache-Control": []string{"max-age=60, stale-while-revalidate=30"},
+	}), nil)
+	_, _ = rt.RoundTrip(req)
+
+	now = now.Add(70 * time.Second)
+	done := make(chan struct{})
+	wrapped.EXPECT().RoundTrip(gomock.Any()).DoAndReturn(func(*http.Request) (*http.Response, error) {
+		defer close(done)
+		return cacheResponse(http.StatusOK, "new", http.Header{"Cache-Control": []string{"max-age=60"}}), nil
+	})
+	resp, _ := rt.RoundTrip(req)
+	assert.Equal(t, cacheStale, resp.Header.Get("X-Cache"))
+	assert.Equal(t, "old", readBody(t, resp))
+	<-done
+	for x := 0; x < 100 && string(rt.store.Get("/", req.Header).body) != "new"; x = x + 1 {
+		time.Sleep(time.Millisecond)
+	}
+	resp, _ = rt.RoundTrip(req)
+	assert.Equal(t, cacheHit, resp.Header.Get("X-Cache"))
+	assert.Equal(t, "new", readBody(t, resp))
+}
+
+func TestCacheStaleIfError(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	wrapped := NewMockRoundTripper(ctrl)
+	now := time.Unix(0, 0)
+	c := &CacheComponent{Backend: "backend", Path: "/"}
+	f, err := c.New(context.Background(), c.Settings())
+	assert.Nil(t, err)
+	rt := f(wrapped).(*cacheTransport)
+	rt.now = func() time.Time { return now }
+	req, _ := http.NewRequest(http.MethodGet, "http://localhost/", http.NoBody)
+	wrapped.EXPECT().RoundTrip(req).Return(cacheResponse(http.StatusOK, "body", http.Header{
+		"Cache-Control": []string{"max-age=60, stale-if-error=60"},
+	}), nil)
+	_, _ = rt.RoundTrip(req)
+
+	now = now.Add(90 * time.Second)
+	wrapped.EXPECT().RoundTrip(req).Return(nil, errors.New("connection refused"))
+	resp, err := rt.RoundTrip(req)
+	assert.Nil(t, err)
+	assert.Equal(t, cacheStale, resp.Header.Get("X-Cache"))
+
+	now = now.Add(time.Minute)
+	wrapped.EXPECT().RoundTrip(req).Return(nil, errors.New("connection refused"))
+	_, err = rt.RoundTrip(req)
+	assert.NotNil(t, err, "served a response older than stale-if-error allows")
+}
+
+func TestCacheStoreBounds(t *testing.T) {
+	s := newCacheStore(2, 10)
+	h := http.Header{}
+	s.Put("/a", h, &cacheEntry{body: []byte("aaaa")})
+	s.Put("/b", h, &cacheEntry{body: []byte("bbbb")})
+	assert.NotNil(t, s.Get("/a", h))
+	s.Put("/c", h, &cacheEntry{body: []byte("cccc")})
+	assert.Nil(t, s.Get("/b", h), "least recently used entry was kept")
+	assert.NotNil(t, s.Get("/a", h))
+	s.Put("/d", h, &cacheEntry{body: []byte("dddddddd")})
+	assert.Equal(t, 1, s.order.Len(), "size bound was not enforced")
+	s.Put("/e", h, &cacheEntry{body: []byte("eeeeeeeeeeee")})
+	assert.Nil(t, s.Get("/e", h), "stored an entry larger than the cache")
+	assert.Len(t, s.vary, 1)
+}
+
+func TestCacheStreaming(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	wrapped := NewMockRoundTripper(ctrl)
+	c := &CacheComponent{Backend: "backend", Path: "/"}
+	f, err := c.New(transportd.StreamingToContext(context.Background(), true), c.Settings())
+	assert.Nil(t, err)
+	assert.Equal(t, wrapped, f(wrapped), "caching was applied to a streaming route")
+}
@@ -0,0 +1,317 @@
+package components
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/asecurityteam/runhttp"
+	transportd "github.com/asecurityteam/transportd/pkg"
+)
+
+const (
+	// CircuitBreakerScopeRoute gives each route its own breaker.
+	CircuitBreakerScopeRoute = "route"
+	// CircuitBreakerScopeBackend shares one breaker between all routes of a
+	// backend that use the same breaker settings.
+	CircuitBreakerScopeBackend = "backend"
+
+	breakerClosed   = "closed"
+	breakerOpen     = "open"
+	breakerHalfOpen = "halfopen"
+
+	// breakerBuckets is the number of buckets in the rolling window.
+	breakerBuckets = 10
+)
+
+// CircuitBreakerConfig contains settings for the circuit breaker.
+type CircuitBreakerConfig struct {
+	Scope               string        `description:"Either route or backend. Backend scoped breakers are shared by all routes of the backend."`
+	ConsecutiveFailures int           `description:"Consecutive failures that open the breaker. Zero disables the check."`
+	ErrorPercent        int           `description:"Percent of failed requests within the window that opens the breaker. Zero disables the check."`
+	MinimumRequests     int           `description:"Minimum requests within the window before the error percent is evaluated."`
+	Window              time.Duration `description:"Duration of the rolling window used to compute the error percent."`
+	OpenDuration        time.Duration `description:"Time the breaker stays open before allowing trial requests."`
+	HalfOpenRequests    int           `description:"Successful trial requests needed to close the breaker."`
+	Codes               []int         `description:"HTTP status codes that count as failures."`
+	TransitionMetric    string        `description:"Name of the state transition count metric."`
+	RejectedMetric      string        `description:"Name of the rejected request count metric."`
+}
+
+// Name of the configuration root.
+func (*CircuitBreakerConfig) Name() string {
+	return "circuitbreaker"
+}
+
+// CircuitBreakerComponent implements the settings.Component interface.
+type CircuitBreakerComponent struct {
+	Backend string
+	Path    string
+	Method  string
+}
+
+// CircuitBreaker satisfies the NewComponent signature.
+func CircuitBreaker(_ context.Context, backend string, path string, method string) (interface{}, error) {
+	return &CircuitBreakerComponent{Backend: backend, Path: path, Method: method}, nil
+}
+
+// Settings generates a config populated with defaults.
+func (*CircuitBreakerComponent) Settings() *CircuitBreakerConfig {
+	return &CircuitBreakerConfig{
+		Scope:               CircuitBreakerScopeRoute,
+		ConsecutiveFailures: 5,
+		ErrorPercent:        50,
+		MinimumRequests:     20,
+		Window:              10 * time.Second,
+		OpenDuration:        30 * time.Second,
+		HalfOpenRequests:    1,
+		Codes:               defaultRetryCodes,
+		TransitionMetric:    "http.client.circuitbreaker.transition",
+		RejectedMetric:      "http.client.circuitbreaker.rejected",
+	}
+}
+
+// BackendPhase builds the component for each backend of a route.
+func (*CircuitBreakerComponent) BackendPhase() {}
+
+// New generates the middleware.
+func (c *CircuitBreakerComponent) New(ctx context.Context, conf *CircuitBreakerConfig) (func(http.RoundTripper) http.RoundTripper, error) { // nolint
+	if conf.ConsecutiveFailures < 0 || conf.ErrorPercent < 0 || conf.ErrorPercent > 100 {
+		return nil, fmt.Errorf("circuit breaker thresholds must be positive and error percent no more than 100")
+	}
+	if conf.ConsecutiveFailures == 0 && conf.ErrorPercent == 0 {
+		return nil, fmt.Errorf("circuit breaker needs at least one of consecutivefailures or errorpercent")
+	}
+	if conf.Window < breakerBuckets {
+		return nil, fmt.Errorf("circuit breaker window must be at least %s", time.Duration(breakerBuckets))
+	}
+	if conf.OpenDuration <= 0 {
+		return nil, fmt.Errorf("circuit breaker open duration must be greater than zero")
+	}
+	if conf.HalfOpenRequests < 1 {
+		return nil, fmt.Errorf("circuit breaker half open requests must be greater than zero")
+	}
+	var breaker *circuitBreaker
+	switch strings.ToLower(conf.Scope) {
+	case CircuitBreakerScopeRoute:
+		breaker = newCircuitBreaker(fmt.Sprintf("%s %s %s", c.Backend, strings.ToUpper(c.Method), c.Path), conf)
+	case CircuitBreakerScopeBackend:
+		// Backend scoped breakers live in the state of the transport being
+		// built so that a reload starts over with closed breakers rather than
+		// keeping the breakers of the replaced configuration.
+		shared := transportd.SharedStateFromContext(ctx)
+		if shared == nil {
+			shared = transportd.NewSharedState()
+		}
+		key := fmt.Sprintf("circuitbreaker %s %+v", c.Backend, *conf)
+		breaker = shared.LoadOrStore(key, func() interface{} {
+			return newCircuitBreaker(c.Backend, conf)
+		}).(*circuitBreaker)
+	default:
+		return nil, fmt.Errorf("unknown circuit breaker scope %s", conf.Scope)
+	}
+	return func(next http.RoundTripper) http.RoundTripper {
+		return &circuitBreakerTransport{
+			Backend: c.Backend,
+			Breaker: breaker,
+			Wrapped: next,
+		}
+	}, nil
+}
+
+type breakerBucket struct {
+	index    int64
+	total    int
+	failures int
+}
+
+// circuitBreaker is the state machine shared by every request that passes
+// through a breaker.
+type circuitBreaker struct {
+	Name string
+	Conf *CircuitBreakerConfig
+
+	lock        sync.Mutex
+	state       string
+	openedAt    time.Time
+	consecutive int
+	buckets     [breakerBuckets]breakerBucket
+	// trials and successes track the requests allowed through while the
+	// breaker is half open.
+	trials    int
+	successes int
+	now       func() time.Time
+}
+
+func newCircuitBreaker(name string, conf *CircuitBreakerConfig) *circuitBreaker {
+	return &circuitBreaker{Name: name, Conf: conf, state: breakerClosed, now: time.Now}
+}
+
+// breakerTransition describes a change of state. The zero value means the
+// state did not change.
+type breakerTransition struct {
+	From string
+	To   string
+}
+
+// Allow reports whether a request may proceed.
+func (b *circuitBreaker) Allow() (bool, breakerTransition) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	var transition breakerTransition
+	if b.state == breakerOpen && !b.now().Before(b.openedAt.Add(b.Conf.OpenDuration)) {
+		transition = b.setState(breakerHalfOpen)
+	}
+	switch b.state {
+	case breakerOpen:
+		return false, transition
+	case breakerHalfOpen:
+		if b.trials >= b.Conf.HalfOpenRequests {
+			return false, transition
+		}
+		b.trials = b.trials + 1
+	}
+	return true, transition
+}
+
+// Record updates the breaker with the outcome of a request that was allowed.
+func (b *circuitBreaker) Record(failed bool) breakerTransition {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	switch b.state {
+	case breakerHalfOpen:
+		if failed {
+			return b.setState(breakerOpen)
+		}
+		b.successes = b.successes + 1
+		if b.successes >= b.Conf.HalfOpenRequests {
+			return b.setState(breakerClosed)
+		}
+	case breakerClosed:
+		total, failures := b.count(failed)
+		if failed {
+			b.consecutive = b.consecutive + 1
+		} else {
+			b.consecutive = 0
+		}
+		if b.Conf.ConsecutiveFailures > 0 && b.consecutive >= b.Conf.ConsecutiveFailures {
+			return b.setState(breakerOpen)
+		}
+		if b.Conf.ErrorPercent > 0 && total >= b.Conf.MinimumRequests && failures*100 >= total*b.Conf.ErrorPercent {
+			return b.setState(breakerOpen)
+		}
+	}
+	// Results that arrive while the breaker is open belong to requests that
+	// were in flight when it opened and are ignored.
+	return breakerTransition{}
+}
+
+// Release returns the trial slot of a request that was allowed but whose
+// outcome should not be counted.
+func (b *circuitBreaker) Release() {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	if b.state == breakerHalfOpen && b.trials > 0 {
+		b.trials = b.trials - 1
+	}
+}
+
+// count adds a result to the rolling window and returns the totals for the
+// window. The caller must hold the lock.
+func (b *circuitBreaker) count(failed bool) (int, int) {
+	width := int64(b.Conf.Window / breakerBuckets)
+	index := b.now().UnixNano() / width
+	bucket := &b.buckets[index%breakerBuckets]
+	if bucket.index != index {
+		*bucket = breakerBucket{index: index}
+	}
+	bucket.total = bucket.total + 1
+	if failed {
+		bucket.failures = bucket.failures + 1
+	}
+	total, failures := 0, 0
+	for _, bkt := range b.buckets {
+		if index-bkt.index < breakerBuckets {
+			total = total + bkt.total
+			failures = failures + bkt.failures
+		}
+	}
+	return total, failures
+}
+
+// setState moves the breaker into a new state and resets the counters that
+// belong to the previous one. The caller must hold the lock.
+func (b *circuitBreaker) setState(state string) breakerTransition {
+	transition := breakerTransition{From: b.state, To: state}
+	b.state = state
+	b.trials = 0
+	b.successes = 0
+	b.consecutive = 0
+	switch state {
+	case breakerOpen:
+		b.openedAt = b.now()
+	case breakerClosed:
+		b.buckets = [breakerBuckets]breakerBucket{}
+	}
+	return transition
+}
+
+type circuitBreakerEvent struct {
+	Message string `logevent:"message,default=circuit-breaker-state-changed"`
+	Breaker string `logevent:"breaker"`
+	From    string `logevent:"from"`
+	To      string `logevent:"to"`
+}
+
+type circuitBreakerTransport struct {
+	Backend string
+	Breaker *circuitBreaker
+	Wrapped http.RoundTripper
+}
+
+func (t *circuitBreakerTransport) RoundTrip(r *http.Request) (*http.Response, error) {
+	ok, transition := t.Breaker.Allow()
+	t.report(r.Context(), transition)
+	if !ok {
+		runhttp.StatFromContext(r.Context()).Count(t.Breaker.Conf.RejectedMetric, 1, "client_dependency:"+t.Backend)
+		return newError(http.StatusServiceUnavailable, fmt.Sprintf("circuit breaker %s is open", t.Breaker.Name)), nil
+	}
+	resp, err := t.Wrapped.RoundTrip(r)
+	if err != nil && errors.Is(err, context.Canceled) {
+		// The caller gave up on the request, which says nothing about the
+		// health of the backend.
+		t.Breaker.Release()
+		return resp, err
+	}
+	t.report(r.Context(), t.Breaker.Record(err != nil || t.isFailure(resp.StatusCode)))
+	return resp, err
+}
+
+func (t *circuitBreakerTransport) isFailure(code int) bool {
+	for _, failure := range t.Breaker.Conf.Codes {
+		if code == failure {
+			return true
+		}
+	}
+	return false
+}
+
+func (t *circuitBreakerTransport) report(ctx context.Context, transition breakerTransition) {
+	if transition.To == "" {
+		return
+	}
+	event := circuitBreakerEvent{Breaker: t.Breaker.Name, From: transition.From, To: transition.To}
+	if transition.To == breakerOpen {
+		runhttp.LoggerFromContext(ctx).Warn(event)
+	} else {
+		runhttp.LoggerFromContext(ctx).Info(event)
+	}
+	runhttp.StatFromContext(ctx).Count(
+		t.Breaker.Conf.TransitionMetric, 1,
+		"client_dependency:"+t.Backend, "from:"+transition.From, "to:"+transition.To,
+	)
+}
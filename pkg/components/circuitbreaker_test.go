@@ -0,0 +1,153 @@
+package components
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/asecurityteam/logevent"
+	transportd "github.com/asecurityteam/transportd/pkg"
+	"github.com/golang/mock/gomock"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCircuitBreakerConsecutiveFailures(t *testing.T) {
+	conf := (&CircuitBreakerComponent{}).Settings()
+	conf.ConsecutiveFailures = 3
+	conf.ErrorPercent = 0
+	now := time.Unix(0, 0)
+	b := newCircuitBreaker("backend GET /", conf)
+	b.now = func() time.Time { return now }
+
+	for x := 0; x < 2; x = x + 1 {
+		ok, _ := b.Allow()
+		assert.True(t, ok)
+		assert.Equal(t, breakerTransition{}, b.Record(true))
+	}
+	_, _ = b.Allow()
+	assert.Equal(t, breakerTransition{}, b.Record(false), "success did not reset the count")
+	for x := 0; x < 2; x = x + 1 {
+		_, _ = b.Allow()
+		_ = b.Record(true)
+	}
+	_, _ = b.Allow()
+	assert.Equal(t, breakerTransition{From: breakerClosed, To: breakerOpen}, b.Record(true))
+	ok, _ := b.Allow()
+	assert.False(t, ok)
+}
+
+func TestCircuitBreakerErrorPercent(t *testing.T) {
+	conf := (&CircuitBreakerComponent{}).Settings()
+	conf.ConsecutiveFailures = 0
+	conf.ErrorPercent = 50
+	conf.MinimumRequests = 4
+	now := time.Unix(0, 0)
+	b := newCircuitBreaker("backend GET /", conf)
+	b.now = func() time.Time { return now }
+
+	_ = b.Record(true)
+	_ = b.Record(true)
+	_ = b.Record(false)
+	// Results that age out of the window no longer count.
+	now = now.Add(conf.Window)
+	assert.Equal(t, breakerTransition{}, b.Record(true))
+	assert.Equal(t, breakerTransition{}, b.Record(false))
+	assert.Equal(t, breakerTransition{}, b.Record(false))
+	assert.Equal(t, breakerTransition{From: breakerClosed, To: breakerOpen}, b.Record(true))
+}
+
+func TestCircuitBreakerHalfOpen(t *testing.T) {
+	conf := (&CircuitBreakerComponent{}).Settings()
+	conf.ConsecutiveFailures = 1
+	conf.HalfOpenRequests = 2
+	now := time.Unix(0, 0)
+	b := newCircuitBreaker("backend GET /", conf)
+	b.now = func() time.Time { return now }
+
+	_ = b.Record(true)
+	now = now.Add(conf.OpenDuration)
+	ok, transition := b.Allow()
+	assert.True(t, ok)
+	assert.Equal(t, breakerTransition{From: breakerOpen, To: breakerHalfOpen}, transition)
+	ok, _ = b.Allow()
+	assert.True(t, ok)
+	ok, _ = b.Allow()
+	assert.False(t, ok, "allowed more than the trial requests")
+
+	assert.Equal(t, breakerTransition{}, b.Record(false))
+	assert.Equal(t, breakerTransition{From: breakerHalfOpen, To: breakerClosed}, b.Record(false))
+
+	_ = b.Record(true)
+	now = now.Add(conf.OpenDuration)
+	_, _ = b.Allow()
+	assert.Equal(t, breakerTransition{From: breakerHalfOpen, To: breakerOpen}, b.Record(true))
+}
+
+func TestCircuitBreakerTransport(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	logger := NewMockLogger(ctrl)
+	wrapped := NewMockRoundTripper(ctrl)
+	c := &CircuitBreakerComponent{Backend: "backend", Path: "/", Method: http.MethodGet}
+	conf := c.Settings()
+	conf.ConsecutiveFailures = 1
+	f, err := c.New(context.Background(), conf)
+	assert.Nil(t, err)
+	rt := f(wrapped)
+
+	req, _ := http.NewRequest(http.MethodGet, "http://localhost/", http.NoBody)
+	req = req.WithContext(logevent.NewContext(req.Context(), logger))
+
+	wrapped.EXPECT().RoundTrip(gomock.Any()).Return(nil, errors.New("connection refused"))
+	logger.EXPECT().Warn(gomock.Any()).Do(func(event interface{}) {
+		assert.Equal(t, circuitBreakerEvent{Breaker: "backend GET /", From: breakerClosed, To: breakerOpen}, event)
+	})
+	_, err = rt.RoundTrip(req)
+	assert.NotNil(t, err)
+
+	resp, err := rt.RoundTrip(req)
+	assert.Nil(t, err)
+	assert.Equal(t, http.StatusServiceUnavailable, resp.StatusCode)
+}
+
+func TestCircuitBreakerBackendScope(t *testing.T) {
+	first := &CircuitBreakerComponent{Backend: "shared", Path: "/a", Method: http.MethodGet}
+	second := &CircuitBreakerComponent{Backend: "shared", Path: "/b", Method: http.MethodPost}
+	conf := first.Settings()
+	conf.Scope = CircuitBreakerScopeBackend
+	ctx := transportd.SharedStateToContext(context.Background(), transportd.NewSharedState())
+	firstF, err := first.New(ctx, conf)
+	assert.Nil(t, err)
+	secondF, err := second.New(ctx, conf)
+	assert.Nil(t, err)
+	assert.Same(t,
+		firstF(nil).(*circuitBreakerTransport).Breaker,
+		secondF(nil).(*circuitBreakerTransport).Breaker,
+		"routes of the same backend did not share a breaker",
+	)
+
+	reloaded := transportd.SharedStateToContext(context.Background(), transportd.NewSharedState())
+	reloadedF, err := first.New(reloaded, conf)
+	assert.Nil(t, err)
+	assert.NotSame(t,
+		firstF(nil).(*circuitBreakerTransport).Breaker,
+		reloadedF(nil).(*circuitBreakerTransport).Breaker,
+		"a new transport reused the breaker of a previous one",
+	)
+}
+
+func TestCircuitBreakerInvalidConfig(t *testing.T) {
+	c := &CircuitBreakerComponent{}
+	conf := c.Settings()
+	conf.Scope = "unknown"
+	_, err := c.New(context.Background(), conf)
+	assert.NotNil(t, err)
+	conf = c.Settings()
+	conf.ConsecutiveFailures = 0
+	conf.ErrorPercent = 0
+	_, err = c.New(context.Background(), conf)
+	assert.NotNil(t, err)
+}
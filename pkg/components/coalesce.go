@@ -0,0 +1,211 @@
+package components
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"sync"
+
+	"github.com/asecurityteam/runhttp"
+	transportd "github.com/asecurityteam/transportd/pkg"
+)
+
+// errCoalesceTooLarge marks a shared response that was too large to buffer.
+var errCoalesceTooLarge = errors.New("response too large to share")
+
+// CoalesceConfig contains settings for request coalescing.
+type CoalesceConfig struct {
+	Methods            []string `description:"HTTP methods that may be coalesced."`
+	Headers            []string `description:"Request headers that must match for requests to be coalesced."`
+	ShareAuthorization bool     `description:"Coalesce requests that differ in the Authorization or Cookie headers."`
+	MaxBodySize        int      `description:"Maximum response size, in bytes, that is shared. Waiting requests are sent on their own when the response is larger."`
+	Metric             string   `description:"Name of the coalesced request count metric."`
+}
+
+// Name of the configuration root.
+func (*CoalesceConfig) Name() string {
+	return "coalesce"
+}
+
+// CoalesceComponent implements the settings.Component interface.
+type CoalesceComponent struct {
+	Backend string
+	Path    string
+}
+
+// Coalesce satisfies the NewComponent signature.
+func Coalesce(_ context.Context, backend string, path string, _ string) (interface{}, error) {
+	return &CoalesceComponent{Backend: backend, Path: path}, nil
+}
+
+// Settings generates a config populated with defaults.
+func (*CoalesceComponent) Settings() *CoalesceConfig {
+	return &CoalesceConfig{
+		Methods:     []string{http.MethodGet},
+		Headers:     []string{},
+		MaxBodySize: 1024 * 1024,
+		Metric:      "http.client.coalesced",
+	}
+}
+
+// New generates the middleware.
+func (c *CoalesceComponent) New(ctx context.Context, conf *CoalesceConfig) (func(http.RoundTripper) http.RoundTripper, error) { // nolint
+	if conf.MaxBodySize < 0 {
+		return nil, fmt.Errorf("coalesce maxbodysize must not be negative")
+	}
+	methods := make(map[string]bool, len(conf.Methods))
+	for _, method := range conf.Methods {
+		methods[strings.ToUpper(method)] = true
+	}
+	headers := make([]string, 0, len(conf.Headers)+2)
+	for _, header := range conf.Headers {
+		headers = append(headers, http.CanonicalHeaderKey(header))
+	}
+	if !conf.ShareAuthorization {
+		headers = append(headers, "Authorization", "Cookie")
+	}
+	if transportd.StreamingFromContext(ctx) {
+		// A streamed response cannot be shared without buffering it.
+		return func(next http.RoundTripper) http.RoundTripper { return next }, nil
+	}
+	return func(next http.RoundTripper) http.RoundTripper {
+		return &coalesceTransport{
+			Backend: c.Backend,
+			Path:    c.Path,
+			Conf:    conf,
+			Methods: methods,
+			Headers: headers,
+			Wrapped: next,
+			calls:   make(map[string]*coalescedCall),
+		}
+	}, nil
+}
+
+// coalescedCall is a request in flight that other requests are waiting on.
+type coalescedCall struct {
+	done   chan struct{}
+	status int
+	proto  string
+	header http.Header
+	body   []byte
+	err    error
+}
+
+// response creates a copy of the shared response for one caller.
+func (c *coalescedCall) response(r *http.Request) *http.Response {
+	return &http.Response{
+		Status:        http.StatusText(c.status),
+		StatusCode:    c.status,
+		Proto:         c.proto,
+		Header:        c.header.Clone(),
+		Body:          io.NopCloser(bytes.NewReader(c.body)),
+		ContentLength: int64(len(c.body)),
+		Request:       r,
+	}
+}
+
+type coalesceTransport struct {
+	Backend string
+	Path    string
+	Conf    *CoalesceConfig
+	Methods map[string]bool
+	Headers []string
+	Wrapped http.RoundTripper
+
+	lock  sync.Mutex
+	calls map[string]*coalescedCall
+}
+
+func (t *coalesceTransport) key(r *http.Request) string {
+	var b strings.Builder
+	b.WriteString(r.Method)
+	b.WriteString(" ")
+	b.WriteString(r.URL.RequestURI())
+	for _, header := range t.Headers {
+		b.WriteString("\x00")
+		b.WriteString(header)
+		b.WriteString("=")
+		b.WriteString(strings.Join(r.Header.Values(header), ","))
+	}
+	return b.String()
+}
+
+func (t *coalesceTransport) RoundTrip(r *http.Request) (*http.Response, error) {
+	if !t.Methods[r.Method] {
+		return t.Wrapped.RoundTrip(r)
+	}
+	key := t.key(r)
+	t.lock.Lock()
+	if call, ok := t.calls[key]; ok {
+		t.lock.Unlock()
+		return t.wait(r, call)
+	}
+	call := &coalescedCall{done: make(chan struct{})}
+	t.calls[key] = call
+	t.lock.Unlock()
+
+	resp, err := t.Wrapped.RoundTrip(r)
+	if err == nil {
+		resp, err = t.share(r, call, resp)
+	} else {
+		call.err = err
+	}
+	t.lock.Lock()
+	delete(t.calls, key)
+	t.lock.Unlock()
+	close(call.done)
+	return resp, err
+}
+
+// share buffers the response so that it can be handed to every waiting
+// request. Responses that are too large are returned to the first caller as
+// they are and the waiting requests are sent on their own.
+func (t *coalesceTransport) share(r *http.Request, call *coalescedCall, resp *http.Response) (*http.Response, error) {
+	if resp.ContentLength > int64(t.Conf.MaxBodySize) {
+		call.err = errCoalesceTooLarge
+		return resp, nil
+	}
+	body, err := io.ReadAll(io.LimitReader(resp.Body, int64(t.Conf.MaxBodySize)+1))
+	if err != nil {
+		_ = resp.Body.Close()
+		call.err = err
+		return nil, err
+	}
+	if len(body) > t.Conf.MaxBodySize {
+		call.err = errCoalesceTooLarge
+		resp.Body = transportd.PrependBody(body, resp.Body, nil)
+		return resp, nil
+	}
+	_ = resp.Body.Close()
+	call.status = resp.StatusCode
+	call.proto = resp.Proto
+	call.header = resp.Header
+	call.body = body
+	return call.response(r), nil
+}
+
+func (t *coalesceTransport) wait(r *http.Request, call *coalescedCall) (*http.Response, error) {
+	select {
+	case <-call.done:
+	case <-r.Context().Done():
+		return nil, r.Context().Err()
+	}
+	// A failure caused by the first caller going away, or a response that
+	// could not be shared, says nothing about the result this request would
+	// get so it is sent on its own.
+	if errors.Is(call.err, context.Canceled) || errors.Is(call.err, errCoalesceTooLarge) {
+		return t.Wrapped.RoundTrip(r)
+	}
+	runhttp.StatFromContext(r.Context()).Count(
+		t.Conf.Metric, 1,
+		"client_dependency:"+t.Backend, "client_path:"+t.Path,
+	)
+	if call.err != nil {
+		return nil, call.err
+	}
+	return call.response(r), nil
+}
@@ -0,0 +1,169 @@
+package components
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"strings"
+	"sync"
+	"testing"
+
+	transportd "github.com/asecurityteam/transportd/pkg"
+	"github.com/golang/mock/gomock"
+	"github.com/stretchr/testify/assert"
+)
+
+// waitingContext reports when a request begins to wait on a coalesced call.
+type waitingContext struct {
+	context.Context
+	once    sync.Once
+	waiting chan struct{}
+}
+
+func (c *waitingContext) Done() <-chan struct{} {
+	c.once.Do(func() { close(c.waiting) })
+	return c.Context.Done()
+}
+
+func TestCoalesceSharesResponse(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	wrapped := NewMockRoundTripper(ctrl)
+	c := &CoalesceComponent{Backend: "backend", Path: "/"}
+	f, err := c.New(context.Background(), c.Settings())
+	assert.Nil(t, err)
+	rt := f(wrapped).(*coalesceTransport)
+	req, _ := http.NewRequest(http.MethodGet, "http://localhost/a?b=c", http.NoBody)
+	started := make(chan struct{})
+	release := make(chan struct{})
+	wrapped.EXPECT().RoundTrip(gomock.Any()).DoAndReturn(func(*http.Request) (*http.Response, error) {
+		close(started)
+		<-release
+		return &http.Response{StatusCode: http.StatusOK, Header: http.Header{}, Body: io.NopCloser(strings.NewReader("body"))}, nil
+	}).Times(1)
+
+	var wg sync.WaitGroup
+	bodies := make([]string, 3)
+	for x := range bodies {
+		ctx := &waitingContext{Context: context.Background(), waiting: make(chan struct{})}
+		wg.Add(1)
+		go func(x int, r *http.Request) {
+			defer wg.Done()
+			resp, err := rt.RoundTrip(r)
+			assert.Nil(t, err)
+			b, _ := io.ReadAll(resp.Body)
+			bodies[x] = string(b)
+		}(x, req.WithContext(ctx))
+		if x == 0 {
+			<-started
+			continue
+		}
+		<-ctx.waiting
+	}
+	close(release)
+	wg.Wait()
+	assert.Equal(t, []string{"body", "body", "body"}, bodies)
+}
+
+func TestCoalesceKey(t *testing.T) {
+	c := &CoalesceComponent{Backend: "backend", Path: "/"}
+	conf := c.Settings()
+	conf.Headers = []string{"accept"}
+	f, err := c.New(context.Background(), conf)
+	assert.Nil(t, err)
+	rt := f(nil).(*coalesceTransport)
+	a, _ := http.NewRequest(http.MethodGet, "http://localhost/a", http.NoBody)
+	b, _ := http.NewRequest(http.MethodGet, "http://localhost/a", http.NoBody)
+	assert.Equal(t, rt.key(a), rt.key(b))
+
+	b.Header.Set("Accept", "text/plain")
+	assert.NotEqual(t, rt.key(a), rt.key(b), "configured header was ignored")
+	b.Header.Del("Accept")
+	b.Header.Set("Authorization", "Bearer other")
+	assert.NotEqual(t, rt.key(a), rt.key(b), "requests with different credentials were coalesced")
+	b.Header.Del("Authorization")
+	b.Header.Set("Cookie", "session=other")
+	assert.NotEqual(t, rt.key(a), rt.key(b), "requests with different sessions were coalesced")
+	b.Header.Set("X-Other", "value")
+	b.Header.Del("Cookie")
+	assert.Equal(t, rt.key(a), rt.key(b))
+
+	conf.ShareAuthorization = true
+	f, err = c.New(context.Background(), conf)
+	assert.Nil(t, err)
+	rt = f(nil).(*coalesceTransport)
+	b.Header.Set("Authorization", "Bearer other")
+	b.Header.Set("Cookie", "session=other")
+	assert.Equal(t, rt.key(a), rt.key(b))
+}
+
+func TestCoalesceTooLarge(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	wrapped := NewMockRoundTripper(ctrl)
+	c := &CoalesceComponent{Backend: "backend", Path: "/"}
+	conf := c.Settings()
+	conf.MaxBodySize = 2
+	f, err := c.New(context.Background(), conf)
+	assert.Nil(t, err)
+	rt := f(wrapped).(*coalesceTransport)
+	req, _ := http.NewRequest(http.MethodGet, "http://localhost/", http.NoBody)
+	started := make(chan struct{})
+	release := make(chan struct{})
+	gomock.InOrder(
+		wrapped.EXPECT().RoundTrip(gomock.Any()).DoAndReturn(func(*http.Request) (*http.Response, error) {
+			close(started)
+			<-release
+			return &http.Response{StatusCode: http.StatusOK, Header: http.Header{}, Body: io.NopCloser(strings.NewReader("large"))}, nil
+		}),
+		wrapped.EXPECT().RoundTrip(gomock.Any()).Return(&http.Response{StatusCode: http.StatusOK, Header: http.Header{}, Body: io.NopCloser(strings.NewReader("large"))}, nil),
+	)
+
+	var wg sync.WaitGroup
+	for x := 0; x < 2; x = x + 1 {
+		ctx := &waitingContext{Context: context.Background(), waiting: make(chan struct{})}
+		wg.Add(1)
+		go func(r *http.Request) {
+			defer wg.Done()
+			resp, err := rt.RoundTrip(r)
+			assert.Nil(t, err)
+			b, _ := io.ReadAll(resp.Body)
+			assert.Equal(t, "large", string(b))
+		}(req.WithContext(ctx))
+		if x == 0 {
+			<-started
+			continue
+		}
+		<-ctx.waiting
+	}
+	close(release)
+	wg.Wait()
+}
+
+func TestCoalesceIgnoresMethods(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	wrapped := NewMockRoundTripper(ctrl)
+	c := &CoalesceComponent{Backend: "backend", Path: "/"}
+	f, err := c.New(context.Background(), c.Settings())
+	assert.Nil(t, err)
+	rt := f(wrapped).(*coalesceTransport)
+	req, _ := http.NewRequest(http.MethodPost, "http://localhost/", http.NoBody)
+	wrapped.EXPECT().RoundTrip(req).Return(simpleResponse(), nil)
+	_, _ = rt.RoundTrip(req)
+	assert.Empty(t, rt.calls)
+}
+
+func TestCoalesceStreaming(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	wrapped := NewMockRoundTripper(ctrl)
+	c := &CoalesceComponent{Backend: "backend", Path: "/"}
+	f, err := c.New(transportd.StreamingToContext(context.Background(), true), c.Settings())
+	assert.Nil(t, err)
+	assert.Equal(t, wrapped, f(wrapped), "coalescing was applied to a streaming route")
+}
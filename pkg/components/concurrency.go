@@ -0,0 +1,96 @@
+package components
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/asecurityteam/runhttp"
+	transportd "github.com/asecurityteam/transportd/pkg"
+)
+
+// ConcurrencyConfig contains settings for limiting in-flight requests.
+type ConcurrencyConfig struct {
+	Limit          int           `description:"Maximum in-flight requests for the route."`
+	Queue          int           `description:"Maximum requests waiting for an in-flight slot."`
+	QueueTimeout   time.Duration `description:"Maximum time a request waits for an in-flight slot."`
+	InFlightMetric string        `description:"Name of the in-flight request gauge."`
+	QueuedMetric   string        `description:"Name of the queued request gauge."`
+}
+
+// Name of the configuration root.
+func (*ConcurrencyConfig) Name() string {
+	return "concurrency"
+}
+
+// ConcurrencyComponent implements the settings.Component interface.
+type ConcurrencyComponent struct {
+	Backend string
+	Path    string
+}
+
+// Concurrency satisfies the NewComponent signature.
+func Concurrency(_ context.Context, backend string, path string, _ string) (interface{}, error) {
+	return &ConcurrencyComponent{Backend: backend, Path: path}, nil
+}
+
+// Settings generates a config populated with defaults.
+func (*ConcurrencyComponent) Settings() *ConcurrencyConfig {
+	return &ConcurrencyConfig{
+		Limit:          100,
+		QueueTimeout:   time.Second,
+		InFlightMetric: "http.client.concurrency.inflight",
+		QueuedMetric:   "http.client.concurrency.queued",
+	}
+}
+
+// RequestPhase marks the component as safe to run for upgrade requests.
+func (*ConcurrencyComponent) RequestPhase() {}
+
+// New generates the middleware.
+func (c *ConcurrencyComponent) New(_ context.Context, conf *ConcurrencyConfig) (func(http.RoundTripper) http.RoundTripper, error) { // nolint
+	if conf.Limit < 1 || conf.Queue < 0 {
+		return nil, fmt.Errorf("concurrency limit must be greater than zero and queue must not be negative")
+	}
+	if conf.Queue > 0 && conf.QueueTimeout <= 0 {
+		return nil, fmt.Errorf("concurrency queue timeout must be greater than zero")
+	}
+	return func(next http.RoundTripper) http.RoundTripper {
+		return &concurrencyTransport{
+			Backend:  c.Backend,
+			Path:     c.Path,
+			Conf:     conf,
+			Bulkhead: transportd.NewBulkhead(conf.Limit, conf.Queue, conf.QueueTimeout),
+			Wrapped:  next,
+		}
+	}, nil
+}
+
+type concurrencyTransport struct {
+	Backend  string
+	Path     string
+	Conf     *ConcurrencyConfig
+	Bulkhead *transportd.Bulkhead
+	Wrapped  http.RoundTripper
+}
+
+func (t *concurrencyTransport) RoundTrip(r *http.Request) (*http.Response, error) {
+	stats := runhttp.StatFromContext(r.Context())
+	tags := []string{"client_dependency:" + t.Backend, "client_path:" + t.Path}
+	err := t.Bulkhead.Acquire(r.Context())
+	stats.Gauge(t.Conf.QueuedMetric, float64(t.Bulkhead.Queued()), tags...)
+	if errors.Is(err, transportd.ErrBulkheadFull) || errors.Is(err, transportd.ErrBulkheadTimeout) {
+		return newError(http.StatusServiceUnavailable, fmt.Sprintf("route concurrency limit: %s", err.Error())), nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	stats.Gauge(t.Conf.InFlightMetric, float64(t.Bulkhead.InFlight()), tags...)
+	resp, err := t.Wrapped.RoundTrip(r)
+	return transportd.ReleaseOnClose(resp, err, func() {
+		t.Bulkhead.Release()
+		stats.Gauge(t.Conf.InFlightMetric, float64(t.Bulkhead.InFlight()), tags...)
+	})
+}
@@ -0,0 +1,147 @@
+package components
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/http/httputil"
+	"testing"
+	"time"
+
+	transportd "github.com/asecurityteam/transportd/pkg"
+	"github.com/golang/mock/gomock"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestConcurrencyRejects(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	wrapped := NewMockRoundTripper(ctrl)
+	c := &ConcurrencyComponent{Backend: "backend", Path: "/"}
+	conf := c.Settings()
+	conf.Limit = 1
+	f, err := c.New(context.Background(), conf)
+	assert.Nil(t, err)
+	rt := f(wrapped)
+	req, _ := http.NewRequest(http.MethodGet, "http://localhost/", http.NoBody)
+
+	wrapped.EXPECT().RoundTrip(req).DoAndReturn(func(*http.Request) (*http.Response, error) {
+		resp, err := rt.RoundTrip(req)
+		assert.Nil(t, err)
+		assert.Equal(t, http.StatusServiceUnavailable, resp.StatusCode)
+		return simpleResponse(), nil
+	})
+	resp, err := rt.RoundTrip(req)
+	assert.Nil(t, err)
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Equal(t, 1, rt.(*concurrencyTransport).Bulkhead.InFlight(), "slot released before the body was closed")
+	_ = resp.Body.Close()
+	assert.Equal(t, 0, rt.(*concurrencyTransport).Bulkhead.InFlight())
+}
+
+func TestConcurrencyInvalidConfig(t *testing.T) {
+	c := &ConcurrencyComponent{}
+	conf := c.Settings()
+	conf.Limit = 0
+	_, err := c.New(context.Background(), conf)
+	assert.NotNil(t, err)
+	conf = c.Settings()
+	conf.Queue = 1
+	conf.QueueTimeout = 0
+	_, err = c.New(context.Background(), conf)
+	assert.NotNil(t, err)
+}
+
+const concurrencyUpgradeSpec = `
+openapi: 3.0.0
+info:
+  version: 1.0.0
+  title: Upgrade API
+x-transportd:
+  backends:
+    - app
+  app:
+    host: "%s"
+    bulkhead:
+      maxconcurrent: 2
+paths:
+  /:
+    get:
+      responses:
+        "200":
+          description: "Success"
+      x-transportd:
+        backend: app
+        upgrade: true
+        enabled:
+          - "concurrency"
+        concurrency:
+          limit: 1
+`
+
+func TestConcurrencyUpgrade(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Upgrade") == "" {
+			_, _ = w.Write([]byte("plain"))
+			return
+		}
+		conn, rw, err := w.(http.Hijacker).Hijack()
+		if !assert.Nil(t, err) {
+			return
+		}
+		defer conn.Close()
+		_, _ = rw.WriteString("HTTP/1.1 101 Switching Protocols\r\nConnection: Upgrade\r\nUpgrade: echo\r\n\r\n")
+		_ = rw.Flush()
+		_, _ = io.Copy(conn, rw)
+	}))
+	defer upstream.Close()
+
+	rt, err := transportd.NewTransport(context.Background(), []byte(fmt.Sprintf(concurrencyUpgradeSpec, upstream.URL)), Defaults...)
+	if !assert.Nil(t, err) {
+		return
+	}
+	proxy := httptest.NewServer(&httputil.ReverseProxy{
+		Director:  func(*http.Request) {},
+		Transport: rt,
+	})
+	defer proxy.Close()
+
+	conn, err := net.Dial("tcp", proxy.Listener.Addr().String())
+	if !assert.Nil(t, err) {
+		return
+	}
+	_ = conn.SetDeadline(time.Now().Add(5 * time.Second))
+	_, _ = conn.Write([]byte("GET / HTTP/1.1\r\nHost: localhost\r\nConnection: Upgrade\r\nUpgrade: echo\r\n\r\n"))
+	reader := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(reader, nil)
+	if !assert.Nil(t, err) {
+		_ = conn.Close()
+		return
+	}
+	assert.Equal(t, http.StatusSwitchingProtocols, resp.StatusCode)
+	_, _ = conn.Write([]byte("ping"))
+	echo := make([]byte, len("ping"))
+	_, err = io.ReadFull(reader, echo)
+	assert.Nil(t, err)
+	assert.Equal(t, "ping", string(echo))
+
+	resp, err = http.Get(proxy.URL)
+	assert.Nil(t, err)
+	_ = resp.Body.Close()
+	assert.Equal(t, http.StatusServiceUnavailable, resp.StatusCode, "slot released while the tunnel was open")
+
+	_ = conn.Close()
+	assert.Eventually(t, func() bool {
+		resp, err := http.Get(proxy.URL)
+		if err != nil {
+			return false
+		}
+		_ = resp.Body.Close()
+		return resp.StatusCode == http.StatusOK
+	}, time.Second, 10*time.Millisecond, "slot not released when the tunnel closed")
+}
@@ -15,6 +15,14 @@ var (
 		Timeout,
 		Hedging,
 		Retry,
+		CircuitBreaker,
+		LoadShed,
+		RateLimit,
+		Concurrency,
+		AdaptiveConcurrency,
+		Cache,
+		Coalesce,
+		Mirror,
 		RetryAfter,
 		ASAPToken,
 		RequestValidation,
@@ -25,4 +33,12 @@ var (
 		BasicAuth,
 		ValidateHeaders,
 	}
+
+	// SecretResolvers is the same set of secret providers that is installed
+	// in the project main.go. Custom builds can append their own providers
+	// and install the list with transportd.SecretResolversToContext.
+	SecretResolvers = []transportd.SecretResolver{
+		&transportd.FileSecretResolver{},
+		&transportd.Base64SecretResolver{},
+	}
 )
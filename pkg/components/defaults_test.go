@@ -0,0 +1,33 @@
+package components
+
+import (
+	"context"
+	"testing"
+
+	transportd "github.com/asecurityteam/transportd/pkg"
+	"github.com/stretchr/testify/assert"
+)
+
+type vaultSecretResolver struct{}
+
+func (*vaultSecretResolver) Name() string {
+	return "vault"
+}
+
+func (*vaultSecretResolver) Resolve(_ context.Context, reference string) (string, error) {
+	return "secret-" + reference, nil
+}
+
+func TestSecretResolversCustomBuild(t *testing.T) {
+	resolvers := append(append([]transportd.SecretResolver{}, SecretResolvers...), &vaultSecretResolver{})
+	ctx := transportd.SecretResolversToContext(context.Background(), resolvers...)
+	installed := transportd.SecretResolversFromContext(ctx)
+	assert.Contains(t, installed, "file")
+	assert.Contains(t, installed, "base64")
+	assert.Contains(t, installed, "vault")
+
+	processor := transportd.NewEnvProcessor()
+	got, err := processor.ProcessContext(ctx, []byte(`key: ${vault:kv/app}`))
+	assert.Nil(t, err)
+	assert.Contains(t, string(got), "secret-kv/app")
+}
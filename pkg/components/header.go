@@ -36,6 +36,9 @@ func makeRequestDecorator(name string, value string) transport.Decorator {
 	})
 }
 
+// RequestPhase marks the component as safe to run for upgrade requests.
+func (*RequestHeaderComponent) RequestPhase() {}
+
 // New generates the middleware.
 func (*RequestHeaderComponent) New(_ context.Context, conf *RequestHeaderConfig) (func(http.RoundTripper) http.RoundTripper, error) { // nolint
 
@@ -0,0 +1,329 @@
+package components
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math"
+	"math/rand"
+	"net/http"
+	"sort"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/asecurityteam/runhttp"
+	transportd "github.com/asecurityteam/transportd/pkg"
+)
+
+const (
+	// loadShedBuckets is the number of buckets in each rolling window.
+	loadShedBuckets = 10
+	// loadShedSamples is the maximum number of latency samples kept for
+	// each bucket of the rolling window. Older samples are overwritten so
+	// that memory use does not grow with traffic.
+	loadShedSamples = 1000
+)
+
+// LoadShedConcurrencyConfig is the rejection curve for in-flight requests.
+type LoadShedConcurrencyConfig struct {
+	Lower int `description:"In-flight requests at which rejection begins."`
+	Upper int `description:"In-flight requests at which all requests are rejected. Zero disables the curve."`
+}
+
+// Name of the configuration root.
+func (*LoadShedConcurrencyConfig) Name() string {
+	return "concurrency"
+}
+
+// LoadShedLatencyConfig is the rejection curve for a latency percentile.
+type LoadShedLatencyConfig struct {
+	Lower           time.Duration `description:"Latency at which rejection begins."`
+	Upper           time.Duration `description:"Latency at which all requests are rejected. Zero disables the curve."`
+	Percentile      float64       `description:"Percentile of latency within the window that is compared to the curve."`
+	Window          time.Duration `description:"Duration of the rolling window of latency samples."`
+	MinimumRequests int           `description:"Minimum requests within the window before the curve is applied."`
+}
+
+// Name of the configuration root.
+func (*LoadShedLatencyConfig) Name() string {
+	return "latency"
+}
+
+// LoadShedErrorRateConfig is the rejection curve for the percent of failed
+// requests.
+type LoadShedErrorRateConfig struct {
+	Lower           float64       `description:"Percent of failed requests at which rejection begins."`
+	Upper           float64       `description:"Percent of failed requests at which all requests are rejected. Zero disables the curve."`
+	Window          time.Duration `description:"Duration of the rolling window of results."`
+	MinimumRequests int           `description:"Minimum requests within the window before the curve is applied."`
+	Codes           []int         `description:"HTTP status codes that count as failures."`
+}
+
+// Name of the configuration root.
+func (*LoadShedErrorRateConfig) Name() string {
+	return "errorrate"
+}
+
+// LoadShedConfig contains settings for load shedding.
+type LoadShedConfig struct {
+	Concurrency    *LoadShedConcurrencyConfig
+	Latency        *LoadShedLatencyConfig
+	ErrorRate      *LoadShedErrorRateConfig
+	RetryAfter     time.Duration `description:"Value of the Retry-After header sent with rejections."`
+	RejectedMetric string        `description:"Name of the rejected request count metric."`
+}
+
+// Name of the configuration root.
+func (*LoadShedConfig) Name() string {
+	return "loadshed"
+}
+
+// LoadShedComponent implements the settings.Component interface.
+type LoadShedComponent struct {
+	Backend string
+	Path    string
+}
+
+// LoadShed satisfies the NewComponent signature.
+func LoadShed(_ context.Context, backend string, path string, _ string) (interface{}, error) {
+	return &LoadShedComponent{Backend: backend, Path: path}, nil
+}
+
+// Settings generates a config populated with defaults. All curves are
+// disabled by default.
+func (*LoadShedComponent) Settings() *LoadShedConfig {
+	return &LoadShedConfig{
+		Concurrency: &LoadShedConcurrencyConfig{},
+		Latency: &LoadShedLatencyConfig{
+			Percentile:      95,
+			Window:          10 * time.Second,
+			MinimumRequests: 20,
+		},
+		ErrorRate: &LoadShedErrorRateConfig{
+			Window:          10 * time.Second,
+			MinimumRequests: 20,
+			Codes:           defaultRetryCodes,
+		},
+		RetryAfter:     time.Second,
+		RejectedMetric: "http.client.loadshed.rejected",
+	}
+}
+
+// New generates the middleware.
+func (c *LoadShedComponent) New(_ context.Context, conf *LoadShedConfig) (func(http.RoundTripper) http.RoundTripper, error) { // nolint
+	if conf.Concurrency.Upper < 0 || conf.Concurrency.Lower < 0 || (conf.Concurrency.Upper > 0 && conf.Concurrency.Upper <= conf.Concurrency.Lower) {
+		return nil, fmt.Errorf("loadshed concurrency upper must be greater than lower")
+	}
+	if conf.Latency.Upper < 0 || conf.Latency.Lower < 0 || (conf.Latency.Upper > 0 && conf.Latency.Upper <= conf.Latency.Lower) {
+		return nil, fmt.Errorf("loadshed latency upper must be greater than lower")
+	}
+	if conf.Latency.Percentile <= 0 || conf.Latency.Percentile > 100 {
+		return nil, fmt.Errorf("loadshed latency percentile must be between 0 and 100")
+	}
+	if conf.ErrorRate.Upper < 0 || conf.ErrorRate.Lower < 0 || conf.ErrorRate.Upper > 100 || (conf.ErrorRate.Upper > 0 && conf.ErrorRate.Upper <= conf.ErrorRate.Lower) {
+		return nil, fmt.Errorf("loadshed error rate upper must be greater than lower and no more than 100")
+	}
+	if conf.Latency.Window < loadShedBuckets || conf.ErrorRate.Window < loadShedBuckets {
+		return nil, fmt.Errorf("loadshed windows must be at least %s", time.Duration(loadShedBuckets))
+	}
+	return func(next http.RoundTripper) http.RoundTripper {
+		return &loadShedTransport{
+			Backend: c.Backend,
+			Path:    c.Path,
+			Conf:    conf,
+			Wrapped: next,
+			latency: newLoadShedWindow(conf.Latency.Window, true),
+			errors:  newLoadShedWindow(conf.ErrorRate.Window, false),
+			random:  rand.Float64, // nolint:gosec
+		}
+	}, nil
+}
+
+// curve returns the probability of rejection for a value. The probability
+// grows linearly from zero at the lower bound to one at the upper bound. A
+// zero upper bound disables the curve.
+func curve(value float64, lower float64, upper float64) float64 {
+	if upper <= 0 || value <= lower {
+		return 0
+	}
+	return math.Min((value-lower)/(upper-lower), 1)
+}
+
+type loadShedBucket struct {
+	index    int64
+	total    int
+	failures int
+	samples  []time.Duration
+}
+
+// loadShedWindow is a rolling window of request results.
+type loadShedWindow struct {
+	lock    sync.Mutex
+	width   int64
+	keep    bool
+	buckets [loadShedBuckets]loadShedBucket
+	// percentile caches the last computed percentile so that it is only
+	// recomputed once per bucket rather than on every request.
+	percentile      time.Duration
+	percentileIndex int64
+	now             func() time.Time
+}
+
+// newLoadShedWindow creates a window. Latency samples are only retained
+// when keep is set.
+func newLoadShedWindow(window time.Duration, keep bool) *loadShedWindow {
+	return &loadShedWindow{width: int64(window / loadShedBuckets), keep: keep, percentileIndex: -1, now: time.Now}
+}
+
+// current returns the bucket for the current time. The caller must hold
+// the lock.
+func (w *loadShedWindow) current() (*loadShedBucket, int64) {
+	index := w.now().UnixNano() / w.width
+	bucket := &w.buckets[index%loadShedBuckets]
+	if bucket.index != index {
+		*bucket = loadShedBucket{index: index, samples: bucket.samples[:0]}
+	}
+	return bucket, index
+}
+
+func (w *loadShedWindow) Record(failed bool, elapsed time.Duration) {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+	bucket, _ := w.current()
+	switch {
+	case !w.keep:
+	case len(bucket.samples) < loadShedSamples:
+		bucket.samples = append(bucket.samples, elapsed)
+	default:
+		bucket.samples[bucket.total%loadShedSamples] = elapsed
+	}
+	bucket.total = bucket.total + 1
+	if failed {
+		bucket.failures = bucket.failures + 1
+	}
+}
+
+// Rate returns the percent of failed requests and the total requests in
+// the window.
+func (w *loadShedWindow) Rate() (float64, int) {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+	_, index := w.current()
+	total, failures := 0, 0
+	for _, bucket := range w.buckets {
+		if index-bucket.index < loadShedBuckets {
+			total = total + bucket.total
+			failures = failures + bucket.failures
+		}
+	}
+	if total < 1 {
+		return 0, 0
+	}
+	return float64(failures) * 100 / float64(total), total
+}
+
+// Percentile returns the given latency percentile and the total requests
+// in the window.
+func (w *loadShedWindow) Percentile(p float64) (time.Duration, int) {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+	_, index := w.current()
+	total := 0
+	for _, bucket := range w.buckets {
+		if index-bucket.index < loadShedBuckets {
+			total = total + bucket.total
+		}
+	}
+	if w.percentileIndex == index {
+		return w.percentile, total
+	}
+	samples := make([]time.Duration, 0, loadShedSamples)
+	for _, bucket := range w.buckets {
+		if index-bucket.index < loadShedBuckets {
+			samples = append(samples, bucket.samples...)
+		}
+	}
+	w.percentile = 0
+	if len(samples) > 0 {
+		sort.Slice(samples, func(i, j int) bool { return samples[i] < samples[j] })
+		offset := int(math.Ceil(p/100*float64(len(samples)))) - 1
+		if offset < 0 {
+			offset = 0
+		}
+		w.percentile = samples[offset]
+	}
+	w.percentileIndex = index
+	return w.percentile, total
+}
+
+type loadShedTransport struct {
+	Backend string
+	Path    string
+	Conf    *LoadShedConfig
+	Wrapped http.RoundTripper
+
+	inflight int64
+	latency  *loadShedWindow
+	errors   *loadShedWindow
+	random   func() float64
+}
+
+// reason returns the name of the curve that rejects the request or an
+// empty string if the request may proceed.
+func (t *loadShedTransport) reason() string {
+	reason, probability := "", 0.0
+	if p := curve(float64(atomic.LoadInt64(&t.inflight)), float64(t.Conf.Concurrency.Lower), float64(t.Conf.Concurrency.Upper)); p > probability {
+		reason, probability = "concurrency", p
+	}
+	if t.Conf.Latency.Upper > 0 {
+		latency, total := t.latency.Percentile(t.Conf.Latency.Percentile)
+		if p := curve(float64(latency), float64(t.Conf.Latency.Lower), float64(t.Conf.Latency.Upper)); total >= t.Conf.Latency.MinimumRequests && p > probability {
+			reason, probability = "latency", p
+		}
+	}
+	if t.Conf.ErrorRate.Upper > 0 {
+		rate, total := t.errors.Rate()
+		if p := curve(rate, t.Conf.ErrorRate.Lower, t.Conf.ErrorRate.Upper); total >= t.Conf.ErrorRate.MinimumRequests && p > probability {
+			reason, probability = "errorrate", p
+		}
+	}
+	if probability > 0 && t.random() < probability {
+		return reason
+	}
+	return ""
+}
+
+func (t *loadShedTransport) RoundTrip(r *http.Request) (*http.Response, error) {
+	if reason := t.reason(); reason != "" {
+		runhttp.StatFromContext(r.Context()).Count(
+			t.Conf.RejectedMetric, 1,
+			"client_dependency:"+t.Backend, "client_path:"+t.Path, "reason:"+reason,
+		)
+		resp := newError(http.StatusServiceUnavailable, fmt.Sprintf("request shed due to %s", reason))
+		resp.Header.Set("Retry-After", strconv.Itoa(int(math.Ceil(t.Conf.RetryAfter.Seconds()))))
+		return resp, nil
+	}
+	// A request counts as in flight until its response body is closed.
+	atomic.AddInt64(&t.inflight, 1)
+	release := func() { atomic.AddInt64(&t.inflight, -1) }
+	start := time.Now()
+	resp, err := t.Wrapped.RoundTrip(r)
+	if err != nil && errors.Is(err, context.Canceled) {
+		return transportd.ReleaseOnClose(resp, err, release)
+	}
+	elapsed := time.Since(start)
+	t.latency.Record(false, elapsed)
+	t.errors.Record(err != nil || t.isFailure(resp.StatusCode), elapsed)
+	return transportd.ReleaseOnClose(resp, err, release)
+}
+
+func (t *loadShedTransport) isFailure(code int) bool {
+	for _, failure := range t.Conf.ErrorRate.Codes {
+		if code == failure {
+			return true
+		}
+	}
+	return false
+}
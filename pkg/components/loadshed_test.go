@@ -0,0 +1,128 @@
+package components
+
+import (
+	"context"
+	"net/http"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/golang/mock/gomock"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCurve(t *testing.T) {
+	assert.Equal(t, 0.0, curve(5, 0, 0), "disabled curve rejected")
+	assert.Equal(t, 0.0, curve(5, 10, 20))
+	assert.Equal(t, 0.5, curve(15, 10, 20))
+	assert.Equal(t, 1.0, curve(25, 10, 20))
+}
+
+func TestLoadShedWindowPercentile(t *testing.T) {
+	now := time.Unix(0, 0)
+	w := newLoadShedWindow(10*time.Second, true)
+	w.now = func() time.Time { return now }
+	for x := 1; x <= 100; x = x + 1 {
+		w.Record(false, time.Duration(x)*time.Millisecond)
+	}
+	// The percentile is cached for the current bucket.
+	now = now.Add(time.Second)
+	p, total := w.Percentile(95)
+	assert.Equal(t, 95*time.Millisecond, p)
+	assert.Equal(t, 100, total)
+
+	now = now.Add(10 * time.Second)
+	p, total = w.Percentile(95)
+	assert.Equal(t, time.Duration(0), p, "samples did not age out of the window")
+	assert.Equal(t, 0, total)
+}
+
+func TestLoadShedWindowRate(t *testing.T) {
+	now := time.Unix(0, 0)
+	w := newLoadShedWindow(10*time.Second, false)
+	w.now = func() time.Time { return now }
+	w.Record(true, 0)
+	w.Record(false, 0)
+	w.Record(false, 0)
+	w.Record(false, 0)
+	rate, total := w.Rate()
+	assert.Equal(t, 25.0, rate)
+	assert.Equal(t, 4, total)
+	assert.Empty(t, w.buckets[0].samples)
+}
+
+func TestLoadShedRejects(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	wrapped := NewMockRoundTripper(ctrl)
+	c := &LoadShedComponent{Backend: "backend", Path: "/"}
+	conf := c.Settings()
+	conf.ErrorRate.Lower = 10
+	conf.ErrorRate.Upper = 50
+	conf.ErrorRate.MinimumRequests = 2
+	conf.RetryAfter = 1500 * time.Millisecond
+	f, err := c.New(context.Background(), conf)
+	assert.Nil(t, err)
+	rt := f(wrapped).(*loadShedTransport)
+	rt.random = func() float64 { return 0.5 }
+
+	req, _ := http.NewRequest(http.MethodGet, "http://localhost/", http.NoBody)
+	wrapped.EXPECT().RoundTrip(gomock.Any()).Return(&http.Response{StatusCode: http.StatusInternalServerError}, nil).Times(2)
+	_, _ = rt.RoundTrip(req)
+	_, _ = rt.RoundTrip(req)
+
+	resp, err := rt.RoundTrip(req)
+	assert.Nil(t, err)
+	assert.Equal(t, http.StatusServiceUnavailable, resp.StatusCode)
+	assert.Equal(t, "2", resp.Header.Get("Retry-After"))
+}
+
+func TestLoadShedConcurrency(t *testing.T) {
+	c := &LoadShedComponent{}
+	conf := c.Settings()
+	conf.Concurrency.Lower = 1
+	conf.Concurrency.Upper = 3
+	f, err := c.New(context.Background(), conf)
+	assert.Nil(t, err)
+	rt := f(nil).(*loadShedTransport)
+	rt.random = func() float64 { return 0.49 }
+
+	assert.Equal(t, "", rt.reason())
+	rt.inflight = 2
+	assert.Equal(t, "concurrency", rt.reason())
+	rt.random = func() float64 { return 0.51 }
+	assert.Equal(t, "", rt.reason())
+}
+
+func TestLoadShedInFlightUntilBodyClosed(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	wrapped := NewMockRoundTripper(ctrl)
+	c := &LoadShedComponent{}
+	f, err := c.New(context.Background(), c.Settings())
+	assert.Nil(t, err)
+	rt := f(wrapped).(*loadShedTransport)
+
+	req, _ := http.NewRequest(http.MethodGet, "http://localhost/", http.NoBody)
+	wrapped.EXPECT().RoundTrip(gomock.Any()).Return(simpleResponse(), nil)
+	resp, err := rt.RoundTrip(req)
+	assert.Nil(t, err)
+	assert.Equal(t, int64(1), atomic.LoadInt64(&rt.inflight), "request left flight before the body was closed")
+	_ = resp.Body.Close()
+	assert.Equal(t, int64(0), atomic.LoadInt64(&rt.inflight))
+}
+
+func TestLoadShedInvalidConfig(t *testing.T) {
+	c := &LoadShedComponent{}
+	conf := c.Settings()
+	conf.Concurrency.Lower = 10
+	conf.Concurrency.Upper = 5
+	_, err := c.New(context.Background(), conf)
+	assert.NotNil(t, err)
+	conf = c.Settings()
+	conf.ErrorRate.Upper = 150
+	_, err = c.New(context.Background(), conf)
+	assert.NotNil(t, err)
+}
@@ -40,6 +40,9 @@ func Metrics(_ context.Context, backend string, path string, _ string) (interfac
 	return &MetricsComponent{Backend: backend, Path: path}, nil
 }
 
+// BackendPhase builds the component for each backend of a route.
+func (*MetricsComponent) BackendPhase() {}
+
 // Settings generates a config populated with defaults.
 func (*MetricsComponent) Settings() *MetricsConfig {
 	return &MetricsConfig{
@@ -0,0 +1,295 @@
+package components
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"math/rand"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/asecurityteam/runhttp"
+	transportd "github.com/asecurityteam/transportd/pkg"
+)
+
+const (
+	mirrorSuccess = "success"
+	mirrorError   = "error"
+	mirrorDropped = "dropped"
+	mirrorSkipped = "skipped"
+)
+
+// MirrorConfig contains settings for copying requests to a second backend.
+type MirrorConfig struct {
+	Backend     string        `description:"Backend that receives the copied requests."`
+	Percent     float64       `description:"Percent of requests that are copied, from 0 to 100."`
+	MaxBodySize int           `description:"Largest request body, in bytes, that is copied. Larger requests are not mirrored."`
+	MaxInFlight int           `description:"Maximum number of copied requests in flight. Copies are dropped when the limit is reached."`
+	Timeout     time.Duration `description:"Maximum duration of a copied request."`
+	Compare     bool          `description:"Log differences between the status and body of the primary and mirrored responses."`
+	Metric      string        `description:"Name of the mirrored request count metric."`
+}
+
+// Name of the configuration root.
+func (*MirrorConfig) Name() string {
+	return "mirror"
+}
+
+// MirrorComponent implements the settings.Component interface.
+type MirrorComponent struct {
+	Backend string
+	Path    string
+}
+
+// Mirror satisfies the NewComponent signature.
+func Mirror(_ context.Context, backend string, path string, _ string) (interface{}, error) {
+	return &MirrorComponent{Backend: backend, Path: path}, nil
+}
+
+// Settings generates a config populated with defaults.
+func (*MirrorComponent) Settings() *MirrorConfig {
+	return &MirrorConfig{
+		Percent:     100,
+		MaxBodySize: 1024 * 1024,
+		MaxInFlight: 100,
+		Timeout:     5 * time.Second,
+		Metric:      "http.client.mirror",
+	}
+}
+
+// New generates the middleware.
+func (c *MirrorComponent) New(ctx context.Context, conf *MirrorConfig) (func(http.RoundTripper) http.RoundTripper, error) { // nolint
+	if conf.Backend == "" {
+		return nil, fmt.Errorf("mirror backend must be set")
+	}
+	if conf.Percent < 0 || conf.Percent > 100 {
+		return nil, fmt.Errorf("mirror percent must be between 0 and 100")
+	}
+	if conf.MaxBodySize < 0 {
+		return nil, fmt.Errorf("mirror maxbodysize must not be negative")
+	}
+	if conf.MaxInFlight < 1 {
+		return nil, fmt.Errorf("mirror maxinflight must be greater than zero")
+	}
+	if conf.Timeout <= 0 {
+		return nil, fmt.Errorf("mirror timeout must be greater than zero")
+	}
+	backends := transportd.BackendsFromContext(ctx)
+	if backends == nil {
+		return nil, fmt.Errorf("mirror requires the backend registry")
+	}
+	backend := backends.Load(ctx, conf.Backend)
+	if backend == nil {
+		return nil, fmt.Errorf("mirror backend %s not found", conf.Backend)
+	}
+	target := transportd.NewBackendTransport(backend)
+	return func(next http.RoundTripper) http.RoundTripper {
+		return &mirrorTransport{
+			Backend: c.Backend,
+			Path:    c.Path,
+			Conf:    conf,
+			Target:  target,
+			Wrapped: next,
+			slots:   make(chan struct{}, conf.MaxInFlight),
+		}
+	}, nil
+}
+
+// mirrorResult is the part of a response that is compared between the
+// primary and mirrored requests. Bodies that were not read in full, or that
+// are larger than the body limit, are not compared.
+type mirrorResult struct {
+	status   int
+	body     []byte
+	complete bool
+	err      error
+}
+
+type mirrorEvent struct {
+	Message       string `logevent:"message,default=mirror-response-mismatch"`
+	Backend       string `logevent:"backend"`
+	MirrorBackend string `logevent:"mirror_backend"`
+	Path          string `logevent:"path"`
+	Status        int    `logevent:"status"`
+	MirrorStatus  int    `logevent:"mirror_status"`
+	Error         string `logevent:"error"`
+	MirrorError   string `logevent:"mirror_error"`
+	BodyMatch     bool   `logevent:"body_match"`
+}
+
+// mirrorCapture records the primary response body as the caller reads it so
+// that it can be compared without delaying the caller.
+type mirrorCapture struct {
+	io.ReadCloser
+	status int
+	limit  int
+	buf    bytes.Buffer
+	over   bool
+	once   sync.Once
+	result chan<- *mirrorResult
+}
+
+func (c *mirrorCapture) Read(p []byte) (int, error) {
+	n, err := c.ReadCloser.Read(p)
+	if !c.over {
+		if c.buf.Len()+n > c.limit {
+			c.over = true
+		} else {
+			_, _ = c.buf.Write(p[:n])
+		}
+	}
+	if err == io.EOF {
+		c.finish(true)
+	}
+	return n, err
+}
+
+func (c *mirrorCapture) Close() error {
+	c.finish(false)
+	return c.ReadCloser.Close()
+}
+
+func (c *mirrorCapture) finish(eof bool) {
+	c.once.Do(func() {
+		c.result <- &mirrorResult{status: c.status, body: c.buf.Bytes(), complete: eof && !c.over}
+	})
+}
+
+type mirrorTransport struct {
+	Backend string
+	Path    string
+	Conf    *MirrorConfig
+	Target  http.RoundTripper
+	Wrapped http.RoundTripper
+
+	slots chan struct{}
+}
+
+func (t *mirrorTransport) count(ctx context.Context, result string) {
+	runhttp.StatFromContext(ctx).Count(
+		t.Conf.Metric, 1,
+		"client_dependency:"+t.Backend, "client_path:"+t.Path,
+		"mirror_dependency:"+t.Conf.Backend, "result:"+result,
+	)
+}
+
+func (t *mirrorTransport) RoundTrip(r *http.Request) (*http.Response, error) {
+	if t.Conf.Percent < 100 && rand.Float64()*100 >= t.Conf.Percent { // nolint:gosec
+		return t.Wrapped.RoundTrip(r)
+	}
+	select {
+	case t.slots <- struct{}{}:
+	default:
+		t.count(r.Context(), mirrorDropped)
+		return t.Wrapped.RoundTrip(r)
+	}
+	body, ok := t.bufferBody(r)
+	if !ok {
+		<-t.slots
+		t.count(r.Context(), mirrorSkipped)
+		return t.Wrapped.RoundTrip(r)
+	}
+	// The copy must outlive the incoming request, which is canceled as soon as
+	// the primary response is complete, while keeping its logger and stats.
+	shadow := r.Clone(context.WithoutCancel(r.Context()))
+	shadow.Body = io.NopCloser(bytes.NewReader(body))
+	shadow.GetBody = nil
+	var primary chan *mirrorResult
+	if t.Conf.Compare {
+		primary = make(chan *mirrorResult, 1)
+	}
+	go t.mirror(shadow, primary)
+
+	resp, err := t.Wrapped.RoundTrip(r)
+	if primary != nil {
+		if err != nil {
+			primary <- &mirrorResult{err: err}
+		} else {
+			resp.Body = &mirrorCapture{ReadCloser: resp.Body, status: resp.StatusCode, limit: t.Conf.MaxBodySize, result: primary}
+		}
+	}
+	return resp, err
+}
+
+// bufferBody reads the request body so that it can be sent twice. Requests
+// with a body that is too large, or cannot be read, are left as they were
+// and are not mirrored.
+func (t *mirrorTransport) bufferBody(r *http.Request) ([]byte, bool) {
+	if r.Body == nil || r.Body == http.NoBody {
+		return nil, true
+	}
+	if r.ContentLength > int64(t.Conf.MaxBodySize) {
+		return nil, false
+	}
+	body, err := io.ReadAll(io.LimitReader(r.Body, int64(t.Conf.MaxBodySize)+1))
+	if err != nil || len(body) > t.Conf.MaxBodySize {
+		r.Body = transportd.PrependBody(body, r.Body, err)
+		return nil, false
+	}
+	_ = r.Body.Close()
+	r.Body = io.NopCloser(bytes.NewReader(body))
+	return body, true
+}
+
+// mirror sends the copied request and, when enabled, compares the response
+// with the primary response. The comparison is abandoned if the primary
+// response is not complete before the mirror timeout.
+func (t *mirrorTransport) mirror(r *http.Request, primary <-chan *mirrorResult) {
+	defer func() { <-t.slots }()
+	ctx, cancel := context.WithTimeout(r.Context(), t.Conf.Timeout)
+	defer cancel()
+	r = r.WithContext(ctx)
+
+	shadow := &mirrorResult{}
+	resp, err := t.Target.RoundTrip(r)
+	if err != nil {
+		shadow.err = err
+		t.count(ctx, mirrorError)
+	} else {
+		shadow.status = resp.StatusCode
+		if primary != nil {
+			var body []byte
+			body, err = io.ReadAll(io.LimitReader(resp.Body, int64(t.Conf.MaxBodySize)+1))
+			shadow.body = body
+			shadow.complete = err == nil && len(body) <= t.Conf.MaxBodySize
+		}
+		_, _ = io.Copy(io.Discard, resp.Body)
+		_ = resp.Body.Close()
+		t.count(ctx, mirrorSuccess)
+	}
+	if primary == nil {
+		return
+	}
+	select {
+	case result := <-primary:
+		t.compare(ctx, result, shadow)
+	case <-ctx.Done():
+	}
+}
+
+func (t *mirrorTransport) compare(ctx context.Context, primary *mirrorResult, shadow *mirrorResult) {
+	bodyMatch := true
+	if primary.complete && shadow.complete {
+		bodyMatch = bytes.Equal(primary.body, shadow.body)
+	}
+	if primary.status == shadow.status && (primary.err == nil) == (shadow.err == nil) && bodyMatch {
+		return
+	}
+	event := mirrorEvent{
+		Backend:       t.Backend,
+		MirrorBackend: t.Conf.Backend,
+		Path:          t.Path,
+		Status:        primary.status,
+		MirrorStatus:  shadow.status,
+		BodyMatch:     bodyMatch,
+	}
+	if primary.err != nil {
+		event.Error = primary.err.Error()
+	}
+	if shadow.err != nil {
+		event.MirrorError = shadow.err.Error()
+	}
+	runhttp.LoggerFromContext(ctx).Info(event)
+}
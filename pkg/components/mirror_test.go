@@ -0,0 +1,180 @@
+package components
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/asecurityteam/logevent"
+	transportd "github.com/asecurityteam/transportd/pkg"
+	"github.com/golang/mock/gomock"
+	"github.com/stretchr/testify/assert"
+)
+
+// mirrorBackend is a transportd.Backend that records the requests it is sent.
+type mirrorBackend struct {
+	http.RoundTripper
+	host *url.URL
+}
+
+func (b *mirrorBackend) Host() *url.URL     { return b.host }
+func (b *mirrorBackend) Count() int         { return 1 }
+func (b *mirrorBackend) TTL() time.Duration { return time.Hour }
+
+// shadowBackends inserts a backend registry that contains only the shadow
+// backend.
+func shadowBackends(ctx context.Context, shadow http.RoundTripper) context.Context {
+	u, _ := url.Parse("https://shadow.localhost")
+	reg := transportd.NewStaticBackendRegistry()
+	reg.Store(ctx, "shadow", &mirrorBackend{RoundTripper: shadow, host: u})
+	return transportd.BackendsToContext(ctx, reg)
+}
+
+func TestMirrorCopiesRequest(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	ctx := context.Background()
+	wrapped := NewMockRoundTripper(ctrl)
+	shadow := NewMockRoundTripper(ctrl)
+	c := &MirrorComponent{Backend: "backend", Path: "/"}
+	conf := c.Settings()
+	conf.Backend = "shadow"
+	f, err := c.New(shadowBackends(ctx, shadow), conf)
+	assert.Nil(t, err)
+	rt := f(wrapped).(*mirrorTransport)
+	req, _ := http.NewRequest(http.MethodPost, "https://primary.localhost/a?b=c", strings.NewReader("body"))
+	req = req.WithContext(ctx)
+
+	done := make(chan struct{})
+	shadow.EXPECT().RoundTrip(gomock.Any()).DoAndReturn(func(r *http.Request) (*http.Response, error) {
+		defer close(done)
+		assert.Equal(t, "shadow.localhost", r.URL.Host)
+		assert.Equal(t, "/a", r.URL.Path)
+		b, _ := io.ReadAll(r.Body)
+		assert.Equal(t, "body", string(b))
+		return simpleResponse(), nil
+	})
+	wrapped.EXPECT().RoundTrip(req).DoAndReturn(func(r *http.Request) (*http.Response, error) {
+		b, _ := io.ReadAll(r.Body)
+		assert.Equal(t, "body", string(b))
+		return simpleResponse(), nil
+	})
+	resp, err := rt.RoundTrip(req)
+	assert.Nil(t, err)
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	<-done
+}
+
+func TestMirrorSkipsLargeBodies(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	ctx := context.Background()
+	wrapped := NewMockRoundTripper(ctrl)
+	shadow := NewMockRoundTripper(ctrl)
+	c := &MirrorComponent{Backend: "backend", Path: "/"}
+	conf := c.Settings()
+	conf.Backend = "shadow"
+	conf.MaxBodySize = 2
+	f, err := c.New(shadowBackends(ctx, shadow), conf)
+	assert.Nil(t, err)
+	rt := f(wrapped).(*mirrorTransport)
+	req, _ := http.NewRequest(http.MethodPost, "https://primary.localhost/", io.NopCloser(strings.NewReader("large")))
+
+	wrapped.EXPECT().RoundTrip(req).DoAndReturn(func(r *http.Request) (*http.Response, error) {
+		b, _ := io.ReadAll(r.Body)
+		assert.Equal(t, "large", string(b))
+		return simpleResponse(), nil
+	})
+	_, err = rt.RoundTrip(req)
+	assert.Nil(t, err)
+	assert.Empty(t, rt.slots)
+}
+
+func TestMirrorDropsWhenFull(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	ctx := context.Background()
+	wrapped := NewMockRoundTripper(ctrl)
+	shadow := NewMockRoundTripper(ctrl)
+	c := &MirrorComponent{Backend: "backend", Path: "/"}
+	conf := c.Settings()
+	conf.Backend = "shadow"
+	conf.MaxInFlight = 1
+	f, err := c.New(shadowBackends(ctx, shadow), conf)
+	assert.Nil(t, err)
+	rt := f(wrapped).(*mirrorTransport)
+	rt.slots <- struct{}{}
+	req, _ := http.NewRequest(http.MethodGet, "https://primary.localhost/", http.NoBody)
+	wrapped.EXPECT().RoundTrip(req).Return(simpleResponse(), nil)
+	_, err = rt.RoundTrip(req)
+	assert.Nil(t, err)
+}
+
+func TestMirrorCompare(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	logger := NewMockLogger(ctrl)
+	ctx := logevent.NewContext(context.Background(), logger)
+	wrapped := NewMockRoundTripper(ctrl)
+	shadow := NewMockRoundTripper(ctrl)
+	c := &MirrorComponent{Backend: "backend", Path: "/"}
+	conf := c.Settings()
+	conf.Backend = "shadow"
+	conf.Compare = true
+	f, err := c.New(shadowBackends(ctx, shadow), conf)
+	assert.Nil(t, err)
+	rt := f(wrapped).(*mirrorTransport)
+	req, _ := http.NewRequest(http.MethodGet, "https://primary.localhost/", http.NoBody)
+	req = req.WithContext(ctx)
+
+	done := make(chan struct{})
+	shadow.EXPECT().RoundTrip(gomock.Any()).Return(&http.Response{
+		StatusCode: http.StatusInternalServerError,
+		Body:       io.NopCloser(strings.NewReader("shadow")),
+	}, nil)
+	wrapped.EXPECT().RoundTrip(req).Return(&http.Response{
+		StatusCode: http.StatusOK,
+		Body:       io.NopCloser(strings.NewReader("primary")),
+	}, nil)
+	logger.EXPECT().Info(gomock.Any()).Do(func(event interface{}) {
+		defer close(done)
+		e := event.(mirrorEvent)
+		assert.Equal(t, http.StatusOK, e.Status)
+		assert.Equal(t, http.StatusInternalServerError, e.MirrorStatus)
+		assert.False(t, e.BodyMatch)
+	})
+	resp, err := rt.RoundTrip(req)
+	assert.Nil(t, err)
+	_, _ = io.ReadAll(resp.Body)
+	_ = resp.Body.Close()
+	<-done
+}
+
+func TestMirrorInvalidConfig(t *testing.T) {
+	ctx := context.Background()
+	c := &MirrorComponent{}
+	conf := c.Settings()
+	_, err := c.New(ctx, conf)
+	assert.NotNil(t, err, "missing backend was accepted")
+
+	conf.Backend = "shadow"
+	_, err = c.New(ctx, conf)
+	assert.NotNil(t, err, "missing registry was accepted")
+
+	_, err = c.New(transportd.BackendsToContext(ctx, transportd.NewStaticBackendRegistry()), conf)
+	assert.NotNil(t, err, "unknown backend was accepted")
+
+	conf.Percent = 101
+	_, err = c.New(ctx, conf)
+	assert.NotNil(t, err)
+	assert.False(t, errors.Is(err, context.Canceled))
+}
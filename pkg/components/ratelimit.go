@@ -0,0 +1,213 @@
+package components
+
+import (
+	"container/list"
+	"context"
+	"fmt"
+	"math"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/asecurityteam/runhttp"
+)
+
+const (
+	// RateLimitKeyIP gives each client IP address its own limit.
+	RateLimitKeyIP = "ip"
+	// RateLimitKeyHeader gives each value of a request header its own limit.
+	RateLimitKeyHeader = "header"
+	// RateLimitKeyConstant applies a single limit to all requests.
+	RateLimitKeyConstant = "constant"
+)
+
+// RateLimitConfig contains settings for token bucket rate limiting.
+type RateLimitConfig struct {
+	Rate           float64 `description:"Requests per second allowed for each key."`
+	Burst          int     `description:"Maximum requests allowed at once for each key."`
+	Key            string  `description:"Source of the rate limit key. One of ip, header, or constant."`
+	Header         string  `description:"List of headers that contain the key when the key is header. The first non empty value will be used. Requests without a value are keyed by IP."`
+	MaxKeys        int     `description:"Maximum number of keys tracked at once. The least recently used key is forgotten when the limit is reached."`
+	RejectedMetric string  `description:"Name of the rejected request count metric."`
+}
+
+// Name of the configuration root.
+func (*RateLimitConfig) Name() string {
+	return "ratelimit"
+}
+
+// RateLimitComponent implements the settings.Component interface.
+type RateLimitComponent struct {
+	Backend string
+	Path    string
+}
+
+// RateLimit satisfies the NewComponent signature.
+func RateLimit(_ context.Context, backend string, path string, _ string) (interface{}, error) {
+	return &RateLimitComponent{Backend: backend, Path: path}, nil
+}
+
+// Settings generates a config populated with defaults.
+func (*RateLimitComponent) Settings() *RateLimitConfig {
+	return &RateLimitConfig{
+		Rate:           10,
+		Burst:          20,
+		Key:            RateLimitKeyIP,
+		Header:         "X-Principal",
+		MaxKeys:        10000,
+		RejectedMetric: "http.client.ratelimit.rejected",
+	}
+}
+
+// RequestPhase marks the component as safe to run for upgrade requests.
+func (*RateLimitComponent) RequestPhase() {}
+
+// New generates the middleware.
+func (c *RateLimitComponent) New(_ context.Context, conf *RateLimitConfig) (func(http.RoundTripper) http.RoundTripper, error) { // nolint
+	if conf.Rate <= 0 || conf.Burst < 1 {
+		return nil, fmt.Errorf("ratelimit rate and burst must be greater than zero")
+	}
+	if conf.MaxKeys < 1 {
+		return nil, fmt.Errorf("ratelimit maxkeys must be greater than zero")
+	}
+	key := strings.ToLower(conf.Key)
+	switch key {
+	case RateLimitKeyIP, RateLimitKeyConstant:
+	case RateLimitKeyHeader:
+		if strings.TrimSpace(conf.Header) == "" {
+			return nil, fmt.Errorf("ratelimit header is required when the key is header")
+		}
+	default:
+		return nil, fmt.Errorf("unknown ratelimit key %s", conf.Key)
+	}
+	return func(next http.RoundTripper) http.RoundTripper {
+		return &rateLimitTransport{
+			Backend: c.Backend,
+			Path:    c.Path,
+			Conf:    conf,
+			Key:     key,
+			Wrapped: next,
+			buckets: newBucketCache(conf.MaxKeys),
+			now:     time.Now,
+		}
+	}, nil
+}
+
+// tokenBucket holds the tokens available to a single key.
+type tokenBucket struct {
+	tokens float64
+	last   time.Time
+}
+
+// bucketCache is a least recently used set of token buckets. Forgetting a
+// key only means its next request starts with a full bucket, so the size is
+// capped to keep memory bounded no matter how many keys are seen.
+type bucketCache struct {
+	lock    sync.Mutex
+	size    int
+	order   *list.List
+	buckets map[string]*list.Element
+}
+
+type bucketEntry struct {
+	key    string
+	bucket *tokenBucket
+}
+
+func newBucketCache(size int) *bucketCache {
+	return &bucketCache{size: size, order: list.New(), buckets: make(map[string]*list.Element)}
+}
+
+// take removes a token from the bucket of the key. It returns whether a
+// token was available, the remaining whole tokens, the time until the next
+// token is available, and the time until the bucket is full.
+func (c *bucketCache) take(key string, now time.Time, rate float64, burst int) (bool, int, time.Duration, time.Duration) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	var bucket *tokenBucket
+	if e, ok := c.buckets[key]; ok {
+		c.order.MoveToFront(e)
+		bucket = e.Value.(*bucketEntry).bucket
+		bucket.tokens = math.Min(float64(burst), bucket.tokens+now.Sub(bucket.last).Seconds()*rate)
+		bucket.last = now
+	} else {
+		if c.order.Len() >= c.size {
+			oldest := c.order.Back()
+			c.order.Remove(oldest)
+			delete(c.buckets, oldest.Value.(*bucketEntry).key)
+		}
+		bucket = &tokenBucket{tokens: float64(burst), last: now}
+		c.buckets[key] = c.order.PushFront(&bucketEntry{key: key, bucket: bucket})
+	}
+	allowed := bucket.tokens >= 1
+	if allowed {
+		bucket.tokens = bucket.tokens - 1
+	}
+	var wait time.Duration
+	if bucket.tokens < 1 {
+		wait = time.Duration((1 - bucket.tokens) / rate * float64(time.Second))
+	}
+	reset := time.Duration((float64(burst) - bucket.tokens) / rate * float64(time.Second))
+	return allowed, int(bucket.tokens), wait, reset
+}
+
+type rateLimitTransport struct {
+	Backend string
+	Path    string
+	Conf    *RateLimitConfig
+	Key     string
+	Wrapped http.RoundTripper
+
+	buckets *bucketCache
+	now     func() time.Time
+}
+
+func (t *rateLimitTransport) key(r *http.Request) string {
+	switch t.Key {
+	case RateLimitKeyConstant:
+		return ""
+	case RateLimitKeyHeader:
+		if v := firstHeaderValue(r, t.Conf.Header); v != "" {
+			return "header:" + v
+		}
+	}
+	ip, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		ip = r.RemoteAddr
+	}
+	return "ip:" + ip
+}
+
+// seconds rounds a duration up to whole seconds for use in headers.
+func seconds(d time.Duration) string {
+	return strconv.Itoa(int(math.Ceil(d.Seconds())))
+}
+
+func (t *rateLimitTransport) RoundTrip(r *http.Request) (*http.Response, error) {
+	allowed, remaining, wait, reset := t.buckets.take(t.key(r), t.now(), t.Conf.Rate, t.Conf.Burst)
+	var resp *http.Response
+	var err error
+	if allowed {
+		resp, err = t.Wrapped.RoundTrip(r)
+		if err != nil {
+			return resp, err
+		}
+	} else {
+		runhttp.StatFromContext(r.Context()).Count(
+			t.Conf.RejectedMetric, 1,
+			"client_dependency:"+t.Backend, "client_path:"+t.Path,
+		)
+		resp = newError(http.StatusTooManyRequests, "rate limit exceeded")
+		resp.Header.Set("Retry-After", seconds(wait))
+	}
+	if resp.Header == nil {
+		resp.Header = http.Header{}
+	}
+	resp.Header.Set("RateLimit-Limit", strconv.Itoa(t.Conf.Burst))
+	resp.Header.Set("RateLimit-Remaining", strconv.Itoa(remaining))
+	resp.Header.Set("RateLimit-Reset", seconds(reset))
+	return resp, nil
+}
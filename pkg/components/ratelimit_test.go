@@ -0,0 +1,102 @@
+package components
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/golang/mock/gomock"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestBucketCacheTake(t *testing.T) {
+	c := newBucketCache(10)
+	now := time.Unix(0, 0)
+
+	allowed, remaining, _, _ := c.take("a", now, 1, 2)
+	assert.True(t, allowed)
+	assert.Equal(t, 1, remaining)
+	allowed, remaining, _, reset := c.take("a", now, 1, 2)
+	assert.True(t, allowed)
+	assert.Equal(t, 0, remaining)
+	assert.Equal(t, 2*time.Second, reset)
+	allowed, _, wait, _ := c.take("a", now, 1, 2)
+	assert.False(t, allowed)
+	assert.Equal(t, time.Second, wait)
+
+	allowed, _, _, _ = c.take("a", now.Add(time.Second), 1, 2)
+	assert.True(t, allowed, "bucket did not refill")
+	allowed, _, _, _ = c.take("b", now, 1, 2)
+	assert.True(t, allowed, "keys shared a bucket")
+}
+
+func TestBucketCacheBounded(t *testing.T) {
+	c := newBucketCache(2)
+	now := time.Unix(0, 0)
+	_, _, _, _ = c.take("a", now, 1, 1)
+	_, _, _, _ = c.take("b", now, 1, 1)
+	_, _, _, _ = c.take("a", now, 1, 1)
+	_, _, _, _ = c.take("c", now, 1, 1)
+	assert.Equal(t, 2, c.order.Len())
+	assert.Contains(t, c.buckets, "a")
+	assert.NotContains(t, c.buckets, "b", "least recently used key was kept")
+}
+
+func TestRateLimitKeys(t *testing.T) {
+	c := &RateLimitComponent{}
+	conf := c.Settings()
+	conf.Header = "X-Missing, X-Principal"
+	req := httptest.NewRequest(http.MethodGet, "http://localhost/", http.NoBody)
+	req.RemoteAddr = "10.0.0.1:1234"
+
+	rt := &rateLimitTransport{Conf: conf, Key: RateLimitKeyIP}
+	assert.Equal(t, "ip:10.0.0.1", rt.key(req))
+	rt.Key = RateLimitKeyHeader
+	assert.Equal(t, "ip:10.0.0.1", rt.key(req), "missing header did not fall back to IP")
+	req.Header.Set("X-Principal", "user")
+	assert.Equal(t, "header:user", rt.key(req))
+	rt.Key = RateLimitKeyConstant
+	assert.Equal(t, "", rt.key(req))
+}
+
+func TestRateLimitRejects(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	wrapped := NewMockRoundTripper(ctrl)
+	c := &RateLimitComponent{}
+	conf := c.Settings()
+	conf.Rate = 0.5
+	conf.Burst = 1
+	f, err := c.New(context.Background(), conf)
+	assert.Nil(t, err)
+	rt := f(wrapped)
+	req := httptest.NewRequest(http.MethodGet, "http://localhost/", http.NoBody)
+
+	wrapped.EXPECT().RoundTrip(gomock.Any()).Return(simpleResponse(), nil)
+	resp, err := rt.RoundTrip(req)
+	assert.Nil(t, err)
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Equal(t, "1", resp.Header.Get("RateLimit-Limit"))
+	assert.Equal(t, "0", resp.Header.Get("RateLimit-Remaining"))
+
+	resp, err = rt.RoundTrip(req)
+	assert.Nil(t, err)
+	assert.Equal(t, http.StatusTooManyRequests, resp.StatusCode)
+	assert.Equal(t, "2", resp.Header.Get("Retry-After"))
+	assert.Equal(t, "2", resp.Header.Get("RateLimit-Reset"))
+}
+
+func TestRateLimitInvalidConfig(t *testing.T) {
+	c := &RateLimitComponent{}
+	conf := c.Settings()
+	conf.Key = "cookie"
+	_, err := c.New(context.Background(), conf)
+	assert.NotNil(t, err)
+	conf = c.Settings()
+	conf.Burst = 0
+	_, err = c.New(context.Background(), conf)
+	assert.NotNil(t, err)
+}
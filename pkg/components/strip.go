@@ -40,6 +40,9 @@ func (*StripComponent) Settings() *StripConfig {
 	return &StripConfig{Count: 0}
 }
 
+// RequestPhase marks the component as safe to run for upgrade requests.
+func (*StripComponent) RequestPhase() {}
+
 // New generates the middleware.
 func (*StripComponent) New(_ context.Context, conf *StripConfig) (func(http.RoundTripper) http.RoundTripper, error) {
 	return func(wrapped http.RoundTripper) http.RoundTripper {
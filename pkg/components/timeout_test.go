@@ -28,7 +28,9 @@ func TestTimeoutContext(t *testing.T) {
 			return &http.Response{StatusCode: http.StatusOK, Body: http.NoBody}, nil
 		},
 	)
-	_, _ = rt.RoundTrip(req)
+	resp, _ := rt.RoundTrip(req)
 	assert.NotNil(t, capturedCtx)
 	assert.Nil(t, capturedCtx.Err())
+	_ = resp.Body.Close()
+	assert.ErrorIs(t, capturedCtx.Err(), context.Canceled, "timeout was not released with the body")
 }
@@ -56,6 +56,9 @@ func (*RequestValidationComponent) Settings() *RequestValidationConfig {
 	return &RequestValidationConfig{}
 }
 
+// RequestPhase marks the component as safe to run for upgrade requests.
+func (*RequestValidationComponent) RequestPhase() {}
+
 // New generates the middleware.
 func (*RequestValidationComponent) New(_ context.Context, _ *RequestValidationConfig) (func(http.RoundTripper) http.RoundTripper, error) {
 	return func(wrapped http.RoundTripper) http.RoundTripper {
@@ -65,6 +68,9 @@ func (*RequestValidationComponent) New(_ context.Context, _ *RequestValidationCo
 
 type outputValidatingTransport struct {
 	Wrapped http.RoundTripper
+	// Streaming validates only the status and headers so that the body is
+	// passed on as it arrives.
+	Streaming bool
 }
 
 func (r *outputValidatingTransport) RoundTrip(req *http.Request) (*http.Response, error) {
@@ -75,6 +81,9 @@ func (r *outputValidatingTransport) RoundTrip(req *http.Request) (*http.Response
 	}
 	// restore the old path just in case something else modified it from the path in the specification
 	req.URL.Path = originalPath
+	if r.Streaming {
+		return r.validateHeaders(req, resp)
+	}
 	body, err := io.ReadAll(resp.Body)
 	if err != nil {
 		return nil, err
@@ -116,6 +125,27 @@ func (r *outputValidatingTransport) RoundTrip(req *http.Request) (*http.Response
 	return resp, nil
 }
 
+func (r *outputValidatingTransport) validateHeaders(req *http.Request, resp *http.Response) (*http.Response, error) {
+	input := &openapi3filter.ResponseValidationInput{
+		RequestValidationInput: &openapi3filter.RequestValidationInput{
+			Route:       transportd.RouteFromContext(req.Context()),
+			Request:     req,
+			QueryParams: req.URL.Query(),
+			PathParams:  transportd.PathParamsFromContext(req.Context()),
+		},
+		Status: resp.StatusCode,
+		Header: resp.Header,
+		Options: &openapi3filter.Options{
+			ExcludeResponseBody: true,
+		},
+	}
+	if err := openapi3filter.ValidateResponse(req.Context(), input); err != nil {
+		_ = resp.Body.Close()
+		return newError(http.StatusBadGateway, err.Error()), nil
+	}
+	return resp, nil
+}
+
 // ResponseValidationConfig is a placeholder for future validation options.
 type ResponseValidationConfig struct{}
 
@@ -139,8 +169,9 @@ func (*ResponseValidationComponent) Settings() *ResponseValidationConfig {
 }
 
 // New generates the middleware.
-func (*ResponseValidationComponent) New(_ context.Context, _ *ResponseValidationConfig) (func(http.RoundTripper) http.RoundTripper, error) {
+func (*ResponseValidationComponent) New(ctx context.Context, _ *ResponseValidationConfig) (func(http.RoundTripper) http.RoundTripper, error) {
+	streaming := transportd.StreamingFromContext(ctx)
 	return func(wrapped http.RoundTripper) http.RoundTripper {
-		return &outputValidatingTransport{Wrapped: wrapped}
+		return &outputValidatingTransport{Wrapped: wrapped, Streaming: streaming}
 	}, nil
 }
@@ -79,6 +79,9 @@ func (*ValidateHeaderConfigComponent) Settings() *ValidateHeaderConfig {
 	return &ValidateHeaderConfig{}
 }
 
+// RequestPhase marks the component as safe to run for upgrade requests.
+func (*ValidateHeaderConfigComponent) RequestPhase() {}
+
 // New generates the middleware.
 func (*ValidateHeaderConfigComponent) New(_ context.Context, conf *ValidateHeaderConfig) (func(tripper http.RoundTripper) http.RoundTripper, error) {
 	return func(wrapped http.RoundTripper) http.RoundTripper {
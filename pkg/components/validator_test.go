@@ -3,6 +3,7 @@ package components
 import (
 	"bytes"
 	"compress/gzip"
+	"context"
 	"fmt"
 	"io"
 	"net/http"
@@ -255,3 +256,37 @@ func TestValidateResponse(t *testing.T) {
 		assert.Equal(t, tt.statusCode, resp.StatusCode)
 	}
 }
+
+func TestValidateResponseStreaming(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	swagger, err := openapi3.NewLoader().LoadFromData([]byte(validatorYaml))
+	assert.Nil(t, err)
+	router, err := legacyrouter.NewRouter(swagger)
+	assert.Nil(t, err)
+	rt := NewMockRoundTripper(ctrl)
+	c := &ResponseValidationComponent{}
+	f, err := c.New(transportd.StreamingToContext(context.Background(), true), c.Settings())
+	assert.Nil(t, err)
+	wrapped := f(rt)
+
+	req, _ := http.NewRequest(http.MethodGet, "https://localhost/hello?name=test1&name2=test2", http.NoBody)
+	route, pathParams, err := router.FindRoute(req)
+	assert.Nil(t, err)
+	req = req.WithContext(transportd.RouteToContext(req.Context(), route))
+	req = req.WithContext(transportd.PathParamsToContext(req.Context(), pathParams))
+
+	// The body never ends so reading it would block the test.
+	body, writer := io.Pipe()
+	defer writer.Close()
+	rt.EXPECT().RoundTrip(gomock.Any()).Return(&http.Response{
+		StatusCode: http.StatusOK,
+		Header:     http.Header{"Content-Type": []string{"application/json"}},
+		Body:       body,
+	}, nil)
+	resp, err := wrapped.RoundTrip(req)
+	assert.Nil(t, err)
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Equal(t, body, resp.Body)
+}
@@ -0,0 +1,185 @@
+package transportd
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"time"
+
+	"github.com/asecurityteam/transport"
+	"golang.org/x/net/http2"
+)
+
+const (
+	connectionSetting = "connection"
+	// HTTP2Auto uses HTTP/2 when the backend offers it during the TLS
+	// handshake and HTTP/1.1 otherwise.
+	HTTP2Auto = "auto"
+	// HTTP2Force requires HTTP/2 and rejects connections that do not
+	// negotiate it.
+	HTTP2Force = "force"
+	// HTTP2Disable always uses HTTP/1.1.
+	HTTP2Disable = "disable"
+	// HTTP2Cleartext uses HTTP/2 without TLS, also known as h2c. The backend
+	// must accept HTTP/2 with prior knowledge because there is no negotiation.
+	HTTP2Cleartext = "h2c"
+)
+
+// ConnectionConfig tunes the connections made to the hosts of a backend. The
+// defaults match those of the Go http.DefaultTransport.
+type ConnectionConfig struct {
+	MaxIdleConns          int           `description:"Maximum idle connections kept across all hosts. Zero means no limit."`
+	MaxIdleConnsPerHost   int           `description:"Maximum idle connections kept for each host."`
+	MaxConnsPerHost       int           `description:"Maximum connections, including those in use, for each host. Zero means no limit."`
+	IdleConnTimeout       time.Duration `description:"Time an idle connection is kept before closing. Zero means no limit."`
+	DialTimeout           time.Duration `description:"Maximum duration of establishing a TCP connection."`
+	KeepAlive             time.Duration `description:"Interval between TCP keepalive probes. Negative disables keepalives."`
+	TLSHandshakeTimeout   time.Duration `description:"Maximum duration of the TLS handshake. Zero means no limit."`
+	ResponseHeaderTimeout time.Duration `description:"Maximum wait for response headers after the request is sent. Zero means no limit."`
+	HTTP2                 string        `description:"HTTP/2 usage. One of auto, force, disable, h2c."`
+}
+
+// Name of the config root.
+func (*ConnectionConfig) Name() string {
+	return connectionSetting
+}
+
+func newConnectionConfig() *ConnectionConfig {
+	return &ConnectionConfig{
+		MaxIdleConns:        100,
+		MaxIdleConnsPerHost: http.DefaultMaxIdleConnsPerHost,
+		IdleConnTimeout:     90 * time.Second,
+		DialTimeout:         30 * time.Second,
+		KeepAlive:           30 * time.Second,
+		TLSHandshakeTimeout: 10 * time.Second,
+		HTTP2:               HTTP2Auto,
+	}
+}
+
+func validateConnection(conf *ConnectionConfig) error {
+	if conf.MaxIdleConns < 0 || conf.MaxIdleConnsPerHost < 0 || conf.MaxConnsPerHost < 0 {
+		return fmt.Errorf("connection limits must not be negative")
+	}
+	if conf.IdleConnTimeout < 0 || conf.DialTimeout < 0 || conf.TLSHandshakeTimeout < 0 || conf.ResponseHeaderTimeout < 0 {
+		return fmt.Errorf("connection timeouts must not be negative")
+	}
+	switch conf.HTTP2 {
+	case HTTP2Auto, HTTP2Force, HTTP2Disable, HTTP2Cleartext:
+	default:
+		return fmt.Errorf("unknown http2 mode %s", conf.HTTP2)
+	}
+	return nil
+}
+
+// connectionOptions converts the connection settings into options for the
+// transport factory. The TLS configuration, if any, is extended to enforce
+// the HTTP/2 mode. Unix socket hosts are dialed through their socket and
+// bypass any proxy.
+func connectionOptions(conf *ConnectionConfig, tlsConf *tls.Config, sockets unixSockets) []transport.Option {
+	dialer := &net.Dialer{
+		Timeout:   conf.DialTimeout,
+		KeepAlive: conf.KeepAlive,
+	}
+	opts := []transport.Option{
+		transport.OptionDialContext(dialUnix(sockets, dialer.DialContext)),
+		transport.OptionMaxIdleConns(conf.MaxIdleConns),
+		transport.OptionMaxIdleConnsPerHost(conf.MaxIdleConnsPerHost),
+		transport.OptionIdleConnTimeout(conf.IdleConnTimeout),
+		transport.OptionTLSHandshakeTimeout(conf.TLSHandshakeTimeout),
+		transport.OptionResponseHeaderTimeout(conf.ResponseHeaderTimeout),
+		func(t *http.Transport) *http.Transport {
+			t.MaxConnsPerHost = conf.MaxConnsPerHost
+			// A custom dialer or TLS configuration turns off HTTP/2 in the
+			// standard transport unless it is requested explicitly.
+			t.ForceAttemptHTTP2 = conf.HTTP2 != HTTP2Disable
+			t.Proxy = proxyUnix(t.Proxy)
+			return t
+		},
+	}
+	switch conf.HTTP2 {
+	case HTTP2Disable:
+		// A non-nil, empty map prevents the standard transport from
+		// negotiating HTTP/2.
+		opts = append(opts, transport.OptionTLSNextProto(map[string]func(string, *tls.Conn) http.RoundTripper{}))
+	case HTTP2Cleartext:
+		// The standard transport only speaks HTTP/2 over TLS. Plain HTTP
+		// requests are handed to an HTTP/2 transport that dials without TLS
+		// through the same dialer, and therefore the same dial timeout,
+		// keepalive, and unix sockets, as the standard transport.
+		dial := dialUnix(sockets, dialer.DialContext)
+		opts = append(opts, func(t *http.Transport) *http.Transport {
+			// Linking the HTTP/2 transport to the standard one applies the
+			// idle connection and response header timeouts. It only fails
+			// when HTTP/2 is already configured, which a new transport never
+			// is.
+			h2, err := http2.ConfigureTransports(t)
+			if err != nil {
+				h2 = &http2.Transport{}
+			}
+			// The linked transport only reuses connections upgraded during a
+			// TLS handshake. Clearing the pool lets it dial its own.
+			h2.ConnPool = nil
+			h2.AllowHTTP = true
+			h2.DialTLSContext = func(ctx context.Context, network string, addr string, _ *tls.Config) (net.Conn, error) {
+				return dial(ctx, network, addr)
+			}
+			t.RegisterProtocol("http", h2)
+			return t
+		})
+	case HTTP2Force:
+		if tlsConf == nil {
+			tlsConf = &tls.Config{MinVersion: tls.VersionTLS12}
+		}
+		tlsConf = requireHTTP2(tlsConf)
+	}
+	if tlsConf != nil {
+		// The standard transport modifies the TLS configuration it is given
+		// so each transport made by the factory needs its own copy.
+		opts = append(opts, func(t *http.Transport) *http.Transport {
+			t.TLSClientConfig = tlsConf.Clone()
+			return t
+		})
+	}
+	return opts
+}
+
+// validateCleartext ensures that a backend using h2c only has plain HTTP
+// hosts and no settings that h2c cannot honor. HTTP/2 sends every request to
+// a host over a single connection so there is no per host connection limit.
+func validateCleartext(conf *ConnectionConfig, tlsConf *TLSConfig, hosts []*url.URL) error {
+	if conf.HTTP2 != HTTP2Cleartext {
+		return nil
+	}
+	if tlsConf.enabled() {
+		return fmt.Errorf("tls settings cannot be used with h2c")
+	}
+	if conf.MaxConnsPerHost != 0 {
+		return fmt.Errorf("max connections per host cannot be used with h2c")
+	}
+	for _, host := range hosts {
+		if host.Scheme != "http" {
+			return fmt.Errorf("h2c requires http hosts but found %s", host.String())
+		}
+	}
+	return nil
+}
+
+// requireHTTP2 rejects TLS connections that do not negotiate HTTP/2.
+func requireHTTP2(conf *tls.Config) *tls.Config {
+	conf = conf.Clone()
+	conf.NextProtos = []string{"h2"}
+	verify := conf.VerifyConnection
+	conf.VerifyConnection = func(cs tls.ConnectionState) error {
+		if cs.NegotiatedProtocol != "h2" {
+			return fmt.Errorf("backend did not negotiate HTTP/2")
+		}
+		if verify != nil {
+			return verify(cs)
+		}
+		return nil
+	}
+	return conf
+}
@@ -0,0 +1,206 @@
+package transportd
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/http/httputil"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/asecurityteam/transport"
+	"github.com/golang/mock/gomock"
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/net/http2"
+	"golang.org/x/net/http2/h2c"
+)
+
+func TestValidateConnection(t *testing.T) {
+	tests := []struct {
+		name    string
+		modify  func(*ConnectionConfig)
+		wantErr bool
+	}{
+		{name: "defaults", modify: func(*ConnectionConfig) {}, wantErr: false},
+		{name: "negative limit", modify: func(c *ConnectionConfig) { c.MaxConnsPerHost = -1 }, wantErr: true},
+		{name: "negative timeout", modify: func(c *ConnectionConfig) { c.DialTimeout = -time.Second }, wantErr: true},
+		{name: "negative keepalive", modify: func(c *ConnectionConfig) { c.KeepAlive = -1 }, wantErr: false},
+		{name: "h2c", modify: func(c *ConnectionConfig) { c.HTTP2 = HTTP2Cleartext }, wantErr: false},
+		{name: "unknown http2", modify: func(c *ConnectionConfig) { c.HTTP2 = "sometimes" }, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			conf := newConnectionConfig()
+			tt.modify(conf)
+			assert.Equal(t, tt.wantErr, validateConnection(conf) != nil)
+		})
+	}
+}
+
+func TestConnectionOptions(t *testing.T) {
+	conf := newConnectionConfig()
+	conf.MaxIdleConnsPerHost = 32
+	conf.MaxConnsPerHost = 64
+	conf.ResponseHeaderTimeout = 5 * time.Second
+	rt := transport.New(connectionOptions(conf, nil, nil)...)
+	assert.Equal(t, 32, rt.MaxIdleConnsPerHost)
+	assert.Equal(t, 64, rt.MaxConnsPerHost)
+	assert.Equal(t, 5*time.Second, rt.ResponseHeaderTimeout)
+	assert.True(t, rt.ForceAttemptHTTP2)
+
+	conf.HTTP2 = HTTP2Disable
+	rt = transport.New(connectionOptions(conf, nil, nil)...)
+	assert.False(t, rt.ForceAttemptHTTP2)
+	assert.NotNil(t, rt.TLSNextProto)
+	assert.Empty(t, rt.TLSNextProto)
+}
+
+func TestConnectionHTTP2Modes(t *testing.T) {
+	h2 := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write([]byte(r.Proto))
+	}))
+	h2.EnableHTTP2 = true
+	h2.StartTLS()
+	defer h2.Close()
+	h1 := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write([]byte(r.Proto))
+	}))
+	defer h1.Close()
+
+	pool := x509.NewCertPool()
+	pool.AddCert(h2.Certificate())
+	pool.AddCert(h1.Certificate())
+	tlsConf := &tls.Config{RootCAs: pool, MinVersion: tls.VersionTLS12}
+	proto := func(mode string, url string) (int, error) {
+		conf := newConnectionConfig()
+		conf.HTTP2 = mode
+		rt := transport.New(connectionOptions(conf, tlsConf, nil)...)
+		defer rt.CloseIdleConnections()
+		req, _ := http.NewRequest(http.MethodGet, url, http.NoBody)
+		resp, err := rt.RoundTrip(req)
+		if err != nil {
+			return 0, err
+		}
+		_ = resp.Body.Close()
+		return resp.ProtoMajor, nil
+	}
+
+	major, err := proto(HTTP2Auto, h2.URL)
+	assert.Nil(t, err)
+	assert.Equal(t, 2, major)
+	major, err = proto(HTTP2Auto, h1.URL)
+	assert.Nil(t, err)
+	assert.Equal(t, 1, major)
+	major, err = proto(HTTP2Disable, h2.URL)
+	assert.Nil(t, err)
+	assert.Equal(t, 1, major)
+	major, err = proto(HTTP2Force, h2.URL)
+	assert.Nil(t, err)
+	assert.Equal(t, 2, major)
+	_, err = proto(HTTP2Force, h1.URL)
+	assert.NotNil(t, err, "forced HTTP/2 connected to an HTTP/1.1 backend")
+}
+
+func TestValidateCleartext(t *testing.T) {
+	plain, _ := url.Parse("http://localhost")
+	secure, _ := url.Parse("https://localhost")
+	tests := []struct {
+		name     string
+		mode     string
+		maxConns int
+		tls      func(*TLSConfig)
+		hosts    []*url.URL
+		wantErr  bool
+	}{
+		{name: "not h2c", mode: HTTP2Auto, tls: func(*TLSConfig) {}, hosts: []*url.URL{secure}, wantErr: false},
+		{name: "http hosts", mode: HTTP2Cleartext, tls: func(*TLSConfig) {}, hosts: []*url.URL{plain}, wantErr: false},
+		{name: "https host", mode: HTTP2Cleartext, tls: func(*TLSConfig) {}, hosts: []*url.URL{plain, secure}, wantErr: true},
+		{name: "tls settings", mode: HTTP2Cleartext, tls: func(c *TLSConfig) { c.ServerName = "localhost" }, hosts: []*url.URL{plain}, wantErr: true},
+		{name: "connection limit", mode: HTTP2Cleartext, maxConns: 10, tls: func(*TLSConfig) {}, hosts: []*url.URL{plain}, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			conf := newConnectionConfig()
+			conf.HTTP2 = tt.mode
+			conf.MaxConnsPerHost = tt.maxConns
+			tlsConf := newTLSConfig()
+			tt.tls(tlsConf)
+			assert.Equal(t, tt.wantErr, validateCleartext(conf, tlsConf, tt.hosts) != nil)
+		})
+	}
+}
+
+func TestConnectionCleartextStreaming(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	release := make(chan struct{})
+	upstream := httptest.NewServer(h2c.NewHandler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, 2, r.ProtoMajor)
+		w.Header().Set("Trailer", "Grpc-Status")
+		_, _ = w.Write([]byte("first"))
+		w.(http.Flusher).Flush()
+		<-release
+		_, _ = w.Write([]byte("second"))
+		w.Header().Set("Grpc-Status", "0")
+	}), &http2.Server{}))
+	defer upstream.Close()
+
+	conf := newConnectionConfig()
+	conf.HTTP2 = HTTP2Cleartext
+	u, _ := url.Parse(upstream.URL)
+	backend := NewMockBackend(ctrl)
+	backend.EXPECT().Host().Return(u).AnyTimes()
+	proxy := httptest.NewServer(h2c.NewHandler(&httputil.ReverseProxy{
+		Director:  func(*http.Request) {},
+		Transport: &hostRewrite{Backend: backend, Wrapped: transport.New(connectionOptions(conf, nil, nil)...)},
+	}, &http2.Server{}))
+	defer proxy.Close()
+
+	client := transport.New(connectionOptions(conf, nil, nil)...)
+	defer client.CloseIdleConnections()
+	req, _ := http.NewRequest(http.MethodPost, proxy.URL+"/stream", http.NoBody)
+	resp, err := client.RoundTrip(req)
+	if !assert.Nil(t, err) {
+		close(release)
+		return
+	}
+	defer resp.Body.Close()
+	assert.Equal(t, 2, resp.ProtoMajor)
+
+	// The first chunk must arrive while the upstream is still writing.
+	first := make([]byte, len("first"))
+	_, err = io.ReadFull(resp.Body, first)
+	close(release)
+	assert.Nil(t, err)
+	assert.Equal(t, "first", string(first))
+	rest, err := io.ReadAll(resp.Body)
+	assert.Nil(t, err)
+	assert.Equal(t, "second", string(rest))
+	assert.Equal(t, "0", resp.Trailer.Get("Grpc-Status"))
+}
+
+func TestConnectionCleartextTimeouts(t *testing.T) {
+	release := make(chan struct{})
+	upstream := httptest.NewServer(h2c.NewHandler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-release
+	}), &http2.Server{}))
+	defer upstream.Close()
+	defer close(release)
+
+	conf := newConnectionConfig()
+	conf.HTTP2 = HTTP2Cleartext
+	conf.ResponseHeaderTimeout = 50 * time.Millisecond
+	rt := transport.New(connectionOptions(conf, nil, nil)...)
+	defer rt.CloseIdleConnections()
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	req, _ := http.NewRequestWithContext(ctx, http.MethodGet, upstream.URL, http.NoBody)
+	_, err := rt.RoundTrip(req)
+	assert.NotNil(t, err)
+	assert.Nil(t, ctx.Err(), "response header timeout was not applied to h2c")
+}
@@ -19,6 +19,24 @@ const (
 // implement the Component interface from the 'settings' project.
 type NewComponent func(ctx context.Context, backend string, path string, method string) (interface{}, error)
 
+// RequestPhaseComponent is implemented by components that only act on the
+// request, such as authentication, header validation, or rate limiting, and
+// leave the response body untouched. Routes that allow connection upgrades
+// run only these components for upgrade requests so that the connection can
+// be tunneled once the backend switches protocols.
+type RequestPhaseComponent interface {
+	RequestPhase()
+}
+
+// BackendPhaseComponent is implemented by components that keep state or
+// metrics for a single backend, such as circuit breaking. These components are
+// built once for each backend of a route, below any split, match rule, or
+// failover, so that every attempt to a backend passes through them. All other
+// components are built once for the route and see each request only once.
+type BackendPhaseComponent interface {
+	BackendPhase()
+}
+
 // ClientRegistry manages a set of configured http.RoundTripper implementations that
 // will be used to make requests.
 type ClientRegistry interface {
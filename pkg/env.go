@@ -1,18 +1,49 @@
 package transportd
 
 import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
 	"os"
 	"regexp"
+	"strings"
+
+	"github.com/ghodss/yaml"
 )
 
 const (
-	envPattern = `\${[^}]+}`
+	// envPattern matches ${NAME} references along with the $${...} escape.
+	envPattern = `\$?\${[^}]+}`
+	// EnvStrictKey is the environment variable that turns on strict
+	// interpolation of the specification when set to true.
+	EnvStrictKey = "TRANSPORTD_ENV_STRICT"
+	// secretPlaceholder stands in for a resolved secret until the document
+	// has been parsed.
+	secretPlaceholder = "__transportd_secret_%d__"
 )
 
 // EnvProcessor transforms documents by interpolating environment variables.
+//
+// References take one of the forms below. Unset variables are replaced with
+// an empty string unless Strict is set, in which case they are an error.
+//
+//	${NAME}            the value of NAME
+//	${NAME:-default}   the value of NAME, or default if NAME is unset or empty
+//	${NAME:?message}   the value of NAME, or an error with message if NAME is unset or empty
+//	$${NAME}           the literal text ${NAME}
+//
+// References whose name starts with the name of a SecretResolver followed by a
+// colon, such as ${file:/run/secrets/key}, are resolved as secrets instead of
+// environment variables. The :- and :? operators apply to secrets as well.
+// Secrets are inserted into the string values of the parsed document rather
+// than the raw text, so documents that contain secrets are returned as JSON.
 type EnvProcessor struct {
-	pattern *regexp.Regexp
-	osenv   func(string) string
+	Strict bool
+
+	pattern   *regexp.Regexp
+	lookupEnv func(string) (string, bool)
+	secrets   *secretRedactor
 }
 
 // NewEnvProcessor prepares the EnvProcessor and returns it.
@@ -21,14 +52,162 @@ func NewEnvProcessor() *EnvProcessor {
 	return &EnvProcessor{pattern: p}
 }
 
-// Process replaces ${} values with values from the environment.
+// Process replaces ${} values with values from the environment. Every
+// missing variable is reported in a single error rather than stopping at the
+// first one. Only the built in secret resolvers are available.
 func (y *EnvProcessor) Process(source []byte) ([]byte, error) {
-	osenv := y.osenv
-	if osenv == nil {
-		osenv = os.Getenv
-	}
-	return y.pattern.ReplaceAllFunc(source, func(match []byte) []byte {
-		name := match[2 : len(match)-1] // strip ${}
-		return []byte(osenv(string(name)))
-	}), nil
+	return y.ProcessContext(context.Background(), source)
+}
+
+// ProcessContext is the same as Process but resolves secret references using
+// the resolvers installed in the context with SecretResolversToContext.
+// Errors never contain the value of a resolved secret.
+func (y *EnvProcessor) ProcessContext(ctx context.Context, source []byte) ([]byte, error) {
+	lookupEnv := y.lookupEnv
+	if lookupEnv == nil {
+		lookupEnv = os.LookupEnv
+	}
+	resolvers := SecretResolversFromContext(ctx)
+	if y.secrets == nil {
+		y.secrets = &secretRedactor{}
+	}
+	var missing []string
+	var required []string
+	var failed []string
+	var secrets []string
+	seen := make(map[string]bool)
+	result := y.pattern.ReplaceAllFunc(source, func(match []byte) []byte {
+		if match[1] == '$' {
+			return match[1:] // $${} escapes a literal ${}
+		}
+		name, op, arg := parseEnvReference(string(match[2 : len(match)-1])) // strip ${}
+		value, ok, isSecret := "", false, false
+		if resolver, reference, found := secretReference(resolvers, name); found {
+			secret, err := resolver.Resolve(ctx, reference)
+			if err != nil {
+				// The reference is not included because some resolvers,
+				// such as base64, carry the secret in the reference.
+				failed = append(failed, fmt.Sprintf("%s: %s", resolver.Name(), err.Error()))
+				return nil
+			}
+			y.secrets.Add(secret)
+			value, ok, isSecret = secret, true, true
+			name = resolver.Name() + " secret"
+		} else {
+			value, ok = lookupEnv(name)
+		}
+		switch {
+		case op == ":-" && value == "":
+			return []byte(arg)
+		case op == ":?" && value == "":
+			if !seen[name] {
+				seen[name] = true
+				if arg == "" {
+					arg = "not set"
+				}
+				required = append(required, fmt.Sprintf("%s: %s", name, arg))
+			}
+		case !ok && y.Strict:
+			if !seen[name] {
+				seen[name] = true
+				missing = append(missing, name)
+			}
+		}
+		if isSecret && value != "" {
+			secrets = append(secrets, value)
+			return []byte(fmt.Sprintf(secretPlaceholder, len(secrets)-1))
+		}
+		return []byte(value)
+	})
+	var problems []string
+	if len(failed) > 0 {
+		problems = append(problems, "failed to resolve secrets: "+strings.Join(failed, "; "))
+	}
+	if len(required) > 0 {
+		problems = append(problems, "required environment variables are missing: "+strings.Join(required, "; "))
+	}
+	if len(missing) > 0 {
+		problems = append(problems, "undefined environment variables: "+strings.Join(missing, ", "))
+	}
+	if len(problems) > 0 {
+		return nil, y.secrets.Redact(fmt.Errorf("%s", strings.Join(problems, "; ")))
+	}
+	if len(secrets) > 0 {
+		return insertSecrets(result, secrets)
+	}
+	return result, nil
+}
+
+// insertSecrets parses a document that contains secret placeholders and
+// replaces them within the parsed string values. Secrets are never part of
+// the text that is parsed so their content, such as the line breaks of a PEM
+// key or quotes, cannot change the structure of the document. The result is
+// the document as JSON.
+func insertSecrets(source []byte, secrets []string) ([]byte, error) {
+	rawJSON, err := yaml.YAMLToJSON(source)
+	if err != nil {
+		return nil, err
+	}
+	var doc interface{}
+	decoder := json.NewDecoder(bytes.NewReader(rawJSON))
+	decoder.UseNumber()
+	if err = decoder.Decode(&doc); err != nil {
+		return nil, err
+	}
+	pairs := make([]string, 0, 2*len(secrets))
+	for offset, secret := range secrets {
+		pairs = append(pairs, fmt.Sprintf(secretPlaceholder, offset), secret)
+	}
+	return json.Marshal(replaceStrings(doc, strings.NewReplacer(pairs...)))
+}
+
+// replaceStrings applies the replacer to every key and string value in the
+// parsed document.
+func replaceStrings(doc interface{}, replacer *strings.Replacer) interface{} {
+	switch value := doc.(type) {
+	case map[string]interface{}:
+		result := make(map[string]interface{}, len(value))
+		for key, child := range value {
+			result[replacer.Replace(key)] = replaceStrings(child, replacer)
+		}
+		return result
+	case []interface{}:
+		for offset, child := range value {
+			value[offset] = replaceStrings(child, replacer)
+		}
+		return value
+	case string:
+		return replacer.Replace(value)
+	}
+	return doc
+}
+
+// Redact removes the values of secrets resolved by the processor from the
+// error.
+func (y *EnvProcessor) Redact(err error) error {
+	return y.secrets.Redact(err)
+}
+
+// secretReference matches a reference name against the installed resolvers.
+func secretReference(resolvers map[string]SecretResolver, name string) (SecretResolver, string, bool) {
+	offset := strings.Index(name, ":")
+	if offset < 1 {
+		return nil, "", false
+	}
+	resolver, ok := resolvers[strings.ToLower(name[:offset])]
+	if !ok {
+		return nil, "", false
+	}
+	return resolver, name[offset+1:], true
+}
+
+// parseEnvReference splits the contents of a ${} reference into the variable
+// name and, if present, the :- or :? operator and its argument.
+func parseEnvReference(ref string) (string, string, string) {
+	for offset := 0; offset < len(ref)-1; offset = offset + 1 {
+		if ref[offset] == ':' && (ref[offset+1] == '-' || ref[offset+1] == '?') {
+			return ref[:offset], ref[offset : offset+2], ref[offset+2:]
+		}
+	}
+	return ref, "", ""
 }
@@ -1,6 +1,7 @@
 package transportd
 
 import (
+	"context"
 	"reflect"
 	"testing"
 )
@@ -11,6 +12,7 @@ func TestEnvProcessor_Process(t *testing.T) {
 		source  string
 		want    string
 		env     map[string]string
+		strict  bool
 		wantErr bool
 	}{
 		{
@@ -55,12 +57,82 @@ func TestEnvProcessor_Process(t *testing.T) {
 				"☃☃☃3":  "VALUE3",
 			},
 		},
+		{
+			name:   "default unset",
+			source: `key: "${TEST:-fallback value}"`,
+			want:   `key: "fallback value"`,
+			env:    make(map[string]string),
+		},
+		{
+			name:   "default empty",
+			source: `key: "${TEST:-fallback}"`,
+			want:   `key: "fallback"`,
+			env:    map[string]string{"TEST": ""},
+		},
+		{
+			name:   "default set",
+			source: `key: "${TEST:-fallback}"`,
+			want:   `key: "VALUE"`,
+			env:    map[string]string{"TEST": "VALUE"},
+		},
+		{
+			name:   "default with separators",
+			source: `key: "${TEST:-http://localhost:8080}"`,
+			want:   `key: "http://localhost:8080"`,
+			env:    make(map[string]string),
+		},
+		{
+			name:   "required set",
+			source: `key: "${TEST:?must be set}"`,
+			want:   `key: "VALUE"`,
+			env:    map[string]string{"TEST": "VALUE"},
+		},
+		{
+			name:    "required unset",
+			source:  `key: "${TEST:?must be set}"`,
+			env:     make(map[string]string),
+			wantErr: true,
+		},
+		{
+			name:    "required empty",
+			source:  `key: "${TEST:?}"`,
+			env:     map[string]string{"TEST": ""},
+			wantErr: true,
+		},
+		{
+			name:   "escaped",
+			source: `key: "$${TEST}"`,
+			want:   `key: "${TEST}"`,
+			env:    map[string]string{"TEST": "VALUE"},
+		},
+		{
+			name:   "escaped next to reference",
+			source: `key: "$${TEST}${TEST}"`,
+			want:   `key: "${TEST}VALUE"`,
+			env:    map[string]string{"TEST": "VALUE"},
+		},
+		{
+			name:   "strict set",
+			source: `key: "${TEST}${EMPTY}${MISSING:-fallback}"`,
+			want:   `key: "VALUEfallback"`,
+			env:    map[string]string{"TEST": "VALUE", "EMPTY": ""},
+			strict: true,
+		},
+		{
+			name:    "strict unset",
+			source:  `key: "${TEST}"`,
+			env:     make(map[string]string),
+			strict:  true,
+			wantErr: true,
+		},
 	}
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
 			y := NewEnvProcessor()
-			y.osenv = func(k string) string {
-				return tt.env[k]
+			y.Strict = tt.strict
+			y.lookupEnv = func(k string) (string, bool) {
+				v, ok := tt.env[k]
+				return v, ok
 			}
 			got, err := y.Process([]byte(tt.source))
 			if (err != nil) != tt.wantErr {
@@ -73,3 +145,40 @@ func TestEnvProcessor_Process(t *testing.T) {
 		})
 	}
 }
+
+func TestEnvProcessor_ProcessReportsAllMissing(t *testing.T) {
+	y := NewEnvProcessor()
+	y.Strict = true
+	y.lookupEnv = func(string) (string, bool) { return "", false }
+	_, err := y.Process([]byte(`a: ${ONE}
+b: ${TWO}
+c: ${ONE}
+d: ${THREE:?needed for auth}`))
+	if err == nil {
+		t.Fatal("EnvProcessor.Process() expected an error")
+	}
+	want := "required environment variables are missing: THREE: needed for auth; undefined environment variables: ONE, TWO"
+	if err.Error() != want {
+		t.Errorf("EnvProcessor.Process() error = %v, want %v", err, want)
+	}
+}
+
+func TestNewSpecificationStrictEnv(t *testing.T) {
+	source := []byte(`openapi: 3.0.0
+info:
+  title: ${TRANSPORTD_TEST_UNDEFINED_TITLE}
+  version: 1.0.0
+paths: {}
+`)
+	if _, _, err := newSpecification(context.Background(), source); err != nil {
+		t.Errorf("newSpecification() error = %v outside of strict mode", err)
+	}
+	t.Setenv(EnvStrictKey, "true")
+	if _, _, err := newSpecification(context.Background(), source); err == nil {
+		t.Error("newSpecification() expected an error in strict mode")
+	}
+	t.Setenv(EnvStrictKey, "sometimes")
+	if _, _, err := newSpecification(context.Background(), source); err == nil {
+		t.Error("newSpecification() expected an error for an invalid strict value")
+	}
+}
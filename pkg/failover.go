@@ -0,0 +1,192 @@
+package transportd
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptrace"
+	"sync/atomic"
+	"time"
+
+	"github.com/asecurityteam/runhttp"
+)
+
+const (
+	failoverSetting = "failover"
+	// failoverMetric is emitted each time a request moves to the next backend.
+	failoverMetric = "transportd.route.failover"
+)
+
+// FailoverConfig lists backends that are tried, in order, when the backend of
+// a route cannot serve a request. A request moves to the next backend when the
+// attempt fails with a connection error, exceeds the attempt timeout, or
+// returns one of the listed status codes. Requests with a method that is not
+// idempotent only move after an error if the request was never written to the
+// backend, unless NonIdempotent is set.
+type FailoverConfig struct {
+	Backends      []string      `description:"Backends tried in order when the route backend fails."`
+	Codes         []int         `description:"Response status codes that move the request to the next backend."`
+	Timeout       time.Duration `description:"Maximum duration of each attempt. Zero leaves attempts unbounded."`
+	MaxBodySize   int           `description:"Largest request body, in bytes, that is buffered for another attempt. Larger requests are not failed over."`
+	NonIdempotent bool          `description:"Fail over requests that are not idempotent even when the failed attempt may have reached the backend."`
+}
+
+// Name of the config root.
+func (*FailoverConfig) Name() string {
+	return failoverSetting
+}
+
+// newFailoverConfig generates a config populated with defaults. Backends with
+// no healthy hosts, an open circuit breaker, or a full bulkhead respond with a
+// 503 rather than an error so a 503 moves the request by default.
+func newFailoverConfig() *FailoverConfig {
+	return &FailoverConfig{
+		Backends:    []string{},
+		Codes:       []int{http.StatusServiceUnavailable},
+		MaxBodySize: 1024 * 1024,
+	}
+}
+
+// enabled reports whether the route has any backends to fail over to.
+func (c *FailoverConfig) enabled() bool {
+	return len(c.Backends) > 0
+}
+
+func validateFailover(conf *FailoverConfig) error {
+	if !conf.enabled() {
+		return nil
+	}
+	if conf.Timeout < 0 {
+		return fmt.Errorf("timeout must not be negative")
+	}
+	if conf.MaxBodySize < 0 {
+		return fmt.Errorf("max body size must not be negative")
+	}
+	for _, code := range conf.Codes {
+		if code < 100 || code > 599 {
+			return fmt.Errorf("invalid status code %d", code)
+		}
+	}
+	return nil
+}
+
+// failoverTransport sends a request to each of its transports in order until
+// one of them serves it. The first transport is the primary target of the
+// route and the rest are the failover backends.
+type failoverTransport struct {
+	Path       string
+	Conf       *FailoverConfig
+	Names      []string
+	Transports []http.RoundTripper
+	codes      map[int]bool
+}
+
+func newFailoverTransport(path string, conf *FailoverConfig, names []string, transports []http.RoundTripper) *failoverTransport {
+	codes := make(map[int]bool, len(conf.Codes))
+	for _, code := range conf.Codes {
+		codes[code] = true
+	}
+	return &failoverTransport{
+		Path:       path,
+		Conf:       conf,
+		Names:      names,
+		Transports: transports,
+		codes:      codes,
+	}
+}
+
+func (t *failoverTransport) RoundTrip(r *http.Request) (*http.Response, error) {
+	body, ok := t.bufferBody(r)
+	if !ok {
+		return t.Transports[0].RoundTrip(r)
+	}
+	for offset, rt := range t.Transports {
+		last := offset == len(t.Transports)-1
+		resp, written, err := t.attempt(r, body, rt)
+		if last || r.Context().Err() != nil {
+			return resp, err
+		}
+		if err == nil && !t.codes[resp.StatusCode] {
+			return resp, nil
+		}
+		if err != nil && written && !t.Conf.NonIdempotent && !idempotent(r) {
+			// The backend may have acted on the request before the attempt
+			// failed so sending it again could apply it twice.
+			return nil, err
+		}
+		if err == nil {
+			_, _ = io.Copy(io.Discard, resp.Body)
+			_ = resp.Body.Close()
+		}
+		runhttp.StatFromContext(r.Context()).Count(
+			failoverMetric, 1,
+			"client_path:"+t.Path,
+			"from_dependency:"+t.Names[offset],
+			"to_dependency:"+t.Names[offset+1],
+		)
+	}
+	// Unreachable because the last transport always returns.
+	return nil, fmt.Errorf("no backends available")
+}
+
+// attempt sends a copy of the request so that every attempt starts with the
+// original URL and body regardless of what earlier attempts changed. The
+// result reports whether any part of the request was written to a backend.
+func (t *failoverTransport) attempt(r *http.Request, body []byte, rt http.RoundTripper) (*http.Response, bool, error) {
+	ctx := r.Context()
+	cancel := context.CancelFunc(func() {})
+	if t.Conf.Timeout > 0 {
+		ctx, cancel = context.WithTimeout(ctx, t.Conf.Timeout)
+	}
+	var written int32
+	ctx = httptrace.WithClientTrace(ctx, &httptrace.ClientTrace{
+		WroteRequest: func(httptrace.WroteRequestInfo) {
+			atomic.StoreInt32(&written, 1)
+		},
+	})
+	req := r.Clone(ctx)
+	if body != nil {
+		req.Body = io.NopCloser(bytes.NewReader(body))
+	}
+	resp, err := rt.RoundTrip(req)
+	if err != nil {
+		cancel()
+		return nil, atomic.LoadInt32(&written) == 1, err
+	}
+	// The attempt timeout covers reading the body so it is only released once
+	// the caller is done with the response.
+	resp, _ = ReleaseOnClose(resp, nil, cancel)
+	return resp, true, nil
+}
+
+// idempotent reports whether sending the request more than once has the same
+// effect as sending it once. Like the http.Transport, requests that carry an
+// idempotency key are treated as idempotent.
+func idempotent(r *http.Request) bool {
+	switch r.Method {
+	case http.MethodGet, http.MethodHead, http.MethodOptions, http.MethodTrace, http.MethodPut, http.MethodDelete:
+		return true
+	}
+	return r.Header.Get("Idempotency-Key") != "" || r.Header.Get("X-Idempotency-Key") != ""
+}
+
+// bufferBody reads the request body so that it can be sent more than once.
+// Requests with a body that is too large, or cannot be read, are left as they
+// were and are only sent to the primary backend.
+func (t *failoverTransport) bufferBody(r *http.Request) ([]byte, bool) {
+	if r.Body == nil || r.Body == http.NoBody {
+		return nil, true
+	}
+	if r.ContentLength > int64(t.Conf.MaxBodySize) {
+		return nil, false
+	}
+	body, err := io.ReadAll(io.LimitReader(r.Body, int64(t.Conf.MaxBodySize)+1))
+	if err != nil || len(body) > t.Conf.MaxBodySize {
+		r.Body = PrependBody(body, r.Body, err)
+		return nil, false
+	}
+	_ = r.Body.Close()
+	return body, true
+}
@@ -0,0 +1,201 @@
+package transportd
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptrace"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/golang/mock/gomock"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestValidateFailover(t *testing.T) {
+	tests := []struct {
+		name    string
+		conf    *FailoverConfig
+		wantErr bool
+	}{
+		{name: "disabled", conf: newFailoverConfig(), wantErr: false},
+		{name: "valid", conf: &FailoverConfig{Backends: []string{"b"}, Codes: []int{503}, Timeout: time.Second}, wantErr: false},
+		{name: "negative timeout", conf: &FailoverConfig{Backends: []string{"b"}, Timeout: -time.Second}, wantErr: true},
+		{name: "negative body", conf: &FailoverConfig{Backends: []string{"b"}, MaxBodySize: -1}, wantErr: true},
+		{name: "invalid code", conf: &FailoverConfig{Backends: []string{"b"}, Codes: []int{1000}}, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := validateFailover(tt.conf)
+			assert.Equal(t, tt.wantErr, err != nil)
+		})
+	}
+}
+
+func TestFailoverOnError(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	primary := NewMockRoundTripper(ctrl)
+	secondary := NewMockRoundTripper(ctrl)
+	rt := newFailoverTransport("/", newFailoverConfig(), []string{"primary", "secondary"}, []http.RoundTripper{primary, secondary})
+	req, _ := http.NewRequest(http.MethodPost, "http://localhost/", strings.NewReader("body"))
+
+	primary.EXPECT().RoundTrip(gomock.Any()).DoAndReturn(func(r *http.Request) (*http.Response, error) {
+		_, _ = io.ReadAll(r.Body)
+		r.URL.Host = "primary"
+		return nil, errors.New("connection refused")
+	})
+	secondary.EXPECT().RoundTrip(gomock.Any()).DoAndReturn(func(r *http.Request) (*http.Response, error) {
+		b, _ := io.ReadAll(r.Body)
+		assert.Equal(t, "body", string(b))
+		assert.Equal(t, "localhost", r.URL.Host, "attempt saw changes made by an earlier attempt")
+		return &http.Response{StatusCode: http.StatusOK, Body: http.NoBody}, nil
+	})
+	resp, err := rt.RoundTrip(req)
+	assert.Nil(t, err)
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+}
+
+func TestFailoverOnStatus(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	primary := NewMockRoundTripper(ctrl)
+	secondary := NewMockRoundTripper(ctrl)
+	rt := newFailoverTransport("/", newFailoverConfig(), []string{"primary", "secondary"}, []http.RoundTripper{primary, secondary})
+	req, _ := http.NewRequest(http.MethodGet, "http://localhost/", http.NoBody)
+
+	primary.EXPECT().RoundTrip(gomock.Any()).Return(&http.Response{StatusCode: http.StatusServiceUnavailable, Body: http.NoBody}, nil)
+	secondary.EXPECT().RoundTrip(gomock.Any()).Return(&http.Response{StatusCode: http.StatusServiceUnavailable, Body: http.NoBody}, nil)
+	resp, err := rt.RoundTrip(req)
+	assert.Nil(t, err)
+	assert.Equal(t, http.StatusServiceUnavailable, resp.StatusCode, "last backend response was not returned")
+
+	primary.EXPECT().RoundTrip(gomock.Any()).Return(&http.Response{StatusCode: http.StatusInternalServerError, Body: http.NoBody}, nil)
+	resp, err = rt.RoundTrip(req)
+	assert.Nil(t, err)
+	assert.Equal(t, http.StatusInternalServerError, resp.StatusCode)
+}
+
+func TestFailoverNonIdempotent(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	primary := NewMockRoundTripper(ctrl)
+	secondary := NewMockRoundTripper(ctrl)
+	conf := newFailoverConfig()
+	rt := newFailoverTransport("/", conf, []string{"primary", "secondary"}, []http.RoundTripper{primary, secondary})
+	written := func(r *http.Request) (*http.Response, error) {
+		httptrace.ContextClientTrace(r.Context()).WroteRequest(httptrace.WroteRequestInfo{})
+		return nil, errors.New("connection reset")
+	}
+
+	req, _ := http.NewRequest(http.MethodPost, "http://localhost/", strings.NewReader("body"))
+	primary.EXPECT().RoundTrip(gomock.Any()).DoAndReturn(written)
+	_, err := rt.RoundTrip(req)
+	assert.NotNil(t, err, "request that may have been processed was sent again")
+
+	req, _ = http.NewRequest(http.MethodPut, "http://localhost/", strings.NewReader("body"))
+	primary.EXPECT().RoundTrip(gomock.Any()).DoAndReturn(written)
+	secondary.EXPECT().RoundTrip(gomock.Any()).Return(&http.Response{StatusCode: http.StatusOK, Body: http.NoBody}, nil)
+	_, err = rt.RoundTrip(req)
+	assert.Nil(t, err)
+
+	conf.NonIdempotent = true
+	req, _ = http.NewRequest(http.MethodPost, "http://localhost/", strings.NewReader("body"))
+	primary.EXPECT().RoundTrip(gomock.Any()).DoAndReturn(written)
+	secondary.EXPECT().RoundTrip(gomock.Any()).Return(&http.Response{StatusCode: http.StatusOK, Body: http.NoBody}, nil)
+	_, err = rt.RoundTrip(req)
+	assert.Nil(t, err)
+}
+
+func TestFailoverOnTimeout(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	primary := NewMockRoundTripper(ctrl)
+	secondary := NewMockRoundTripper(ctrl)
+	conf := newFailoverConfig()
+	conf.Timeout = time.Millisecond
+	rt := newFailoverTransport("/", conf, []string{"primary", "secondary"}, []http.RoundTripper{primary, secondary})
+	req, _ := http.NewRequest(http.MethodGet, "http://localhost/", http.NoBody)
+
+	primary.EXPECT().RoundTrip(gomock.Any()).DoAndReturn(func(r *http.Request) (*http.Response, error) {
+		<-r.Context().Done()
+		return nil, r.Context().Err()
+	})
+	secondary.EXPECT().RoundTrip(gomock.Any()).Return(&http.Response{StatusCode: http.StatusOK, Body: http.NoBody}, nil)
+	resp, err := rt.RoundTrip(req)
+	assert.Nil(t, err)
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+}
+
+func TestFailoverCallerCanceled(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	primary := NewMockRoundTripper(ctrl)
+	secondary := NewMockRoundTripper(ctrl)
+	rt := newFailoverTransport("/", newFailoverConfig(), []string{"primary", "secondary"}, []http.RoundTripper{primary, secondary})
+	ctx, cancel := context.WithCancel(context.Background())
+	req, _ := http.NewRequestWithContext(ctx, http.MethodGet, "http://localhost/", http.NoBody)
+
+	primary.EXPECT().RoundTrip(gomock.Any()).DoAndReturn(func(*http.Request) (*http.Response, error) {
+		cancel()
+		return nil, context.Canceled
+	})
+	_, err := rt.RoundTrip(req)
+	assert.ErrorIs(t, err, context.Canceled)
+}
+
+func TestFailoverLargeBody(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	primary := NewMockRoundTripper(ctrl)
+	secondary := NewMockRoundTripper(ctrl)
+	conf := newFailoverConfig()
+	conf.MaxBodySize = 2
+	rt := newFailoverTransport("/", conf, []string{"primary", "secondary"}, []http.RoundTripper{primary, secondary})
+	req, _ := http.NewRequest(http.MethodPost, "http://localhost/", io.NopCloser(strings.NewReader("large")))
+
+	primary.EXPECT().RoundTrip(req).DoAndReturn(func(r *http.Request) (*http.Response, error) {
+		b, _ := io.ReadAll(r.Body)
+		assert.Equal(t, "large", string(b))
+		return nil, errors.New("connection refused")
+	})
+	_, err := rt.RoundTrip(req)
+	assert.NotNil(t, err)
+}
+
+type nopReadWriteCloser struct {
+	io.Reader
+	io.Writer
+}
+
+func (nopReadWriteCloser) Close() error {
+	return nil
+}
+
+func TestFailoverSwitchingProtocols(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	primary := NewMockRoundTripper(ctrl)
+	secondary := NewMockRoundTripper(ctrl)
+	conf := newFailoverConfig()
+	conf.Timeout = time.Second
+	rt := newFailoverTransport("/", conf, []string{"primary", "secondary"}, []http.RoundTripper{primary, secondary})
+	req, _ := http.NewRequest(http.MethodGet, "http://localhost/", http.NoBody)
+
+	conn := nopReadWriteCloser{Reader: strings.NewReader(""), Writer: io.Discard}
+	primary.EXPECT().RoundTrip(gomock.Any()).Return(&http.Response{StatusCode: http.StatusSwitchingProtocols, Body: conn}, nil)
+	resp, err := rt.RoundTrip(req)
+	assert.Nil(t, err)
+	_, ok := resp.Body.(io.ReadWriteCloser)
+	assert.True(t, ok, "upgraded connection is no longer writable")
+	_ = resp.Body.Close()
+}
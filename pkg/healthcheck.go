@@ -0,0 +1,175 @@
+package transportd
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"sync/atomic"
+	"time"
+
+	"github.com/asecurityteam/runhttp"
+)
+
+const (
+	healthCheckSetting = "healthcheck"
+	// healthStateMetric is emitted each time a host changes state.
+	healthStateMetric = "transportd.backend.health.change"
+	// healthyHostsMetric is the number of hosts in rotation for a backend.
+	healthyHostsMetric = "transportd.backend.health.healthy_hosts"
+)
+
+// HealthCheckConfig configures active health checking of the hosts
+// for a backend.
+type HealthCheckConfig struct {
+	Path               string        `description:"URL path probed on each host. Health checking is disabled when empty."`
+	Interval           time.Duration `description:"Time between probes of each host."`
+	Timeout            time.Duration `description:"Maximum duration of a single probe."`
+	HealthyThreshold   int           `description:"Consecutive successful probes before an unhealthy host is returned to rotation."`
+	UnhealthyThreshold int           `description:"Consecutive failed probes before a host is removed from rotation."`
+	ExpectedStatus     []int         `description:"Status codes that indicate a healthy host."`
+}
+
+// Name of the config root.
+func (*HealthCheckConfig) Name() string {
+	return healthCheckSetting
+}
+
+func newHealthCheckConfig() *HealthCheckConfig {
+	return &HealthCheckConfig{
+		Interval:           10 * time.Second,
+		Timeout:            time.Second,
+		HealthyThreshold:   2,
+		UnhealthyThreshold: 3,
+		ExpectedStatus:     []int{http.StatusOK},
+	}
+}
+
+func validateHealthCheck(conf *HealthCheckConfig) error {
+	if conf.Path == "" {
+		return nil
+	}
+	if conf.Interval <= 0 {
+		return fmt.Errorf("interval must be greater than zero")
+	}
+	if conf.Timeout <= 0 {
+		return fmt.Errorf("timeout must be greater than zero")
+	}
+	if conf.HealthyThreshold < 1 || conf.UnhealthyThreshold < 1 {
+		return fmt.Errorf("thresholds must be greater than zero")
+	}
+	if len(conf.ExpectedStatus) < 1 {
+		return fmt.Errorf("expected status list is empty")
+	}
+	return nil
+}
+
+type healthEvent struct {
+	Message string `logevent:"message,default=backend-host-health-changed"`
+	Backend string `logevent:"backend"`
+	Host    string `logevent:"host"`
+	Healthy bool   `logevent:"healthy"`
+	Reason  string `logevent:"reason"`
+}
+
+// healthChecker periodically probes every host of a backend and removes
+// hosts that fail their probes from rotation.
+type healthChecker struct {
+	Backend   string
+	Pool      *hostPool
+	Conf      *HealthCheckConfig
+	Transport http.RoundTripper
+	Logger    runhttp.Logger
+	Stats     runhttp.Stat
+
+	// counts tracks consecutive probe results for each host. Positive values
+	// are consecutive successes and negative values are consecutive failures.
+	counts map[*upstream]int
+}
+
+// Run probes the hosts on the configured interval until the context is
+// canceled.
+func (c *healthChecker) Run(ctx context.Context) {
+	c.counts = make(map[*upstream]int, len(c.Pool.hosts))
+	ticker := time.NewTicker(c.Conf.Interval)
+	defer ticker.Stop()
+	for {
+		c.checkAll(ctx)
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+func (c *healthChecker) checkAll(ctx context.Context) {
+	for _, host := range c.Pool.hosts {
+		err := c.probe(ctx, host)
+		if ctx.Err() != nil {
+			// Probes that fail because the checker is stopping say nothing
+			// about the state of the host.
+			return
+		}
+		c.record(host, err)
+	}
+	healthy := 0
+	for _, host := range c.Pool.hosts {
+		if atomic.LoadInt32(&host.unhealthy) == 0 {
+			healthy = healthy + 1
+		}
+	}
+	c.Stats.Gauge(healthyHostsMetric, float64(healthy), "backend:"+c.Backend)
+}
+
+func (c *healthChecker) probe(ctx context.Context, host *upstream) error {
+	ctx, cancel := context.WithTimeout(ctx, c.Conf.Timeout)
+	defer cancel()
+	u := *host.url
+	u.Path = upstreamPath(host.url, c.Conf.Path)
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, u.String(), http.NoBody)
+	if err != nil {
+		return err
+	}
+	req.Host = hostHeader(host.url)
+	resp, err := c.Transport.RoundTrip(req)
+	if err != nil {
+		return err
+	}
+	_, _ = io.Copy(io.Discard, resp.Body)
+	_ = resp.Body.Close()
+	for _, code := range c.Conf.ExpectedStatus {
+		if resp.StatusCode == code {
+			return nil
+		}
+	}
+	return fmt.Errorf("unexpected status code %d", resp.StatusCode)
+}
+
+func (c *healthChecker) record(host *upstream, err error) {
+	count := c.counts[host]
+	if err == nil {
+		if count < 0 {
+			count = 0
+		}
+		count = count + 1
+	} else {
+		if count > 0 {
+			count = 0
+		}
+		count = count - 1
+	}
+	c.counts[host] = count
+
+	unhealthy := atomic.LoadInt32(&host.unhealthy) == 1
+	switch {
+	case unhealthy && count >= c.Conf.HealthyThreshold:
+		atomic.StoreInt32(&host.unhealthy, 0)
+		c.Logger.Info(healthEvent{Backend: c.Backend, Host: host.url.Host, Healthy: true})
+		c.Stats.Count(healthStateMetric, 1, "backend:"+c.Backend, "host:"+host.url.Host, "state:healthy")
+	case !unhealthy && -count >= c.Conf.UnhealthyThreshold:
+		atomic.StoreInt32(&host.unhealthy, 1)
+		c.Logger.Warn(healthEvent{Backend: c.Backend, Host: host.url.Host, Healthy: false, Reason: err.Error()})
+		c.Stats.Count(healthStateMetric, 1, "backend:"+c.Backend, "host:"+host.url.Host, "state:unhealthy")
+	}
+}
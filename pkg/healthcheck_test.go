@@ -0,0 +1,112 @@
+package transportd
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/asecurityteam/runhttp"
+	"github.com/golang/mock/gomock"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestHealthCheckerTransitions(t *testing.T) {
+	var status int32 = http.StatusInternalServerError
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, "/health", r.URL.Path)
+		w.WriteHeader(int(atomic.LoadInt32(&status)))
+	}))
+	defer srv.Close()
+
+	ctx := context.Background()
+	u, _ := url.Parse(srv.URL)
+	pool := newHostPool([]*url.URL{u}, nil, &roundRobinBalancer{})
+	conf := newHealthCheckConfig()
+	conf.Path = "/health"
+	conf.HealthyThreshold = 2
+	conf.UnhealthyThreshold = 2
+	checker := &healthChecker{
+		Backend:   testBackend,
+		Pool:      pool,
+		Conf:      conf,
+		Transport: http.DefaultTransport,
+		Logger:    backgroundLogger(ctx),
+		Stats:     runhttp.StatFromContext(ctx),
+		counts:    make(map[*upstream]int),
+	}
+
+	checker.checkAll(ctx)
+	assert.NotNil(t, pool.Next(), "host removed before reaching the threshold")
+	checker.checkAll(ctx)
+	assert.Nil(t, pool.Next(), "host not removed after reaching the threshold")
+
+	atomic.StoreInt32(&status, http.StatusOK)
+	checker.checkAll(ctx)
+	assert.Nil(t, pool.Next(), "host returned before reaching the threshold")
+	checker.checkAll(ctx)
+	assert.NotNil(t, pool.Next(), "host not returned after reaching the threshold")
+}
+
+func TestHealthCheckerStops(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer srv.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	u, _ := url.Parse(srv.URL)
+	conf := newHealthCheckConfig()
+	conf.Path = "/"
+	conf.Interval = time.Millisecond
+	checker := &healthChecker{
+		Backend:   testBackend,
+		Pool:      newHostPool([]*url.URL{u}, nil, &roundRobinBalancer{}),
+		Conf:      conf,
+		Transport: http.DefaultTransport,
+		Logger:    backgroundLogger(ctx),
+		Stats:     runhttp.StatFromContext(ctx),
+	}
+	done := make(chan struct{})
+	go func() {
+		checker.Run(ctx)
+		close(done)
+	}()
+	cancel()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("health checker did not stop")
+	}
+}
+
+func TestValidateHealthCheck(t *testing.T) {
+	conf := newHealthCheckConfig()
+	assert.Nil(t, validateHealthCheck(conf), "disabled checks are always valid")
+	conf.Path = "/health"
+	assert.Nil(t, validateHealthCheck(conf))
+	conf.ExpectedStatus = nil
+	assert.NotNil(t, validateHealthCheck(conf))
+	conf = newHealthCheckConfig()
+	conf.Path = "/health"
+	conf.Interval = 0
+	assert.NotNil(t, validateHealthCheck(conf))
+}
+
+func TestHostRewriteNoHealthyHosts(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	backend := NewMockBackend(ctrl)
+	rt := &hostRewrite{
+		Backend: backend,
+		Wrapped: NewMockRoundTripper(ctrl),
+	}
+	req, _ := http.NewRequest(http.MethodGet, "http://localhost/", http.NoBody)
+
+	backend.EXPECT().Host().Return(nil)
+	resp, err := rt.RoundTrip(req)
+	assert.Nil(t, err)
+	assert.Equal(t, http.StatusServiceUnavailable, resp.StatusCode)
+}
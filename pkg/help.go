@@ -25,18 +25,35 @@ func Help(ctx context.Context, components ...NewComponent) (string, error) {
 
 	rt := runhttp.NewComponent().Settings()
 	rtG, _ := settings.Convert(&rtC{rt})
+	for _, g := range rtG.Groups() {
+		if server, ok := g.(*settings.SettingGroup); ok && server.Name() == httpServerSetting {
+			server.SettingValues = append(server.SettingValues, newH2CSetting())
+		}
+	}
 	_, _ = result.WriteString("The following top level extension must appear and configures the runtime:\n")
 	_, _ = result.WriteString(settings.ExampleYamlGroups([]settings.Group{rtG}))
 	_, _ = result.WriteString("\n")
 
 	backendsInstalled := settings.NewStringSliceSetting(backendsSetting, "Available backends.", []string{"backendName"})
 	host := settings.NewStringSetting(hostSetting, "Backend host URL.", "https://localhost")
+	hosts := settings.NewStringSliceSetting(hostsSetting, "Backend host URLs. Use instead of host to balance across replicas.", []string{})
+	weights := settings.NewIntSliceSetting(weightsSetting, "Relative weight of each entry in hosts. Defaults to equal weights.", []int{})
+	balancerName := settings.NewStringSetting(
+		balancerSetting,
+		"Host selection strategy. One of roundrobin, weightedrandom, leastoutstanding, poweroftwo.",
+		BalancerRoundRobin,
+	)
 	poolCount := settings.NewIntSetting(countSetting, "Number of connections pools. Only use >1 if HTTP/2", 1)
 	poolTTL := settings.NewDurationSetting(ttlSetting, "Lifetime of a pool before refreshing.", time.Hour)
 	pool := &settings.SettingGroup{
 		NameValue:     poolSetting,
 		SettingValues: []settings.Setting{poolCount, poolTTL},
 	}
+	healthCheckG, _ := settings.Convert(newHealthCheckConfig())
+	outlierG, _ := settings.Convert(newOutlierConfig())
+	bulkheadG, _ := settings.Convert(newBulkheadConfig())
+	tlsG, _ := settings.Convert(newTLSConfig())
+	connectionG, _ := settings.Convert(newConnectionConfig())
 	backendsG := &settings.SettingGroup{
 		NameValue:     ExtensionKey,
 		SettingValues: []settings.Setting{backendsInstalled},
@@ -44,8 +61,8 @@ func Help(ctx context.Context, components ...NewComponent) (string, error) {
 			&settings.SettingGroup{
 				NameValue:        "backendName",
 				DescriptionValue: "Configuration for a single backend.",
-				SettingValues:    []settings.Setting{host},
-				GroupValues:      []settings.Group{pool},
+				SettingValues:    []settings.Setting{host, hosts, weights, balancerName},
+				GroupValues:      []settings.Group{pool, connectionG, healthCheckG, outlierG, bulkheadG, tlsG},
 			},
 		},
 	}
@@ -69,10 +86,28 @@ func Help(ctx context.Context, components ...NewComponent) (string, error) {
 		names = append(names, g.Name())
 	}
 	componentsEnabled := settings.NewStringSliceSetting(enabledSetting, "Ordered list of components enabled for this route.", names)
+	splitG, _ := settings.Convert(newSplitConfig())
+	rulesEnabled := settings.NewStringSliceSetting(rulesSetting, "Ordered list of match rules for this route.", []string{"ruleName"})
+	matchG := &settings.SettingGroup{
+		NameValue:     matchSetting,
+		SettingValues: []settings.Setting{rulesEnabled},
+		GroupValues:   []settings.Group{matchRuleGroup("ruleName", &MatchRuleConfig{})},
+	}
+	failoverG, _ := settings.Convert(newFailoverConfig())
+	upgradeAllowed := settings.NewBoolSetting(
+		upgradeSetting,
+		"Tunnel upgrade requests, such as WebSockets, after running only the request phase components.",
+		false,
+	)
+	streamingEnabled := settings.NewBoolSetting(
+		streamingSetting,
+		"Pass response bodies to the client as they arrive. Defaults to true for operations with a text/event-stream response.",
+		false,
+	)
 	enabledG := &settings.SettingGroup{
 		NameValue:     ExtensionKey,
-		SettingValues: []settings.Setting{componentsEnabled, backendSelected},
-		GroupValues:   componentConfigs,
+		SettingValues: []settings.Setting{componentsEnabled, backendSelected, upgradeAllowed, streamingEnabled},
+		GroupValues:   append([]settings.Group{splitG, matchG, failoverG}, componentConfigs...),
 	}
 	_, _ = result.WriteString("The following per-route extension must appear and configures request behavior:\n")
 	_, _ = result.WriteString(settings.ExampleYamlGroups([]settings.Group{enabledG}))
@@ -0,0 +1,144 @@
+package transportd
+
+import (
+	"fmt"
+	"net/http"
+	"regexp"
+	"strings"
+
+	"github.com/asecurityteam/settings"
+)
+
+const (
+	matchSetting = "match"
+	rulesSetting = "rules"
+)
+
+// MatchRuleConfig sends requests with a matching header, query parameter, or
+// cookie to a different backend than the rest of the route. Exactly one of
+// header, query, or cookie names the value to inspect and at most one of
+// exact, prefix, or regex describes the match. A rule without a match
+// description applies to any request that carries the value.
+type MatchRuleConfig struct {
+	Header  string `description:"Request header inspected by the rule."`
+	Query   string `description:"Query parameter inspected by the rule."`
+	Cookie  string `description:"Cookie inspected by the rule."`
+	Exact   string `description:"Value must equal this string."`
+	Prefix  string `description:"Value must start with this string."`
+	Regex   string `description:"Value must match this regular expression."`
+	Backend string `description:"Backend that serves matching requests."`
+}
+
+// Name of the config root.
+func (*MatchRuleConfig) Name() string {
+	return "rule"
+}
+
+// matchRuleGroup binds the settings of a rule to the name given in the rule
+// list of the route.
+func matchRuleGroup(name string, conf *MatchRuleConfig) settings.Group {
+	g, _ := settings.Convert(conf)
+	return &settings.SettingGroup{
+		NameValue:        name,
+		DescriptionValue: g.Description(),
+		SettingValues:    g.Settings(),
+	}
+}
+
+// matchRule is a parsed and validated MatchRuleConfig.
+type matchRule struct {
+	Name      string
+	Conf      *MatchRuleConfig
+	Regex     *regexp.Regexp
+	Transport http.RoundTripper
+}
+
+func newMatchRule(name string, conf *MatchRuleConfig) (*matchRule, error) {
+	sources := 0
+	for _, v := range []string{conf.Header, conf.Query, conf.Cookie} {
+		if v != "" {
+			sources = sources + 1
+		}
+	}
+	if sources != 1 {
+		return nil, fmt.Errorf("rule %s must set exactly one of header, query, or cookie", name)
+	}
+	matchers := 0
+	for _, v := range []string{conf.Exact, conf.Prefix, conf.Regex} {
+		if v != "" {
+			matchers = matchers + 1
+		}
+	}
+	if matchers > 1 {
+		return nil, fmt.Errorf("rule %s may only set one of exact, prefix, or regex", name)
+	}
+	if conf.Backend == "" {
+		return nil, fmt.Errorf("rule %s is missing a backend", name)
+	}
+	rule := &matchRule{Name: name, Conf: conf}
+	if conf.Regex != "" {
+		re, err := regexp.Compile(conf.Regex)
+		if err != nil {
+			return nil, fmt.Errorf("rule %s has an invalid regex: %s", name, err.Error())
+		}
+		rule.Regex = re
+	}
+	return rule, nil
+}
+
+// value extracts the inspected value from the request.
+func (m *matchRule) value(r *http.Request) (string, bool) {
+	switch {
+	case m.Conf.Header != "":
+		values := r.Header.Values(m.Conf.Header)
+		if len(values) < 1 {
+			return "", false
+		}
+		return values[0], true
+	case m.Conf.Query != "":
+		values, ok := r.URL.Query()[m.Conf.Query]
+		if !ok || len(values) < 1 {
+			return "", false
+		}
+		return values[0], true
+	default:
+		c, err := r.Cookie(m.Conf.Cookie)
+		if err != nil {
+			return "", false
+		}
+		return c.Value, true
+	}
+}
+
+func (m *matchRule) Matches(r *http.Request) bool {
+	v, ok := m.value(r)
+	if !ok {
+		return false
+	}
+	switch {
+	case m.Conf.Exact != "":
+		return v == m.Conf.Exact
+	case m.Conf.Prefix != "":
+		return strings.HasPrefix(v, m.Conf.Prefix)
+	case m.Regex != nil:
+		return m.Regex.MatchString(v)
+	default:
+		return true
+	}
+}
+
+// matchTransport sends each request to the transport of the first matching
+// rule, or to the fallback when no rule matches.
+type matchTransport struct {
+	Rules    []*matchRule
+	Fallback http.RoundTripper
+}
+
+func (t *matchTransport) RoundTrip(r *http.Request) (*http.Response, error) {
+	for _, rule := range t.Rules {
+		if rule.Matches(r) {
+			return rule.Transport.RoundTrip(r)
+		}
+	}
+	return t.Fallback.RoundTrip(r)
+}
@@ -0,0 +1,84 @@
+package transportd
+
+import (
+	"net/http"
+	"testing"
+
+	"github.com/golang/mock/gomock"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestNewMatchRule(t *testing.T) {
+	tests := []struct {
+		name    string
+		conf    *MatchRuleConfig
+		wantErr bool
+	}{
+		{name: "header", conf: &MatchRuleConfig{Header: "X-Api-Version", Exact: "2", Backend: "b"}, wantErr: false},
+		{name: "present", conf: &MatchRuleConfig{Cookie: "beta", Backend: "b"}, wantErr: false},
+		{name: "no source", conf: &MatchRuleConfig{Exact: "2", Backend: "b"}, wantErr: true},
+		{name: "two sources", conf: &MatchRuleConfig{Header: "a", Query: "b", Backend: "b"}, wantErr: true},
+		{name: "two matchers", conf: &MatchRuleConfig{Header: "a", Exact: "a", Prefix: "a", Backend: "b"}, wantErr: true},
+		{name: "bad regex", conf: &MatchRuleConfig{Header: "a", Regex: "(", Backend: "b"}, wantErr: true},
+		{name: "no backend", conf: &MatchRuleConfig{Header: "a"}, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := newMatchRule(tt.name, tt.conf)
+			assert.Equal(t, tt.wantErr, err != nil)
+		})
+	}
+}
+
+func TestMatchRuleMatches(t *testing.T) {
+	req, _ := http.NewRequest(http.MethodGet, "http://localhost/?tenant=acme-eu", http.NoBody)
+	req.Header.Set("X-Api-Version", "2")
+	req.AddCookie(&http.Cookie{Name: "beta", Value: "true"})
+	tests := []struct {
+		name string
+		conf *MatchRuleConfig
+		want bool
+	}{
+		{name: "header exact", conf: &MatchRuleConfig{Header: "x-api-version", Exact: "2"}, want: true},
+		{name: "header mismatch", conf: &MatchRuleConfig{Header: "X-Api-Version", Exact: "1"}, want: false},
+		{name: "query prefix", conf: &MatchRuleConfig{Query: "tenant", Prefix: "acme-"}, want: true},
+		{name: "query regex", conf: &MatchRuleConfig{Query: "tenant", Regex: "-(us|ca)$"}, want: false},
+		{name: "cookie present", conf: &MatchRuleConfig{Cookie: "beta"}, want: true},
+		{name: "missing", conf: &MatchRuleConfig{Header: "X-Tenant"}, want: false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tt.conf.Backend = "b"
+			rule, err := newMatchRule(tt.name, tt.conf)
+			assert.Nil(t, err)
+			assert.Equal(t, tt.want, rule.Matches(req))
+		})
+	}
+}
+
+func TestMatchTransport(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	first := NewMockRoundTripper(ctrl)
+	second := NewMockRoundTripper(ctrl)
+	fallback := NewMockRoundTripper(ctrl)
+	firstRule, _ := newMatchRule("first", &MatchRuleConfig{Header: "X-Api-Version", Exact: "2", Backend: "b"})
+	firstRule.Transport = first
+	secondRule, _ := newMatchRule("second", &MatchRuleConfig{Header: "X-Api-Version", Backend: "b"})
+	secondRule.Transport = second
+	rt := &matchTransport{Rules: []*matchRule{firstRule, secondRule}, Fallback: fallback}
+
+	v2, _ := http.NewRequest(http.MethodGet, "http://localhost/", http.NoBody)
+	v2.Header.Set("X-Api-Version", "2")
+	v1, _ := http.NewRequest(http.MethodGet, "http://localhost/", http.NoBody)
+	v1.Header.Set("X-Api-Version", "1")
+	none, _ := http.NewRequest(http.MethodGet, "http://localhost/", http.NoBody)
+
+	first.EXPECT().RoundTrip(v2).Return(&http.Response{}, nil)
+	second.EXPECT().RoundTrip(v1).Return(&http.Response{}, nil)
+	fallback.EXPECT().RoundTrip(none).Return(&http.Response{}, nil)
+	_, _ = rt.RoundTrip(v2)
+	_, _ = rt.RoundTrip(v1)
+	_, _ = rt.RoundTrip(none)
+}
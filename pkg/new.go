@@ -6,7 +6,10 @@ import (
 	"fmt"
 	"net/http"
 	"net/http/httputil"
+	"os"
+	"strconv"
 	"strings"
+	"time"
 
 	"github.com/asecurityteam/runhttp"
 	"github.com/asecurityteam/settings"
@@ -33,11 +36,17 @@ const (
 	allowUnknown = "allowUnknown"
 )
 
-func newSpecification(source []byte) (*openapi3.T, error) {
-	envProcessor := NewEnvProcessor()
-	source, err := envProcessor.Process(source)
+// newSpecification interpolates and parses the specification. The returned
+// redactor removes any secrets resolved from the specification and must be
+// applied to every error produced while building from it.
+func newSpecification(ctx context.Context, source []byte) (*openapi3.T, *secretRedactor, error) {
+	envProcessor, err := specificationEnvProcessor()
 	if err != nil {
-		return nil, err
+		return nil, nil, err
+	}
+	source, err = envProcessor.ProcessContext(ctx, source)
+	if err != nil {
+		return nil, nil, err
 	}
 
 	loader := openapi3.NewLoader()
@@ -47,9 +56,23 @@ func newSpecification(source []byte) (*openapi3.T, error) {
 		swagger, errJSON = loader.LoadFromData(source)
 	}
 	if errYaml != nil && errJSON != nil {
-		return nil, errJSON
+		return nil, nil, envProcessor.Redact(errJSON)
 	}
-	return swagger, nil
+	return swagger, envProcessor.secrets, nil
+}
+
+// specificationEnvProcessor creates the EnvProcessor used for specifications
+// with strict mode set from the environment.
+func specificationEnvProcessor() (*EnvProcessor, error) {
+	envProcessor := NewEnvProcessor()
+	if rawStrict := os.Getenv(EnvStrictKey); rawStrict != "" {
+		strict, err := strconv.ParseBool(rawStrict)
+		if err != nil {
+			return nil, fmt.Errorf("invalid %s value %s", EnvStrictKey, rawStrict)
+		}
+		envProcessor.Strict = strict
+	}
+	return envProcessor, nil
 }
 
 func newTransport(ctx context.Context, specification *openapi3.T, components ...NewComponent) (http.RoundTripper, error) {
@@ -73,7 +96,9 @@ func newTransport(ctx context.Context, specification *openapi3.T, components ...
 		return nil, fmt.Errorf("failed to configure backends: %s", err.Error())
 	}
 
-	// Load and configure endpoints.
+	// Load and configure endpoints. Components of every route share a single
+	// state that is discarded along with the transport.
+	ctx = SharedStateToContext(ctx, NewSharedState())
 	reg := NewStaticClientRegistry()
 	clientF := &ClientFactory{
 		Bases:      transports,
@@ -115,30 +140,100 @@ func newTransport(ctx context.Context, specification *openapi3.T, components ...
 	}, nil
 }
 
-// NewTransport constructs a smart HTTP client from the given specification
-// and set of plugins. For running a service, use the New method instead.
-func NewTransport(ctx context.Context, specification []byte, components ...NewComponent) (http.RoundTripper, error) {
-	spec, err := newSpecification(specification)
+// build parses the specification and generates the transport it describes.
+func build(ctx context.Context, specification []byte, components ...NewComponent) (*openapi3.T, http.RoundTripper, error) {
+	spec, secrets, err := newSpecification(ctx, specification)
 	if err != nil {
-		return nil, err
+		return nil, nil, err
+	}
+	transport, err := buildTransport(ctx, spec, secrets, components...)
+	if err != nil {
+		return nil, nil, err
 	}
+	return spec, transport, nil
+}
+
+// buildTransport generates the transport described by a parsed
+// specification.
+func buildTransport(ctx context.Context, spec *openapi3.T, secrets *secretRedactor, components ...NewComponent) (http.RoundTripper, error) {
 	ctx = context.WithValue(ctx, ContextKeyOpenAPISpec, spec)
 	transport, err := newTransport(ctx, spec, components...)
+	return transport, secrets.Redact(err)
+}
+
+// NewTransport constructs a smart HTTP client from the given specification
+// and set of plugins. For running a service, use the New method instead.
+func NewTransport(ctx context.Context, specification []byte, components ...NewComponent) (http.RoundTripper, error) {
+	_, transport, err := build(ctx, specification, components...)
 	return transport, err
 }
 
 // New generates a configured HTTP runtime. To use as a library, call the
 // NewTransport method instead.
 func New(ctx context.Context, specification []byte, components ...NewComponent) (*runhttp.Runtime, error) {
-	spec, err := newSpecification(specification)
+	spec, secrets, err := newSpecification(ctx, specification)
 	if err != nil {
 		return nil, err
 	}
+	// The runtime is created before the transport so that any background
+	// tasks started by the transport have access to the runtime logger and
+	// stats client.
+	reloadable := NewReloadableTransport(nil)
+	rt, err := newRuntime(ctx, spec, reloadable)
+	if err != nil {
+		return nil, secrets.Redact(err)
+	}
+	ctx = runtimeContext(ctx, rt)
 	ctx = context.WithValue(ctx, ContextKeyOpenAPISpec, spec)
 	transport, err := newTransport(ctx, spec, components...)
 	if err != nil {
+		return nil, secrets.Redact(err)
+	}
+	reloadable.Store(transport)
+	return rt, nil
+}
+
+// NewWithReload generates a configured HTTP runtime from the specification
+// stored in the given file. The backend and route configurations are rebuilt
+// each time the file changes or the process receives a SIGHUP. A new
+// configuration only replaces the active one if it loads without error.
+// Requests that are in flight during a reload complete using the previous
+// configuration. The file is checked for changes on the given interval and
+// checking stops when the context is canceled.
+func NewWithReload(ctx context.Context, fileName string, interval time.Duration, components ...NewComponent) (*runhttp.Runtime, error) {
+	return NewFromFiles(ctx, SpecificationFiles{Root: fileName}, interval, components...)
+}
+
+// NewFromFiles is the same as NewWithReload but loads a specification that
+// is split across multiple files. Changes to any file that was read,
+// including those reached through external $refs, and files added to or
+// removed from the fragment directories trigger a reload.
+func NewFromFiles(ctx context.Context, files SpecificationFiles, interval time.Duration, components ...NewComponent) (*runhttp.Runtime, error) {
+	reloadable := NewReloadableTransport(nil)
+	reloader := &Reloader{
+		Transport:  reloadable,
+		Files:      &files,
+		Components: components,
+	}
+	spec, secrets, err := reloader.specification(ctx)
+	if err != nil {
+		return nil, err
+	}
+	rt, err := newRuntime(ctx, spec, reloadable)
+	if err != nil {
+		return nil, secrets.Redact(err)
+	}
+	reloader.Logger = rt.Logger
+	ctx = runtimeContext(ctx, rt)
+	if err := reloader.Reload(ctx); err != nil {
 		return nil, err
 	}
+	go reloader.Watch(ctx, files.Root, interval)
+	return rt, nil
+}
+
+func newRuntime(ctx context.Context, spec *openapi3.T, transport http.RoundTripper) (*runhttp.Runtime, error) {
+	ctx = context.WithValue(ctx, ContextKeyOpenAPISpec, spec)
 	handler := &httputil.ReverseProxy{
 		Director:  func(*http.Request) {},
 		Transport: transport,
@@ -174,7 +269,7 @@ func New(ctx context.Context, specification []byte, components ...NewComponent)
 	if err != nil {
 		return nil, fmt.Errorf("failed to parse runtime configuration: %s", err.Error())
 	}
-	rt, err := NewRuntime(ctx, s, handler)
+	rt, err := NewRuntime(ctx, s, newStreamingProxy(handler))
 	if err != nil {
 		return nil, fmt.Errorf("failed to configure runtime: %s", err.Error())
 	}
@@ -0,0 +1,216 @@
+package transportd
+
+import (
+	"fmt"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/asecurityteam/runhttp"
+)
+
+const (
+	outlierSetting = "outlier"
+	// outlierEjectionMetric is emitted each time a host is ejected.
+	outlierEjectionMetric = "transportd.backend.outlier.ejection"
+)
+
+// OutlierConfig configures passive outlier detection for the hosts of a
+// backend. Each threshold may be set to zero to disable that check.
+type OutlierConfig struct {
+	Consecutive5xx     int           `description:"Consecutive 5xx responses from a host before it is ejected."`
+	ConsecutiveErrors  int           `description:"Consecutive connection errors from a host before it is ejected."`
+	ConsecutiveSlow    int           `description:"Consecutive responses slower than the latency threshold before a host is ejected."`
+	Latency            time.Duration `description:"Latency threshold for slow responses."`
+	BaseEjectionTime   time.Duration `description:"Ejection time of a host. Doubles with each consecutive ejection."`
+	MaxEjectionTime    time.Duration `description:"Maximum ejection time of a host."`
+	MaxEjectionPercent int           `description:"Maximum percent of hosts that may be ejected at once. One host may always be ejected unless this is zero."`
+}
+
+// Name of the config root.
+func (*OutlierConfig) Name() string {
+	return outlierSetting
+}
+
+func newOutlierConfig() *OutlierConfig {
+	return &OutlierConfig{
+		BaseEjectionTime:   30 * time.Second,
+		MaxEjectionTime:    5 * time.Minute,
+		MaxEjectionPercent: 50,
+	}
+}
+
+// enabled reports whether any of the outlier checks are active.
+func (c *OutlierConfig) enabled() bool {
+	return c.Consecutive5xx > 0 || c.ConsecutiveErrors > 0 || (c.ConsecutiveSlow > 0 && c.Latency > 0)
+}
+
+func validateOutlier(conf *OutlierConfig) error {
+	if !conf.enabled() {
+		return nil
+	}
+	if conf.BaseEjectionTime <= 0 {
+		return fmt.Errorf("base ejection time must be greater than zero")
+	}
+	if conf.MaxEjectionTime < conf.BaseEjectionTime {
+		return fmt.Errorf("max ejection time must not be less than the base ejection time")
+	}
+	if conf.MaxEjectionPercent < 0 || conf.MaxEjectionPercent > 100 {
+		return fmt.Errorf("max ejection percent must be between 0 and 100")
+	}
+	return nil
+}
+
+// outlierState is the set of consecutive failure counters for a host.
+type outlierState struct {
+	serverErrors int
+	connErrors   int
+	slow         int
+	// ejections is the number of times the host has been ejected without
+	// a recovery period in between. It drives the exponential ejection time.
+	ejections int
+	ejectedAt time.Time
+}
+
+type outlierEvent struct {
+	Message  string `logevent:"message,default=backend-host-ejected"`
+	Backend  string `logevent:"backend"`
+	Host     string `logevent:"host"`
+	Reason   string `logevent:"reason"`
+	Duration string `logevent:"duration"`
+}
+
+// outlierDetector is an http.RoundTripper decorator that watches the results
+// of real traffic and temporarily ejects hosts that repeatedly fail or that
+// are much slower than expected. This catches failures that a health check
+// endpoint may not reveal.
+type outlierDetector struct {
+	Backend string
+	Pool    *hostPool
+	Conf    *OutlierConfig
+	Wrapped http.RoundTripper
+	Logger  runhttp.Logger
+	Stats   runhttp.Stat
+
+	lock   sync.Mutex
+	states map[*upstream]*outlierState
+	now    func() time.Time
+}
+
+func (d *outlierDetector) RoundTrip(req *http.Request) (*http.Response, error) {
+	u, ok := d.Pool.byHost[req.URL.Host]
+	if !ok {
+		return d.Wrapped.RoundTrip(req)
+	}
+	start := d.clock()
+	resp, err := d.Wrapped.RoundTrip(req)
+	if err != nil && req.Context().Err() != nil {
+		// The request was canceled or timed out by the caller rather than
+		// failed by the host so it says nothing about the host's health.
+		return resp, err
+	}
+	d.observe(u, resp, err, d.clock().Sub(start))
+	return resp, err
+}
+
+func (d *outlierDetector) clock() time.Time {
+	if d.now != nil {
+		return d.now()
+	}
+	return time.Now()
+}
+
+func (d *outlierDetector) observe(u *upstream, resp *http.Response, err error, elapsed time.Duration) {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	if d.states == nil {
+		d.states = make(map[*upstream]*outlierState, len(d.Pool.hosts))
+	}
+	state, ok := d.states[u]
+	if !ok {
+		state = &outlierState{}
+		d.states[u] = state
+	}
+
+	reason := ""
+	switch {
+	case err != nil:
+		state.connErrors = state.connErrors + 1
+		state.serverErrors = 0
+		if d.Conf.ConsecutiveErrors > 0 && state.connErrors >= d.Conf.ConsecutiveErrors {
+			reason = fmt.Sprintf("%d consecutive connection errors", state.connErrors)
+		}
+	case resp.StatusCode >= http.StatusInternalServerError:
+		state.serverErrors = state.serverErrors + 1
+		state.connErrors = 0
+		if d.Conf.Consecutive5xx > 0 && state.serverErrors >= d.Conf.Consecutive5xx {
+			reason = fmt.Sprintf("%d consecutive 5xx responses", state.serverErrors)
+		}
+	default:
+		state.serverErrors = 0
+		state.connErrors = 0
+	}
+	if d.Conf.Latency > 0 && d.Conf.ConsecutiveSlow > 0 {
+		if elapsed > d.Conf.Latency {
+			state.slow = state.slow + 1
+			if reason == "" && state.slow >= d.Conf.ConsecutiveSlow {
+				reason = fmt.Sprintf("%d consecutive responses slower than %s", state.slow, d.Conf.Latency)
+			}
+		} else {
+			state.slow = 0
+		}
+	}
+	if reason != "" {
+		d.eject(u, state, reason)
+	}
+}
+
+// eject removes the host from rotation unless doing so would exceed the
+// maximum percent of ejected hosts. At least one host may be ejected so that
+// a failing backend with few hosts, or only one, can still be taken out of
+// rotation and respond with a 503. The caller must hold the lock.
+func (d *outlierDetector) eject(u *upstream, state *outlierState, reason string) {
+	now := d.clock()
+	if now.UnixNano() < atomic.LoadInt64(&u.ejectedUntil) {
+		// Already ejected. This happens for requests that were in flight
+		// when the ejection started.
+		return
+	}
+	ejected := 0
+	for _, host := range d.Pool.hosts {
+		if now.UnixNano() < atomic.LoadInt64(&host.ejectedUntil) {
+			ejected = ejected + 1
+		}
+	}
+	limit := len(d.Pool.hosts) * d.Conf.MaxEjectionPercent / 100
+	if limit < 1 && d.Conf.MaxEjectionPercent > 0 {
+		limit = 1
+	}
+	if ejected >= limit {
+		return
+	}
+	// Hosts that have behaved since their last ejection start over at the
+	// base ejection time.
+	if !state.ejectedAt.IsZero() && now.Sub(state.ejectedAt) > 2*d.Conf.MaxEjectionTime {
+		state.ejections = 0
+	}
+	duration := d.Conf.BaseEjectionTime << uint(state.ejections)
+	if duration > d.Conf.MaxEjectionTime || duration <= 0 {
+		duration = d.Conf.MaxEjectionTime
+	} else {
+		state.ejections = state.ejections + 1
+	}
+	state.ejectedAt = now
+	state.serverErrors = 0
+	state.connErrors = 0
+	state.slow = 0
+	atomic.StoreInt64(&u.ejectedUntil, now.Add(duration).UnixNano())
+	d.Logger.Warn(outlierEvent{
+		Backend:  d.Backend,
+		Host:     u.url.Host,
+		Reason:   reason,
+		Duration: duration.String(),
+	})
+	d.Stats.Count(outlierEjectionMetric, 1, "backend:"+d.Backend, "host:"+u.url.Host)
+}
@@ -0,0 +1,202 @@
+package transportd
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/asecurityteam/runhttp"
+	"github.com/golang/mock/gomock"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestOutlierDetectorEjectsOnConsecutive5xx(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	wrapped := NewMockRoundTripper(ctrl)
+	conf := newOutlierConfig()
+	conf.Consecutive5xx = 2
+	a, _ := url.Parse("https://a")
+	b, _ := url.Parse("https://b")
+	d := &outlierDetector{
+		Backend: testBackend,
+		Pool:    newHostPool([]*url.URL{a, b}, nil, &roundRobinBalancer{}),
+		Conf:    conf,
+		Wrapped: wrapped,
+		Logger:  backgroundLogger(context.Background()),
+		Stats:   runhttp.StatFromContext(context.Background()),
+	}
+	req, _ := http.NewRequest(http.MethodGet, "https://a/", http.NoBody)
+
+	wrapped.EXPECT().RoundTrip(req).Return(&http.Response{StatusCode: http.StatusBadGateway}, nil).Times(2)
+	_, _ = d.RoundTrip(req)
+	assert.True(t, d.Pool.hosts[0].available())
+	_, _ = d.RoundTrip(req)
+	assert.False(t, d.Pool.hosts[0].available())
+	for x := 0; x < 5; x = x + 1 {
+		assert.Equal(t, "b", d.Pool.Next().Host)
+	}
+}
+
+func TestOutlierDetectorSuccessResetsCount(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	wrapped := NewMockRoundTripper(ctrl)
+	conf := newOutlierConfig()
+	conf.ConsecutiveErrors = 2
+	a, _ := url.Parse("https://a")
+	b, _ := url.Parse("https://b")
+	d := &outlierDetector{
+		Backend: testBackend,
+		Pool:    newHostPool([]*url.URL{a, b}, nil, &roundRobinBalancer{}),
+		Conf:    conf,
+		Wrapped: wrapped,
+		Logger:  backgroundLogger(context.Background()),
+		Stats:   runhttp.StatFromContext(context.Background()),
+	}
+	req, _ := http.NewRequest(http.MethodGet, "https://a/", http.NoBody)
+
+	gomock.InOrder(
+		wrapped.EXPECT().RoundTrip(req).Return(nil, errors.New("connection refused")),
+		wrapped.EXPECT().RoundTrip(req).Return(&http.Response{StatusCode: http.StatusOK}, nil),
+		wrapped.EXPECT().RoundTrip(req).Return(nil, errors.New("connection refused")),
+	)
+	_, _ = d.RoundTrip(req)
+	_, _ = d.RoundTrip(req)
+	_, _ = d.RoundTrip(req)
+	assert.True(t, d.Pool.hosts[0].available())
+}
+
+func TestOutlierDetectorMaxEjectionPercent(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	wrapped := NewMockRoundTripper(ctrl)
+	conf := newOutlierConfig()
+	conf.ConsecutiveErrors = 1
+	a, _ := url.Parse("https://a")
+	b, _ := url.Parse("https://b")
+	d := &outlierDetector{
+		Backend: testBackend,
+		Pool:    newHostPool([]*url.URL{a, b}, nil, &roundRobinBalancer{}),
+		Conf:    conf,
+		Wrapped: wrapped,
+		Logger:  backgroundLogger(context.Background()),
+		Stats:   runhttp.StatFromContext(context.Background()),
+	}
+	reqA, _ := http.NewRequest(http.MethodGet, "https://a/", http.NoBody)
+	reqB, _ := http.NewRequest(http.MethodGet, "https://b/", http.NoBody)
+
+	wrapped.EXPECT().RoundTrip(gomock.Any()).Return(nil, errors.New("connection refused")).Times(2)
+	_, _ = d.RoundTrip(reqA)
+	_, _ = d.RoundTrip(reqB)
+	assert.False(t, d.Pool.hosts[0].available())
+	assert.True(t, d.Pool.hosts[1].available(), "ejected more than the max percent of hosts")
+}
+
+func TestOutlierDetectorEjectsSingleHost(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	wrapped := NewMockRoundTripper(ctrl)
+	conf := newOutlierConfig()
+	conf.ConsecutiveErrors = 1
+	a, _ := url.Parse("https://a")
+	d := &outlierDetector{
+		Backend: testBackend,
+		Pool:    newHostPool([]*url.URL{a}, nil, &roundRobinBalancer{}),
+		Conf:    conf,
+		Wrapped: wrapped,
+		Logger:  backgroundLogger(context.Background()),
+		Stats:   runhttp.StatFromContext(context.Background()),
+	}
+	req, _ := http.NewRequest(http.MethodGet, "https://a/", http.NoBody)
+
+	wrapped.EXPECT().RoundTrip(req).Return(nil, errors.New("connection refused"))
+	_, _ = d.RoundTrip(req)
+	assert.False(t, d.Pool.hosts[0].available(), "only host of the backend was not ejected")
+	assert.Nil(t, d.Pool.Next())
+
+	conf.MaxEjectionPercent = 0
+	d.Pool = newHostPool([]*url.URL{a}, nil, &roundRobinBalancer{})
+	wrapped.EXPECT().RoundTrip(req).Return(nil, errors.New("connection refused"))
+	_, _ = d.RoundTrip(req)
+	assert.True(t, d.Pool.hosts[0].available(), "host was ejected with a zero max percent")
+}
+
+func TestOutlierDetectorExponentialEjection(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	wrapped := NewMockRoundTripper(ctrl)
+	conf := newOutlierConfig()
+	conf.ConsecutiveErrors = 1
+	conf.BaseEjectionTime = time.Second
+	conf.MaxEjectionTime = 3 * time.Second
+	a, _ := url.Parse("https://a")
+	b, _ := url.Parse("https://b")
+	d := &outlierDetector{
+		Backend: testBackend,
+		Pool:    newHostPool([]*url.URL{a, b}, nil, &roundRobinBalancer{}),
+		Conf:    conf,
+		Wrapped: wrapped,
+		Logger:  backgroundLogger(context.Background()),
+		Stats:   runhttp.StatFromContext(context.Background()),
+	}
+	now := time.Unix(0, 0)
+	d.now = func() time.Time { return now }
+	req, _ := http.NewRequest(http.MethodGet, "https://a/", http.NoBody)
+	host := d.Pool.hosts[0]
+
+	wrapped.EXPECT().RoundTrip(req).Return(nil, errors.New("connection refused")).AnyTimes()
+	expected := []time.Duration{time.Second, 2 * time.Second, 3 * time.Second, 3 * time.Second}
+	for _, duration := range expected {
+		_, _ = d.RoundTrip(req)
+		assert.Equal(t, now.Add(duration).UnixNano(), host.ejectedUntil)
+		now = time.Unix(0, host.ejectedUntil)
+	}
+}
+
+func TestOutlierDetectorIgnoresCanceledRequests(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	wrapped := NewMockRoundTripper(ctrl)
+	conf := newOutlierConfig()
+	conf.ConsecutiveErrors = 1
+	a, _ := url.Parse("https://a")
+	b, _ := url.Parse("https://b")
+	d := &outlierDetector{
+		Backend: testBackend,
+		Pool:    newHostPool([]*url.URL{a, b}, nil, &roundRobinBalancer{}),
+		Conf:    conf,
+		Wrapped: wrapped,
+		Logger:  backgroundLogger(context.Background()),
+		Stats:   runhttp.StatFromContext(context.Background()),
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	req, _ := http.NewRequestWithContext(ctx, http.MethodGet, "https://a/", http.NoBody)
+
+	wrapped.EXPECT().RoundTrip(req).Return(nil, context.Canceled)
+	_, _ = d.RoundTrip(req)
+	assert.True(t, d.Pool.hosts[0].available(), "ejected a host because the caller went away")
+}
+
+func TestValidateOutlier(t *testing.T) {
+	conf := newOutlierConfig()
+	assert.Nil(t, validateOutlier(conf), "disabled detection is always valid")
+	conf.Consecutive5xx = 5
+	assert.Nil(t, validateOutlier(conf))
+	conf.MaxEjectionTime = time.Second
+	assert.NotNil(t, validateOutlier(conf))
+	conf = newOutlierConfig()
+	conf.Consecutive5xx = 5
+	conf.MaxEjectionPercent = 101
+	assert.NotNil(t, validateOutlier(conf))
+}
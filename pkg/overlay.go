@@ -0,0 +1,305 @@
+package transportd
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// overlayAction is a single change described by an OpenAPI Overlay
+// document.
+type overlayAction struct {
+	Target      string      `json:"target"`
+	Description string      `json:"description"`
+	Update      interface{} `json:"update"`
+	Remove      bool        `json:"remove"`
+}
+
+// removedNode marks array elements that are removed by an overlay until the
+// array can be compacted.
+type removedNode struct{}
+
+// applyOverlay applies an OpenAPI Overlay document to the specification. Any
+// other document is applied as a JSON merge patch as described by RFC 7396.
+func applyOverlay(doc map[string]interface{}, overlay interface{}) (map[string]interface{}, error) {
+	if o, ok := overlay.(map[string]interface{}); ok {
+		if _, isOverlay := o["overlay"]; isOverlay {
+			return doc, applyOverlayActions(doc, o["actions"])
+		}
+	}
+	patched, ok := mergePatch(doc, overlay).(map[string]interface{})
+	if !ok {
+		return nil, fmt.Errorf("merge patch must be an object")
+	}
+	return patched, nil
+}
+
+// mergePatch applies a JSON merge patch to the target. Null values in the
+// patch remove the matching member of the target.
+func mergePatch(target interface{}, patch interface{}) interface{} {
+	p, ok := patch.(map[string]interface{})
+	if !ok {
+		return patch
+	}
+	t, ok := target.(map[string]interface{})
+	if !ok {
+		t = make(map[string]interface{})
+	}
+	for key, value := range p {
+		if value == nil {
+			delete(t, key)
+			continue
+		}
+		t[key] = mergePatch(t[key], value)
+	}
+	return t
+}
+
+// applyOverlayActions runs the actions of an overlay in order. An update is
+// merged into each object selected by its target, appended to each selected
+// array, and replaces any other selected value. Targets that select nothing
+// leave the document unchanged.
+func applyOverlayActions(doc map[string]interface{}, rawActions interface{}) error {
+	rawJSON, err := json.Marshal(rawActions)
+	if err != nil {
+		return err
+	}
+	var actions []overlayAction
+	decoder := json.NewDecoder(bytes.NewReader(rawJSON))
+	decoder.UseNumber()
+	if err := decoder.Decode(&actions); err != nil {
+		return fmt.Errorf("invalid overlay actions: %s", err.Error())
+	}
+	if len(actions) < 1 {
+		return fmt.Errorf("overlay has no actions")
+	}
+	for offset, action := range actions {
+		if err := applyOverlayAction(doc, action); err != nil {
+			return fmt.Errorf("action %d: %s", offset+1, err.Error())
+		}
+	}
+	return nil
+}
+
+func applyOverlayAction(doc map[string]interface{}, action overlayAction) error {
+	segments, err := parseJSONPath(action.Target)
+	if err != nil {
+		return err
+	}
+	if !action.Remove && action.Update == nil {
+		return fmt.Errorf("target %s has neither an update nor remove", action.Target)
+	}
+	for _, match := range selectJSONPath(doc, segments) {
+		if match.parent == nil {
+			if action.Remove {
+				return fmt.Errorf("the root of the document cannot be removed")
+			}
+			update, ok := action.Update.(map[string]interface{})
+			if !ok {
+				return fmt.Errorf("the root of the document can only be updated with an object")
+			}
+			mergeUpdate(doc, copyValue(update).(map[string]interface{}))
+			continue
+		}
+		if action.Remove {
+			match.set(removedNode{})
+			continue
+		}
+		switch value := match.value.(type) {
+		case map[string]interface{}:
+			if update, ok := action.Update.(map[string]interface{}); ok {
+				mergeUpdate(value, copyValue(update).(map[string]interface{}))
+				continue
+			}
+			match.set(copyValue(action.Update))
+		case []interface{}:
+			match.set(append(value, copyValue(action.Update)))
+		default:
+			match.set(copyValue(action.Update))
+		}
+	}
+	compactRemoved(doc)
+	return nil
+}
+
+// mergeUpdate recursively merges an overlay update into an object.
+func mergeUpdate(target map[string]interface{}, update map[string]interface{}) {
+	for key, value := range update {
+		existing, isObject := target[key].(map[string]interface{})
+		child, isUpdateObject := value.(map[string]interface{})
+		if isObject && isUpdateObject {
+			mergeUpdate(existing, child)
+			continue
+		}
+		target[key] = value
+	}
+}
+
+// compactRemoved deletes the values marked by removedNode.
+func compactRemoved(node interface{}) interface{} {
+	switch value := node.(type) {
+	case map[string]interface{}:
+		for key, child := range value {
+			if _, removed := child.(removedNode); removed {
+				delete(value, key)
+				continue
+			}
+			value[key] = compactRemoved(child)
+		}
+	case []interface{}:
+		kept := value[:0]
+		for _, child := range value {
+			if _, removed := child.(removedNode); !removed {
+				kept = append(kept, compactRemoved(child))
+			}
+		}
+		return kept
+	}
+	return node
+}
+
+func copyValue(node interface{}) interface{} {
+	switch value := node.(type) {
+	case map[string]interface{}:
+		result := make(map[string]interface{}, len(value))
+		for key, child := range value {
+			result[key] = copyValue(child)
+		}
+		return result
+	case []interface{}:
+		result := make([]interface{}, len(value))
+		for offset, child := range value {
+			result[offset] = copyValue(child)
+		}
+		return result
+	}
+	return node
+}
+
+// jsonPathSegment is one step of a JSONPath expression. Only the name,
+// index, and wildcard selectors are supported.
+type jsonPathSegment struct {
+	name     string
+	index    int
+	isIndex  bool
+	wildcard bool
+}
+
+// parseJSONPath parses expressions such as $.paths['/users'].get or
+// $.x-transportd.backends[0].
+func parseJSONPath(expr string) ([]jsonPathSegment, error) {
+	if !strings.HasPrefix(expr, "$") {
+		return nil, fmt.Errorf("target %s must start with $", expr)
+	}
+	var segments []jsonPathSegment
+	for offset := 1; offset < len(expr); {
+		switch {
+		case strings.HasPrefix(expr[offset:], ".."):
+			return nil, fmt.Errorf("target %s uses recursive descent which is not supported", expr)
+		case strings.HasPrefix(expr[offset:], ".*"):
+			segments = append(segments, jsonPathSegment{wildcard: true})
+			offset = offset + 2
+		case expr[offset] == '.':
+			end := offset + 1
+			for end < len(expr) && expr[end] != '.' && expr[end] != '[' {
+				end = end + 1
+			}
+			if end == offset+1 {
+				return nil, fmt.Errorf("target %s has an empty name", expr)
+			}
+			segments = append(segments, jsonPathSegment{name: expr[offset+1 : end]})
+			offset = end
+		case expr[offset] == '[':
+			end := strings.Index(expr[offset:], "]")
+			if end < 0 {
+				return nil, fmt.Errorf("target %s has an unclosed [", expr)
+			}
+			selector := expr[offset+1 : offset+end]
+			if len(selector) > 1 && (selector[0] == '\'' || selector[0] == '"') {
+				// Quoted names may contain ] so the closing quote is found first.
+				closing := strings.IndexByte(expr[offset+2:], selector[0])
+				if closing < 0 || offset+2+closing+1 >= len(expr) || expr[offset+2+closing+1] != ']' {
+					return nil, fmt.Errorf("target %s has an invalid quoted name", expr)
+				}
+				segments = append(segments, jsonPathSegment{name: expr[offset+2 : offset+2+closing]})
+				offset = offset + 2 + closing + 2
+				continue
+			}
+			switch {
+			case selector == "*":
+				segments = append(segments, jsonPathSegment{wildcard: true})
+			case strings.HasPrefix(selector, "?"):
+				return nil, fmt.Errorf("target %s uses a filter which is not supported", expr)
+			default:
+				index, err := strconv.Atoi(selector)
+				if err != nil {
+					return nil, fmt.Errorf("target %s has an invalid index %s", expr, selector)
+				}
+				segments = append(segments, jsonPathSegment{index: index, isIndex: true})
+			}
+			offset = offset + end + 1
+		default:
+			return nil, fmt.Errorf("target %s is not a supported JSONPath expression", expr)
+		}
+	}
+	return segments, nil
+}
+
+// jsonPathMatch is a value selected by a JSONPath expression along with the
+// container that holds it. The root of the document has no parent.
+type jsonPathMatch struct {
+	value  interface{}
+	parent interface{}
+	key    string
+	index  int
+}
+
+func (m jsonPathMatch) set(value interface{}) {
+	switch parent := m.parent.(type) {
+	case map[string]interface{}:
+		parent[m.key] = value
+	case []interface{}:
+		parent[m.index] = value
+	}
+}
+
+func selectJSONPath(doc interface{}, segments []jsonPathSegment) []jsonPathMatch {
+	matches := []jsonPathMatch{{value: doc}}
+	for _, segment := range segments {
+		var next []jsonPathMatch
+		for _, match := range matches {
+			switch value := match.value.(type) {
+			case map[string]interface{}:
+				switch {
+				case segment.wildcard:
+					for _, key := range sortedKeys(value) {
+						next = append(next, jsonPathMatch{value: value[key], parent: value, key: key})
+					}
+				case !segment.isIndex:
+					if child, ok := value[segment.name]; ok {
+						next = append(next, jsonPathMatch{value: child, parent: value, key: segment.name})
+					}
+				}
+			case []interface{}:
+				switch {
+				case segment.wildcard:
+					for offset, child := range value {
+						next = append(next, jsonPathMatch{value: child, parent: value, index: offset})
+					}
+				case segment.isIndex:
+					index := segment.index
+					if index < 0 {
+						index = len(value) + index
+					}
+					if index >= 0 && index < len(value) {
+						next = append(next, jsonPathMatch{value: value[index], parent: value, index: index})
+					}
+				}
+			}
+		}
+		matches = next
+	}
+	return matches
+}
@@ -0,0 +1,219 @@
+package transportd
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+const overlayBase = `{
+  "x-transportd": {
+    "backends": ["app"],
+    "app": {"host": "http://localhost", "pool": {"count": 1}}
+  },
+  "paths": {
+    "/users/{id}": {
+      "get": {"x-transportd": {"backend": "app", "timeout": {"after": "1s"}}},
+      "delete": {"x-transportd": {"backend": "app"}}
+    }
+  },
+  "tags": [{"name": "a"}, {"name": "b"}, {"name": "c"}]
+}`
+
+func TestApplyOverlay(t *testing.T) {
+	tests := []struct {
+		name    string
+		overlay string
+		want    string
+		wantErr bool
+	}{
+		{
+			name:    "merge patch",
+			overlay: `{"x-transportd": {"app": {"host": "http://eu.local", "pool": null}}, "tags": null}`,
+			want: `{
+  "x-transportd": {"backends": ["app"], "app": {"host": "http://eu.local"}},
+  "paths": {
+    "/users/{id}": {
+      "get": {"x-transportd": {"backend": "app", "timeout": {"after": "1s"}}},
+      "delete": {"x-transportd": {"backend": "app"}}
+    }
+  }
+}`,
+		},
+		{
+			name: "update object",
+			overlay: `{"overlay": "1.0.0", "actions": [
+  {"target": "$['x-transportd'].app", "update": {"host": "http://eu.local", "pool": {"ttl": "1m"}}},
+  {"target": "$.paths['/users/{id}'].*['x-transportd']", "update": {"timeout": {"after": "5s"}}}
+]}`,
+			want: `{
+  "x-transportd": {
+    "backends": ["app"],
+    "app": {"host": "http://eu.local", "pool": {"count": 1, "ttl": "1m"}}
+  },
+  "paths": {
+    "/users/{id}": {
+      "get": {"x-transportd": {"backend": "app", "timeout": {"after": "5s"}}},
+      "delete": {"x-transportd": {"backend": "app", "timeout": {"after": "5s"}}}
+    }
+  },
+  "tags": [{"name": "a"}, {"name": "b"}, {"name": "c"}]
+}`,
+		},
+		{
+			name: "append remove and replace",
+			overlay: `{"overlay": "1.0.0", "actions": [
+  {"target": "$.x-transportd.backends", "update": "other"},
+  {"target": "$.x-transportd.app.host", "update": "http://other.local"},
+  {"target": "$.tags[0]", "remove": true},
+  {"target": "$.tags[-1]", "remove": true},
+  {"target": "$.paths['/users/{id}'].delete", "remove": true},
+  {"target": "$.missing.value", "remove": true}
+]}`,
+			want: `{
+  "x-transportd": {
+    "backends": ["app", "other"],
+    "app": {"host": "http://other.local", "pool": {"count": 1}}
+  },
+  "paths": {
+    "/users/{id}": {
+      "get": {"x-transportd": {"backend": "app", "timeout": {"after": "1s"}}}
+    }
+  },
+  "tags": [{"name": "b"}]
+}`,
+		},
+		{
+			name:    "remove root",
+			overlay: `{"overlay": "1.0.0", "actions": [{"target": "$", "remove": true}]}`,
+			wantErr: true,
+		},
+		{
+			name:    "no change",
+			overlay: `{"overlay": "1.0.0", "actions": [{"target": "$.tags"}]}`,
+			wantErr: true,
+		},
+		{
+			name:    "no actions",
+			overlay: `{"overlay": "1.0.0"}`,
+			wantErr: true,
+		},
+		{
+			name:    "invalid target",
+			overlay: `{"overlay": "1.0.0", "actions": [{"target": "$..host", "update": "x"}]}`,
+			wantErr: true,
+		},
+		{
+			name:    "non object patch",
+			overlay: `["not", "an", "object"]`,
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var doc map[string]interface{}
+			var overlay interface{}
+			assert.Nil(t, json.Unmarshal([]byte(overlayBase), &doc))
+			assert.Nil(t, json.Unmarshal([]byte(tt.overlay), &overlay))
+			got, err := applyOverlay(doc, overlay)
+			if tt.wantErr {
+				assert.NotNil(t, err)
+				return
+			}
+			assert.Nil(t, err)
+			rawGot, _ := json.Marshal(got)
+			assert.JSONEq(t, tt.want, string(rawGot))
+		})
+	}
+}
+
+func TestParseJSONPath(t *testing.T) {
+	tests := []struct {
+		expr    string
+		want    []jsonPathSegment
+		wantErr bool
+	}{
+		{expr: "$", want: nil},
+		{expr: "$.a.b-c", want: []jsonPathSegment{{name: "a"}, {name: "b-c"}}},
+		{expr: `$['a.b']["c]"][2].*[*]`, want: []jsonPathSegment{{name: "a.b"}, {name: "c]"}, {index: 2, isIndex: true}, {wildcard: true}, {wildcard: true}}},
+		{expr: "a.b", wantErr: true},
+		{expr: "$.", wantErr: true},
+		{expr: "$[0", wantErr: true},
+		{expr: "$['a]", wantErr: true},
+		{expr: "$[?(@.name)]", wantErr: true},
+		{expr: "$[x]", wantErr: true},
+		{expr: "$a", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.expr, func(t *testing.T) {
+			got, err := parseJSONPath(tt.expr)
+			if tt.wantErr {
+				assert.NotNil(t, err)
+				return
+			}
+			assert.Nil(t, err)
+			assert.Equal(t, tt.want, got)
+		})
+	}
+}
+
+func TestResolveSpecification(t *testing.T) {
+	secret := "http://svc:p@ss'w0rd@eu.local"
+	encoded := base64.StdEncoding.EncodeToString([]byte(secret))
+	dir := writeSpecFiles(t, map[string]string{
+		"openapi.yaml":          specFilesRoot,
+		"shared/responses.yaml": specFilesResponses,
+		"shared/schemas.yaml":   specFilesSchemas,
+		"overlays/eu.yaml": `
+overlay: 1.0.0
+info:
+  title: EU
+  version: 1.0.0
+actions:
+  - target: $.x-transportd.app
+    update:
+      host: "${base64:` + encoded + `}"
+`,
+		"overlays/timeouts.yaml": `
+paths:
+  /hello:
+    get:
+      x-transportd:
+        timeout:
+          after: 5s
+`,
+	})
+	files := SpecificationFiles{
+		Root:     filepath.Join(dir, "openapi.yaml"),
+		Overlays: []string{filepath.Join(dir, "overlays", "eu.yaml"), filepath.Join(dir, "overlays", "timeouts.yaml")},
+	}
+	spec, _, read, err := files.load(context.Background())
+	if !assert.Nil(t, err) {
+		return
+	}
+	assert.Contains(t, read, filepath.Join(dir, "overlays", "eu.yaml"))
+	var conf struct {
+		App struct {
+			Host string `json:"host"`
+		} `json:"app"`
+	}
+	assert.Nil(t, json.Unmarshal(spec.Extensions[ExtensionKey].(json.RawMessage), &conf))
+	assert.Equal(t, secret, conf.App.Host)
+	assert.Contains(t, string(spec.Paths["/hello"].Get.Extensions[ExtensionKey].(json.RawMessage)), "5s")
+
+	resolved, err := ResolveSpecification(context.Background(), files)
+	assert.Nil(t, err)
+	assert.NotContains(t, string(resolved), "w0rd")
+	assert.Contains(t, string(resolved), "host: '[REDACTED]'")
+	assert.Contains(t, string(resolved), "after: 5s")
+	assert.Contains(t, string(resolved), "shared/responses.yaml#/components/responses/Hello")
+
+	assert.Nil(t, os.WriteFile(filepath.Join(dir, "overlays", "timeouts.yaml"), []byte("{"), 0600))
+	_, err = ResolveSpecification(context.Background(), files)
+	assert.NotNil(t, err)
+}
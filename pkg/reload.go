@@ -0,0 +1,209 @@
+package transportd
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"os"
+	"os/signal"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+
+	"github.com/asecurityteam/runhttp"
+	"github.com/getkin/kin-openapi/openapi3"
+)
+
+const (
+	// DefaultReloadInterval is the frequency with which a specification file
+	// is checked for modifications when hot reloading is enabled.
+	DefaultReloadInterval = 5 * time.Second
+)
+
+// storedTransport exists because atomic.Value requires that every stored
+// value has the same concrete type. Wrapping the http.RoundTripper lets us
+// swap between any implementations.
+type storedTransport struct {
+	http.RoundTripper
+}
+
+// ReloadableTransport is an http.RoundTripper that delegates to another
+// http.RoundTripper which can be replaced at any time. Requests that are
+// already in flight when a replacement happens complete using the instance
+// that was active when they started.
+type ReloadableTransport struct {
+	current atomic.Value
+}
+
+// NewReloadableTransport initializes a ReloadableTransport with the given
+// starting http.RoundTripper.
+func NewReloadableTransport(rt http.RoundTripper) *ReloadableTransport {
+	r := &ReloadableTransport{}
+	r.Store(rt)
+	return r
+}
+
+// Store replaces the active http.RoundTripper.
+func (r *ReloadableTransport) Store(rt http.RoundTripper) {
+	r.current.Store(storedTransport{RoundTripper: rt})
+}
+
+// Load returns the active http.RoundTripper.
+func (r *ReloadableTransport) Load() http.RoundTripper {
+	return r.current.Load().(storedTransport).RoundTripper
+}
+
+// RoundTrip executes the request using the active http.RoundTripper.
+func (r *ReloadableTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	return r.Load().RoundTrip(req)
+}
+
+// streaming reports whether the active http.RoundTripper serves the request
+// in streaming mode.
+func (r *ReloadableTransport) streaming(req *http.Request) bool {
+	router, ok := r.Load().(streamingRouter)
+	return ok && router.streaming(req)
+}
+
+// Reloader rebuilds the transport from a fresh copy of the specification
+// and swaps it into a ReloadableTransport. Only the backend and route
+// configurations are reloaded. Changes to the x-runtime block require a
+// restart. The specification is read from Files when it is set and from
+// Source otherwise.
+type Reloader struct {
+	Transport  *ReloadableTransport
+	Source     func() ([]byte, error)
+	Files      *SpecificationFiles
+	Components []NewComponent
+	Logger     runhttp.Logger
+
+	lock    sync.Mutex
+	stop    context.CancelFunc
+	watched []string
+}
+
+// Reload reads the specification and, if it produces a valid transport,
+// replaces the active transport with the new one. Any error leaves the
+// previous transport in place. Background tasks, such as health checks,
+// that belong to the replaced transport are stopped.
+func (r *Reloader) Reload(ctx context.Context) error {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	spec, secrets, err := r.specification(ctx)
+	if err != nil {
+		return err
+	}
+	ctx, cancel := context.WithCancel(ctx)
+	transport, err := buildTransport(ctx, spec, secrets, r.Components...)
+	if err != nil {
+		cancel()
+		return err
+	}
+	r.Transport.Store(transport)
+	if r.stop != nil {
+		r.stop()
+	}
+	r.stop = cancel
+	return nil
+}
+
+// specification reads and parses the current specification. When loading
+// from Files, the files that were read are recorded so that Watch can check
+// them for changes.
+func (r *Reloader) specification(ctx context.Context) (*openapi3.T, *secretRedactor, error) {
+	if r.Files == nil {
+		source, err := r.Source()
+		if err != nil {
+			return nil, nil, err
+		}
+		return newSpecification(ctx, source)
+	}
+	spec, secrets, read, err := r.Files.load(ctx)
+	if len(read) > 0 {
+		r.watched = read
+	}
+	return spec, secrets, err
+}
+
+func (r *Reloader) reloadAndLog(ctx context.Context, trigger string) {
+	if err := r.Reload(ctx); err != nil {
+		r.Logger.Error(struct {
+			Message string `logevent:"message,default=specification-reload-failed"`
+			Trigger string `logevent:"trigger"`
+			Reason  string `logevent:"reason"`
+		}{
+			Trigger: trigger,
+			Reason:  err.Error(),
+		})
+		return
+	}
+	r.Logger.Info(struct {
+		Message string `logevent:"message,default=specification-reloaded"`
+		Trigger string `logevent:"trigger"`
+	}{
+		Trigger: trigger,
+	})
+}
+
+// Watch triggers a reload each time the given file, or any other file read
+// from Files, is modified or the process receives a SIGHUP. The files are
+// checked for changes on the given interval. A zero interval disables file
+// polling but SIGHUP is still honored. Watch blocks until the context is
+// canceled.
+func (r *Reloader) Watch(ctx context.Context, fileName string, interval time.Duration) {
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	defer signal.Stop(hup)
+
+	var tick <-chan time.Time
+	if interval > 0 {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		tick = ticker.C
+	}
+	lastMod := r.stamp(fileName)
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-hup:
+			lastMod = r.stamp(fileName)
+			r.reloadAndLog(ctx, "signal")
+		case <-tick:
+			mod := r.stamp(fileName)
+			if mod == lastMod {
+				continue
+			}
+			lastMod = mod
+			r.reloadAndLog(ctx, "file")
+		}
+	}
+}
+
+// stamp summarizes the modification times of the watched files. Listing the
+// fragment directories on each check means that added files are noticed.
+func (r *Reloader) stamp(fileName string) string {
+	r.lock.Lock()
+	watched := append([]string{fileName}, r.watched...)
+	r.lock.Unlock()
+	if r.Files != nil {
+		fragments, _ := r.Files.fragments()
+		watched = append(watched, fragments...)
+	}
+	var b strings.Builder
+	for _, name := range watched {
+		fmt.Fprintf(&b, "%s@%d;", name, modTime(name).UnixNano())
+	}
+	return b.String()
+}
+
+func modTime(fileName string) time.Time {
+	info, err := os.Stat(fileName)
+	if err != nil {
+		return time.Time{}
+	}
+	return info.ModTime()
+}
@@ -0,0 +1,80 @@
+package transportd
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"testing"
+
+	"github.com/golang/mock/gomock"
+	"github.com/stretchr/testify/assert"
+)
+
+const reloadSpec = `
+openapi: 3.0.0
+info:
+  version: 1.0.0
+  title: Reload API
+x-transportd:
+  backends:
+    - app
+  app:
+    host: "http://localhost"
+paths:
+  /hello:
+    get:
+      responses:
+        "200":
+          description: "Success"
+      x-transportd:
+        backend: app
+`
+
+func TestReloadableTransportSwap(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	first := NewMockRoundTripper(ctrl)
+	second := NewMockRoundTripper(ctrl)
+	rt := NewReloadableTransport(first)
+	req, _ := http.NewRequest(http.MethodGet, "http://localhost/", http.NoBody)
+
+	first.EXPECT().RoundTrip(req).Return(&http.Response{StatusCode: http.StatusOK}, nil)
+	resp, err := rt.RoundTrip(req)
+	assert.Nil(t, err)
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+
+	rt.Store(second)
+	second.EXPECT().RoundTrip(req).Return(&http.Response{StatusCode: http.StatusAccepted}, nil)
+	resp, err = rt.RoundTrip(req)
+	assert.Nil(t, err)
+	assert.Equal(t, http.StatusAccepted, resp.StatusCode)
+}
+
+func TestReloaderReload(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	original := NewMockRoundTripper(ctrl)
+	source := []byte(reloadSpec)
+	var sourceErr error
+	r := &Reloader{
+		Transport: NewReloadableTransport(original),
+		Source: func() ([]byte, error) {
+			return source, sourceErr
+		},
+	}
+
+	sourceErr = errors.New("unreadable")
+	assert.NotNil(t, r.Reload(context.Background()))
+	assert.Equal(t, original, r.Transport.Load())
+
+	sourceErr = nil
+	source = []byte("x-transportd: [")
+	assert.NotNil(t, r.Reload(context.Background()))
+	assert.Equal(t, original, r.Transport.Load())
+
+	source = []byte(reloadSpec)
+	assert.Nil(t, r.Reload(context.Background()))
+	assert.IsType(t, &ClientTransport{}, r.Transport.Load())
+}
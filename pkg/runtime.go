@@ -3,16 +3,23 @@ package transportd
 import (
 	"context"
 	"encoding/json"
+	"io"
 	"net/http"
 
+	"github.com/asecurityteam/logevent"
 	"github.com/asecurityteam/runhttp"
 	"github.com/asecurityteam/settings"
+	"github.com/rs/xstats"
+	"golang.org/x/net/http2"
+	"golang.org/x/net/http2/h2c"
 )
 
 const (
 	// RuntimeExtensionKey is used to identify the runtime configuration
 	// extension block at the top level of an OpenAPI specification.
 	RuntimeExtensionKey = "x-runtime"
+	httpServerSetting   = "httpserver"
+	h2cSetting          = "h2c"
 )
 
 // RuntimeSourceFromExtension is a one-off change from the SourceFromExtension
@@ -38,5 +45,54 @@ func NewRuntime(ctx context.Context, s settings.Source, h http.Handler) (*runhtt
 	rt := runhttp.NewComponent().WithHandler(h)
 	rtD := new(runhttp.Runtime)
 	err := settings.NewComponent(ctx, s, rt, rtD)
-	return rtD, err
+	if err != nil {
+		return rtD, err
+	}
+
+	// The runhttp server has no option for h2c so it is loaded separately
+	// from the same httpserver block.
+	rtG, _ := settings.GroupFromComponent(rt)
+	cleartext := newH2CSetting()
+	h2cG := &settings.SettingGroup{
+		NameValue: rtG.Name(),
+		GroupValues: []settings.Group{&settings.SettingGroup{
+			NameValue:     httpServerSetting,
+			SettingValues: []settings.Setting{cleartext},
+		}},
+	}
+	if err = settings.LoadGroups(ctx, s, []settings.Group{h2cG}); err != nil {
+		return rtD, err
+	}
+	if *cleartext.BoolValue {
+		// Streaming requests and responses, including trailers, are passed
+		// through the reverse proxy as they arrive over either protocol. The
+		// requests of an h2c connection inherit the context, and so the
+		// logger and stats, of the request that started the connection.
+		rtD.Handler = h2c.NewHandler(rtD.Handler, &http2.Server{})
+	}
+	return rtD, nil
+}
+
+func newH2CSetting() *settings.BoolSetting {
+	return settings.NewBoolSetting(h2cSetting, "Accept HTTP/2 without TLS (h2c) in addition to HTTP/1.1.", false)
+}
+
+// runtimeContext installs the runtime logger and stats client in the context
+// so that background tasks, such as health checks, can emit events outside
+// the lifecycle of a request.
+func runtimeContext(ctx context.Context, rt *runhttp.Runtime) context.Context {
+	ctx = logevent.NewContext(ctx, rt.Logger)
+	return xstats.NewContext(ctx, rt.Stats)
+}
+
+// backgroundLogger fetches the logger from the context. Contexts without a
+// logger, such as those given to NewTransport by library users, result in a
+// logger that discards all events.
+func backgroundLogger(ctx context.Context) (logger runhttp.Logger) {
+	defer func() {
+		if r := recover(); r != nil {
+			logger = logevent.New(logevent.Config{Output: io.Discard})
+		}
+	}()
+	return runhttp.LoggerFromContext(ctx)
 }
@@ -1,13 +1,20 @@
 package transportd
 
 import (
+	"context"
+	"crypto/tls"
 	"encoding/json"
 	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
 	"reflect"
 	"testing"
 
 	"github.com/asecurityteam/runhttp"
 	"github.com/asecurityteam/settings"
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/net/http2"
 )
 
 func TestRTSourceFromExtension(t *testing.T) {
@@ -48,3 +55,41 @@ func TestRTSourceFromExtension(t *testing.T) {
 		})
 	}
 }
+
+func TestNewRuntimeH2C(t *testing.T) {
+	s, err := RuntimeSourceFromExtension([]byte(`{"logger": {"output": "NULL"}, "stats": {"output": "NULL"}}`))
+	assert.Nil(t, err)
+	rt, err := NewRuntime(context.Background(), s, http.NotFoundHandler())
+	assert.Nil(t, err)
+	assert.IsType(t, http.NotFoundHandler(), rt.Handler)
+
+	s, err = RuntimeSourceFromExtension([]byte(`{"logger": {"output": "NULL"}, "stats": {"output": "NULL"}, "httpserver": {"h2c": true}}`))
+	assert.Nil(t, err)
+	rt, err = NewRuntime(context.Background(), s, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("X-Proto", r.Proto)
+	}))
+	assert.Nil(t, err)
+	server := httptest.NewServer(rt.Handler)
+	defer server.Close()
+	client := &http2.Transport{
+		AllowHTTP: true,
+		DialTLSContext: func(ctx context.Context, network string, addr string, _ *tls.Config) (net.Conn, error) {
+			return (&net.Dialer{}).DialContext(ctx, network, addr)
+		},
+	}
+	defer client.CloseIdleConnections()
+	req, _ := http.NewRequest(http.MethodGet, server.URL, http.NoBody)
+	resp, err := client.RoundTrip(req)
+	if !assert.Nil(t, err) {
+		return
+	}
+	defer resp.Body.Close()
+	assert.Equal(t, "HTTP/2.0", resp.Header.Get("X-Proto"))
+
+	resp, err = http.Get(server.URL)
+	if !assert.Nil(t, err) {
+		return
+	}
+	defer resp.Body.Close()
+	assert.Equal(t, "HTTP/1.1", resp.Header.Get("X-Proto"))
+}
@@ -0,0 +1,134 @@
+package transportd
+
+import (
+	"context"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+)
+
+const (
+	redactedSecret = "[REDACTED]"
+)
+
+// SecretResolver provides the values of secret references in the
+// specification. A reference of the form ${name:reference} is passed to the
+// resolver with the matching name. Resolved values are treated as secrets and
+// are removed from any error returned while loading the specification.
+type SecretResolver interface {
+	// Name is the prefix of the references handled by the resolver.
+	Name() string
+	// Resolve returns the secret for the reference. Errors must not include
+	// the secret itself.
+	Resolve(ctx context.Context, reference string) (string, error)
+}
+
+// FileSecretResolver reads secrets from files, such as those mounted into a
+// container, using references like ${file:/run/secrets/key}. Leading and
+// trailing whitespace is removed from the content.
+type FileSecretResolver struct{}
+
+// Name of the resolver.
+func (*FileSecretResolver) Name() string {
+	return "file"
+}
+
+// Resolve reads the file at the given path.
+func (*FileSecretResolver) Resolve(_ context.Context, reference string) (string, error) {
+	b, err := os.ReadFile(reference)
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimSpace(string(b)), nil
+}
+
+// Base64SecretResolver decodes secrets that are base64 encoded in place, such
+// as ${base64:c2VjcmV0}.
+type Base64SecretResolver struct{}
+
+// Name of the resolver.
+func (*Base64SecretResolver) Name() string {
+	return "base64"
+}
+
+// Resolve decodes the reference. Both padded and unpadded input is accepted.
+func (*Base64SecretResolver) Resolve(_ context.Context, reference string) (string, error) {
+	b, err := base64.StdEncoding.DecodeString(reference)
+	if err != nil {
+		b, err = base64.RawStdEncoding.DecodeString(reference)
+	}
+	if err != nil {
+		// The decoding error describes the input so it is replaced.
+		return "", errors.New("invalid base64 value")
+	}
+	return string(b), nil
+}
+
+var secretResolversCtxKey = ctxKey("__transportd_secret_resolvers")
+
+// SecretResolversToContext installs additional secret resolvers that are used
+// when a specification is loaded with the context. Resolvers with the same
+// name as a built in resolver replace it.
+func SecretResolversToContext(ctx context.Context, resolvers ...SecretResolver) context.Context {
+	return context.WithValue(ctx, secretResolversCtxKey, resolvers)
+}
+
+// SecretResolversFromContext fetches the secret resolvers available to the
+// context. The result always includes the built in file and base64 resolvers.
+func SecretResolversFromContext(ctx context.Context) map[string]SecretResolver {
+	result := map[string]SecretResolver{}
+	custom, _ := ctx.Value(secretResolversCtxKey).([]SecretResolver)
+	for _, resolver := range append([]SecretResolver{&FileSecretResolver{}, &Base64SecretResolver{}}, custom...) {
+		result[strings.ToLower(resolver.Name())] = resolver
+	}
+	return result
+}
+
+// secretRedactor removes known secret values from errors.
+type secretRedactor struct {
+	values []string
+}
+
+// Add records a secret. Multi-line secrets, such as PEM keys, are also
+// recorded line by line so that partial quotes of them are removed.
+func (r *secretRedactor) Add(secret string) {
+	if strings.TrimSpace(secret) == "" {
+		return
+	}
+	r.values = append(r.values, secret)
+	for _, line := range strings.Split(secret, "\n") {
+		if line = strings.TrimSpace(line); line != "" && line != secret {
+			r.values = append(r.values, line)
+		}
+	}
+	// Longer values are replaced first so that a secret containing another
+	// is removed in full.
+	sort.SliceStable(r.values, func(i, j int) bool { return len(r.values[i]) > len(r.values[j]) })
+}
+
+// Redact returns the error with every known secret replaced.
+func (r *secretRedactor) Redact(err error) error {
+	if err == nil || r == nil || len(r.values) < 1 {
+		return err
+	}
+	message := err.Error()
+	redacted := r.RedactString(message)
+	if redacted == message {
+		return err
+	}
+	return fmt.Errorf("%s", redacted)
+}
+
+// RedactString returns the text with every known secret replaced.
+func (r *secretRedactor) RedactString(text string) string {
+	if r == nil {
+		return text
+	}
+	for _, value := range r.values {
+		text = strings.ReplaceAll(text, value, redactedSecret)
+	}
+	return text
+}
@@ -0,0 +1,62 @@
+package transportd
+
+import (
+	"context"
+	"sync"
+)
+
+var servedByCtxKey = ctxKey("__transportd_served_by")
+
+// ServedBy records the backend that a request was sent to. Components that
+// are built once for a route run above any split, match rule, or failover so
+// they cannot know the backend ahead of time. Such a component places a
+// ServedBy in the request context and reads it once the request returns.
+// When a request is sent more than once, such as during failover, the last
+// attempt is recorded.
+type ServedBy struct {
+	lock    sync.Mutex
+	backend string
+	host    string
+	scheme  string
+}
+
+// Backend is the name of the backend that served the request or an empty
+// string if the request never reached a backend.
+func (s *ServedBy) Backend() string {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return s.backend
+}
+
+// Host is the host of the backend that served the request.
+func (s *ServedBy) Host() string {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return s.host
+}
+
+// Scheme is the URL scheme used to reach the backend.
+func (s *ServedBy) Scheme() string {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return s.scheme
+}
+
+func (s *ServedBy) record(backend string, host string, scheme string) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.backend = backend
+	s.host = host
+	s.scheme = scheme
+}
+
+// ServedByFromContext returns the ServedBy of the request, if any.
+func ServedByFromContext(ctx context.Context) *ServedBy {
+	s, _ := ctx.Value(servedByCtxKey).(*ServedBy)
+	return s
+}
+
+// ServedByToContext places a ServedBy in the request context.
+func ServedByToContext(ctx context.Context, s *ServedBy) context.Context {
+	return context.WithValue(ctx, servedByCtxKey, s)
+}
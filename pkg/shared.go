@@ -0,0 +1,49 @@
+package transportd
+
+import (
+	"context"
+	"sync"
+)
+
+// SharedState holds values that components share between the routes of a
+// single transport. Each build of a specification, including those caused by
+// a reload, gets a new SharedState so that no state carries over from one
+// configuration to the next and values from replaced configurations can be
+// garbage collected.
+type SharedState struct {
+	lock   sync.Mutex
+	values map[string]interface{}
+}
+
+// NewSharedState initializes an empty SharedState.
+func NewSharedState() *SharedState {
+	return &SharedState{values: make(map[string]interface{})}
+}
+
+// LoadOrStore returns the value stored for the key. If there is none then
+// create is called to generate it and the result is stored for later calls.
+func (s *SharedState) LoadOrStore(key string, create func() interface{}) interface{} {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if v, ok := s.values[key]; ok {
+		return v
+	}
+	v := create()
+	s.values[key] = v
+	return v
+}
+
+var sharedStateCtxKey = ctxKey("__transportd_shared_state")
+
+// SharedStateFromContext fetches the state shared by the routes of the
+// transport being built. The result is nil if no state is set.
+func SharedStateFromContext(ctx context.Context) *SharedState {
+	s, _ := ctx.Value(sharedStateCtxKey).(*SharedState)
+	return s
+}
+
+// SharedStateToContext inserts the state shared by the routes of the
+// transport being built.
+func SharedStateToContext(ctx context.Context, s *SharedState) context.Context {
+	return context.WithValue(ctx, sharedStateCtxKey, s)
+}
@@ -0,0 +1,24 @@
+package transportd
+
+import (
+	"context"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSharedState(t *testing.T) {
+	assert.Nil(t, SharedStateFromContext(context.Background()))
+	s := NewSharedState()
+	ctx := SharedStateToContext(context.Background(), s)
+	assert.Equal(t, s, SharedStateFromContext(ctx))
+
+	calls := 0
+	create := func() interface{} {
+		calls = calls + 1
+		return calls
+	}
+	assert.Equal(t, 1, s.LoadOrStore("a", create))
+	assert.Equal(t, 1, s.LoadOrStore("a", create))
+	assert.Equal(t, 2, s.LoadOrStore("b", create))
+}
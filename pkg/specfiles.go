@@ -0,0 +1,358 @@
+package transportd
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/fs"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/getkin/kin-openapi/openapi3"
+	"github.com/ghodss/yaml"
+)
+
+// SpecificationFiles identifies a specification that is split across
+// multiple files. Relative external $refs are resolved from the directory of
+// the document that contains them and every file is interpolated with
+// environment variables and secrets as it is read.
+type SpecificationFiles struct {
+	// Root is the main document. It carries the openapi, info, and x-runtime
+	// sections along with any paths and backends that are not split out.
+	Root string
+	// Directories contain fragment documents, in the style of conf.d, that
+	// are merged into the root. Each fragment may define paths and
+	// x-transportd backends. Fragments are merged in lexical order of their
+	// path and any path or backend that is defined more than once is an
+	// error. Only .yaml, .yml, and .json files are loaded.
+	Directories []string
+	// Overlays are applied, in order, to the merged specification before it
+	// is parsed. Each is either an OpenAPI Overlay document or a JSON merge
+	// patch.
+	Overlays []string
+}
+
+// fragments lists the fragment documents in the order they are merged.
+func (f SpecificationFiles) fragments() ([]string, error) {
+	var result []string
+	for _, dir := range f.Directories {
+		var found []string
+		err := filepath.WalkDir(dir, func(name string, entry fs.DirEntry, err error) error {
+			if err != nil {
+				return err
+			}
+			switch strings.ToLower(filepath.Ext(name)) {
+			case ".yaml", ".yml", ".json":
+				if !entry.IsDir() {
+					found = append(found, name)
+				}
+			}
+			return nil
+		})
+		if err != nil {
+			return nil, fmt.Errorf("failed to list specification directory %s: %s", dir, err.Error())
+		}
+		sort.Strings(found)
+		result = append(result, found...)
+	}
+	return result, nil
+}
+
+// document reads the files, merges the fragments into the root, and applies
+// the overlays. The result is the specification as a generic JSON value in
+// which every relative $ref is resolvable from the location of the root.
+func (f SpecificationFiles) document(readFile func(string) ([]byte, error)) (map[string]interface{}, error) {
+	root, err := readDocument(f.Root, readFile)
+	if err != nil {
+		return nil, err
+	}
+	doc, ok := root.(map[string]interface{})
+	if !ok {
+		return nil, fmt.Errorf("specification file %s is not an object", f.Root)
+	}
+	fragments, err := f.fragments()
+	if err != nil {
+		return nil, err
+	}
+	for _, name := range fragments {
+		fragment, err := readDocument(name, readFile)
+		if err != nil {
+			return nil, err
+		}
+		absolute, err := filepath.Abs(name)
+		if err != nil {
+			return nil, err
+		}
+		fragment, err = rebaseRefs(fragment, filepath.ToSlash(absolute))
+		if err == nil {
+			err = mergeFragment(doc, fragment)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("failed to merge specification file %s: %s", name, err.Error())
+		}
+	}
+	for _, name := range f.Overlays {
+		overlay, err := readDocument(name, readFile)
+		if err != nil {
+			return nil, err
+		}
+		if doc, err = applyOverlay(doc, overlay); err != nil {
+			return nil, fmt.Errorf("failed to apply overlay %s: %s", name, err.Error())
+		}
+	}
+	return doc, nil
+}
+
+// load reads, merges, and parses the documents. Along with the
+// specification it returns the secrets that were resolved and the name of
+// every file that was read, including those reached through external $refs.
+func (f SpecificationFiles) load(ctx context.Context) (*openapi3.T, *secretRedactor, []string, error) {
+	spec, _, secrets, read, err := f.resolve(ctx)
+	return spec, secrets, read, err
+}
+
+// resolve is the same as load but also returns the final document before it
+// is parsed.
+func (f SpecificationFiles) resolve(ctx context.Context) (*openapi3.T, map[string]interface{}, *secretRedactor, []string, error) {
+	envProcessor, err := specificationEnvProcessor()
+	if err != nil {
+		return nil, nil, nil, nil, err
+	}
+	var read []string
+	seen := make(map[string]bool)
+	readFile := func(name string) ([]byte, error) {
+		// Fragments are read again when their own $refs are resolved.
+		if !seen[name] {
+			seen[name] = true
+			read = append(read, name)
+		}
+		source, err := os.ReadFile(name)
+		if err != nil {
+			return nil, err
+		}
+		return envProcessor.ProcessContext(ctx, source)
+	}
+	doc, err := f.document(readFile)
+	if err != nil {
+		return nil, nil, nil, read, envProcessor.Redact(err)
+	}
+	source, err := json.Marshal(doc)
+	if err != nil {
+		return nil, nil, nil, read, envProcessor.Redact(err)
+	}
+	absolute, err := filepath.Abs(f.Root)
+	if err != nil {
+		return nil, nil, nil, read, err
+	}
+	loader := openapi3.NewLoader()
+	loader.IsExternalRefsAllowed = true
+	loader.ReadFromURIFunc = func(_ *openapi3.Loader, location *url.URL) ([]byte, error) {
+		if location.Scheme != "" || location.Host != "" {
+			return nil, fmt.Errorf("unsupported reference %s: only local files may be referenced", location.String())
+		}
+		return readFile(location.Path)
+	}
+	spec, err := loader.LoadFromDataWithPath(source, &url.URL{Path: filepath.ToSlash(absolute)})
+	if err != nil {
+		return nil, nil, nil, read, envProcessor.Redact(fmt.Errorf("failed to load specification: %s", err.Error()))
+	}
+	return spec, doc, envProcessor.secrets, read, nil
+}
+
+// ResolveSpecification returns the specification described by the files,
+// after interpolation, merging, and overlays, as YAML for review. The values
+// of any secrets are replaced with [REDACTED] and external $refs are left in
+// place. The specification must load without errors.
+func ResolveSpecification(ctx context.Context, files SpecificationFiles) ([]byte, error) {
+	_, doc, secrets, _, err := files.resolve(ctx)
+	if err != nil {
+		return nil, err
+	}
+	rawJSON, err := json.Marshal(redactDocument(doc, secrets))
+	if err != nil {
+		return nil, err
+	}
+	return yaml.JSONToYAML(rawJSON)
+}
+
+// redactDocument replaces the secrets in every string of the document.
+// Redacting the values before they are rendered avoids missing secrets that
+// are quoted or escaped in the output.
+func redactDocument(node interface{}, secrets *secretRedactor) interface{} {
+	switch value := node.(type) {
+	case map[string]interface{}:
+		result := make(map[string]interface{}, len(value))
+		for key, child := range value {
+			result[secrets.RedactString(key)] = redactDocument(child, secrets)
+		}
+		return result
+	case []interface{}:
+		result := make([]interface{}, len(value))
+		for offset, child := range value {
+			result[offset] = redactDocument(child, secrets)
+		}
+		return result
+	case string:
+		return secrets.RedactString(value)
+	}
+	return node
+}
+
+// readDocument reads a YAML or JSON file into a generic JSON value.
+func readDocument(name string, readFile func(string) ([]byte, error)) (interface{}, error) {
+	absolute, err := filepath.Abs(name)
+	if err != nil {
+		return nil, err
+	}
+	source, err := readFile(absolute)
+	if err != nil {
+		return nil, err
+	}
+	rawJSON, err := yaml.YAMLToJSON(source)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse specification file %s: %s", name, err.Error())
+	}
+	var doc interface{}
+	decoder := json.NewDecoder(bytes.NewReader(rawJSON))
+	decoder.UseNumber()
+	if err := decoder.Decode(&doc); err != nil {
+		return nil, fmt.Errorf("failed to parse specification file %s: %s", name, err.Error())
+	}
+	return doc, nil
+}
+
+// rebaseRefs rewrites the $refs of a fragment so that they resolve from any
+// document. References local to the fragment point at the fragment file and
+// relative file references are made absolute. Remote references are rejected
+// here, rather than by the loader, so that the error names the fragment.
+func rebaseRefs(node interface{}, location string) (interface{}, error) {
+	var err error
+	switch value := node.(type) {
+	case map[string]interface{}:
+		for key, child := range value {
+			ref, isString := child.(string)
+			if key != "$ref" || !isString {
+				if value[key], err = rebaseRefs(child, location); err != nil {
+					return nil, err
+				}
+				continue
+			}
+			switch {
+			case strings.HasPrefix(ref, "#"):
+				value[key] = location + ref
+			case strings.Contains(ref, "://"):
+				return nil, fmt.Errorf("unsupported reference %s: only local files may be referenced", ref)
+			case strings.HasPrefix(ref, "/"):
+			default:
+				value[key] = path.Join(path.Dir(location), ref)
+			}
+		}
+	case []interface{}:
+		for offset, child := range value {
+			if value[offset], err = rebaseRefs(child, location); err != nil {
+				return nil, err
+			}
+		}
+	}
+	return node, nil
+}
+
+// mergeFragment adds the paths and x-transportd backends of the fragment to
+// the specification. Other sections of the fragment are only reachable
+// through $refs.
+func mergeFragment(spec map[string]interface{}, node interface{}) error {
+	fragment, ok := node.(map[string]interface{})
+	if !ok {
+		return fmt.Errorf("fragment is not an object")
+	}
+	if rawPaths, ok := fragment["paths"]; ok {
+		paths, ok := rawPaths.(map[string]interface{})
+		if !ok {
+			return fmt.Errorf("paths is not an object")
+		}
+		specPaths, _ := spec["paths"].(map[string]interface{})
+		if specPaths == nil {
+			specPaths = make(map[string]interface{})
+			spec["paths"] = specPaths
+		}
+		for _, name := range sortedKeys(paths) {
+			if _, ok := specPaths[name]; ok {
+				return fmt.Errorf("duplicate path %s", name)
+			}
+			specPaths[name] = paths[name]
+		}
+	}
+
+	rawFragment, ok := fragment[ExtensionKey]
+	if !ok {
+		return nil
+	}
+	fragmentConf, ok := rawFragment.(map[string]interface{})
+	if !ok {
+		return fmt.Errorf("%s is not an object", ExtensionKey)
+	}
+	conf, _ := spec[ExtensionKey].(map[string]interface{})
+	if conf == nil {
+		conf = make(map[string]interface{})
+		spec[ExtensionKey] = conf
+	}
+	var backends []interface{}
+	if key, ok := foldKey(conf, backendsSetting); ok {
+		if backends, ok = conf[key].([]interface{}); !ok {
+			return fmt.Errorf("backend list is not an array")
+		}
+		delete(conf, key)
+	}
+	if key, ok := foldKey(fragmentConf, backendsSetting); ok {
+		fragmentBackends, ok := fragmentConf[key].([]interface{})
+		if !ok {
+			return fmt.Errorf("backend list is not an array")
+		}
+		for _, backend := range fragmentBackends {
+			for _, existing := range backends {
+				if strings.EqualFold(fmt.Sprint(existing), fmt.Sprint(backend)) {
+					return fmt.Errorf("duplicate backend %v", backend)
+				}
+			}
+			backends = append(backends, backend)
+		}
+	}
+	if backends != nil {
+		conf[backendsSetting] = backends
+	}
+	for _, key := range sortedKeys(fragmentConf) {
+		if strings.EqualFold(key, backendsSetting) {
+			continue
+		}
+		if _, ok := foldKey(conf, key); ok {
+			return fmt.Errorf("duplicate %s setting %s", ExtensionKey, key)
+		}
+		conf[key] = fragmentConf[key]
+	}
+	return nil
+}
+
+// foldKey finds the key in the map that matches the name without regard to
+// case, which is how settings names are matched.
+func foldKey(m map[string]interface{}, name string) (string, bool) {
+	for key := range m {
+		if strings.EqualFold(key, name) {
+			return key, true
+		}
+	}
+	return "", false
+}
+
+func sortedKeys(m map[string]interface{}) []string {
+	keys := make([]string, 0, len(m))
+	for key := range m {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
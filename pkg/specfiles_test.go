@@ -0,0 +1,231 @@
+package transportd
+
+import (
+	"context"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+const specFilesRoot = `
+openapi: 3.0.0
+info:
+  version: 1.0.0
+  title: Split API
+x-transportd:
+  backends:
+    - app
+  app:
+    host: "http://localhost"
+paths:
+  /hello:
+    get:
+      responses:
+        "200":
+          $ref: "shared/responses.yaml#/components/responses/Hello"
+      x-transportd:
+        backend: app
+`
+
+const specFilesResponses = `
+components:
+  responses:
+    Hello:
+      description: "Hello"
+      content:
+        application/json:
+          schema:
+            $ref: "schemas.yaml#/components/schemas/Greeting"
+`
+
+const specFilesSchemas = `
+components:
+  schemas:
+    Greeting:
+      type: object
+      properties:
+        message:
+          type: string
+`
+
+const specFilesFragment = `
+x-transportd:
+  backends:
+    - users
+  users:
+    host: "${TRANSPORTD_TEST_USERS_HOST}"
+paths:
+  /users:
+    get:
+      responses:
+        "200":
+          $ref: "#/components/responses/Users"
+      x-transportd:
+        backend: users
+components:
+  responses:
+    Users:
+      description: "Users"
+`
+
+func writeSpecFiles(t *testing.T, files map[string]string) string {
+	dir := t.TempDir()
+	for name, content := range files {
+		name = filepath.Join(dir, name)
+		assert.Nil(t, os.MkdirAll(filepath.Dir(name), 0700))
+		assert.Nil(t, os.WriteFile(name, []byte(content), 0600))
+	}
+	return dir
+}
+
+func TestSpecificationFilesLoad(t *testing.T) {
+	t.Setenv("TRANSPORTD_TEST_USERS_HOST", "http://users.local")
+	dir := writeSpecFiles(t, map[string]string{
+		"openapi.yaml":          specFilesRoot,
+		"shared/responses.yaml": specFilesResponses,
+		"shared/schemas.yaml":   specFilesSchemas,
+		"conf.d/10-users.yaml":  specFilesFragment,
+		"conf.d/README.md":      "not a fragment",
+	})
+	files := SpecificationFiles{
+		Root:        filepath.Join(dir, "openapi.yaml"),
+		Directories: []string{filepath.Join(dir, "conf.d")},
+	}
+	spec, _, read, err := files.load(context.Background())
+	assert.Nil(t, err)
+	assert.Len(t, read, 4)
+
+	hello := spec.Paths["/hello"].Get.Responses["200"].Value
+	assert.Equal(t, "Hello", *hello.Description)
+	assert.Contains(t, hello.Content["application/json"].Schema.Value.Properties, "message")
+	users := spec.Paths["/users"].Get.Responses["200"].Value
+	assert.Equal(t, "Users", *users.Description)
+
+	conf := make(map[string]json.RawMessage)
+	assert.Nil(t, json.Unmarshal(spec.Extensions[ExtensionKey].(json.RawMessage), &conf))
+	assert.JSONEq(t, `["app","users"]`, string(conf["backends"]))
+	assert.JSONEq(t, `{"host":"http://users.local"}`, string(conf["users"]))
+
+	transport, err := buildTransport(context.Background(), spec, nil)
+	assert.Nil(t, err)
+	assert.IsType(t, &ClientTransport{}, transport)
+}
+
+func TestSpecificationFilesLoadErrors(t *testing.T) {
+	tests := []struct {
+		name     string
+		fragment string
+		want     string
+	}{
+		{
+			name: "duplicate path",
+			want: "fragment.yaml: duplicate path /hello",
+			fragment: `
+paths:
+  /hello:
+    get:
+      responses:
+        "200":
+          description: "Hello"
+`,
+		},
+		{
+			name: "duplicate backend",
+			want: "fragment.yaml: duplicate backend App",
+			fragment: `
+x-transportd:
+  backends:
+    - App
+`,
+		},
+		{
+			name: "duplicate backend settings",
+			want: "fragment.yaml: duplicate x-transportd setting app",
+			fragment: `
+x-transportd:
+  app:
+    host: "http://other"
+`,
+		},
+		{
+			name: "remote reference",
+			want: "only local files may be referenced",
+			fragment: `
+paths:
+  /remote:
+    get:
+      responses:
+        "200":
+          $ref: "http://example.com/responses.yaml#/components/responses/Remote"
+`,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir := writeSpecFiles(t, map[string]string{
+				"openapi.yaml":          specFilesRoot,
+				"shared/responses.yaml": specFilesResponses,
+				"shared/schemas.yaml":   specFilesSchemas,
+				"conf.d/fragment.yaml":  tt.fragment,
+			})
+			files := SpecificationFiles{
+				Root:        filepath.Join(dir, "openapi.yaml"),
+				Directories: []string{filepath.Join(dir, "conf.d")},
+			}
+			_, _, _, err := files.load(context.Background())
+			assert.NotNil(t, err)
+			assert.Contains(t, err.Error(), "fragment.yaml")
+			assert.Contains(t, err.Error(), tt.want)
+		})
+	}
+}
+
+func TestSpecificationFilesOrder(t *testing.T) {
+	dir := writeSpecFiles(t, map[string]string{
+		"a/20.yaml":     "{}",
+		"a/10.yml":      "{}",
+		"a/sub/00.json": "{}",
+		"a/notes.txt":   "",
+		"b/00.yaml":     "{}",
+	})
+	files := SpecificationFiles{Directories: []string{filepath.Join(dir, "a"), filepath.Join(dir, "b")}}
+	fragments, err := files.fragments()
+	assert.Nil(t, err)
+	assert.Equal(t, []string{
+		filepath.Join(dir, "a", "10.yml"),
+		filepath.Join(dir, "a", "20.yaml"),
+		filepath.Join(dir, "a", "sub", "00.json"),
+		filepath.Join(dir, "b", "00.yaml"),
+	}, fragments)
+
+	files.Directories = []string{filepath.Join(dir, "missing")}
+	_, err = files.fragments()
+	assert.NotNil(t, err)
+}
+
+func TestReloaderFilesStamp(t *testing.T) {
+	t.Setenv("TRANSPORTD_TEST_USERS_HOST", "http://users.local")
+	dir := writeSpecFiles(t, map[string]string{
+		"openapi.yaml":          specFilesRoot,
+		"shared/responses.yaml": specFilesResponses,
+		"shared/schemas.yaml":   specFilesSchemas,
+	})
+	root := filepath.Join(dir, "openapi.yaml")
+	r := &Reloader{
+		Transport: NewReloadableTransport(nil),
+		Files:     &SpecificationFiles{Root: root, Directories: []string{filepath.Join(dir, "conf.d")}},
+	}
+	assert.NotNil(t, r.Reload(context.Background()), "missing directory should fail")
+	assert.Nil(t, os.Mkdir(filepath.Join(dir, "conf.d"), 0700))
+	assert.Nil(t, r.Reload(context.Background()))
+	assert.Contains(t, r.watched, filepath.Join(dir, "shared", "schemas.yaml"))
+
+	before := r.stamp(root)
+	assert.Nil(t, os.WriteFile(filepath.Join(dir, "conf.d", "10-users.yaml"), []byte(specFilesFragment), 0600))
+	assert.NotEqual(t, before, r.stamp(root))
+	assert.Nil(t, r.Reload(context.Background()))
+	assert.Len(t, r.watched, 4)
+}
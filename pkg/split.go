@@ -0,0 +1,123 @@
+package transportd
+
+import (
+	"fmt"
+	"hash/fnv"
+	"math/rand"
+	"net/http"
+)
+
+const (
+	splitSetting = "split"
+)
+
+// SplitConfig divides the traffic of a route between several backends. Each
+// request is sent to one of the backends in proportion to its weight. When a
+// header or cookie is named, requests carrying it are routed by a hash of its
+// value so that the same caller always reaches the same backend.
+type SplitConfig struct {
+	Backends []string `description:"Backends that share the traffic of the route. Replaces backend when set."`
+	Weights  []int    `description:"Relative weight of each entry in backends. Defaults to equal weights."`
+	Header   string   `description:"Request header whose value keeps a caller on the same backend."`
+	Cookie   string   `description:"Request cookie whose value keeps a caller on the same backend. Used when the header is not present."`
+}
+
+// Name of the config root.
+func (*SplitConfig) Name() string {
+	return splitSetting
+}
+
+func newSplitConfig() *SplitConfig {
+	return &SplitConfig{
+		Backends: []string{},
+		Weights:  []int{},
+	}
+}
+
+// enabled reports whether the route splits traffic at all.
+func (c *SplitConfig) enabled() bool {
+	return len(c.Backends) > 0
+}
+
+func validateSplit(conf *SplitConfig) error {
+	if !conf.enabled() {
+		return nil
+	}
+	seen := make(map[string]bool, len(conf.Backends))
+	for _, backend := range conf.Backends {
+		if seen[backend] {
+			return fmt.Errorf("backend %s is listed more than once", backend)
+		}
+		seen[backend] = true
+	}
+	return validateWeights(conf.Weights, len(conf.Backends))
+}
+
+// splitTransport sends each request to one of several backend transports.
+type splitTransport struct {
+	Header     string
+	Cookie     string
+	Weights    []int
+	Transports []http.RoundTripper
+	total      int
+}
+
+func newSplitTransport(conf *SplitConfig, transports []http.RoundTripper) *splitTransport {
+	weights := conf.Weights
+	if len(weights) < 1 {
+		weights = make([]int, len(transports))
+		for offset := range weights {
+			weights[offset] = 1
+		}
+	}
+	total := 0
+	for _, weight := range weights {
+		total = total + weight
+	}
+	return &splitTransport{
+		Header:     conf.Header,
+		Cookie:     conf.Cookie,
+		Weights:    weights,
+		Transports: transports,
+		total:      total,
+	}
+}
+
+// stickyKey returns the value used to pin the request to a backend, if any.
+func (t *splitTransport) stickyKey(r *http.Request) string {
+	if t.Header != "" {
+		if v := r.Header.Get(t.Header); v != "" {
+			return v
+		}
+	}
+	if t.Cookie != "" {
+		if c, err := r.Cookie(t.Cookie); err == nil && c.Value != "" {
+			return c.Value
+		}
+	}
+	return ""
+}
+
+// selectTransport picks the transport for the request. Requests without a
+// sticky key are distributed randomly by weight.
+func (t *splitTransport) selectTransport(r *http.Request) http.RoundTripper {
+	var target int
+	if key := t.stickyKey(r); key != "" {
+		h := fnv.New32a()
+		_, _ = h.Write([]byte(key))
+		target = int(h.Sum32() % uint32(t.total))
+	} else {
+		target = rand.Intn(t.total) // nolint:gosec
+	}
+	for offset, weight := range t.Weights {
+		if target < weight {
+			return t.Transports[offset]
+		}
+		target = target - weight
+	}
+	return t.Transports[len(t.Transports)-1]
+}
+
+func (t *splitTransport) RoundTrip(r *http.Request) (*http.Response, error) {
+	return t.selectTransport(r).RoundTrip(r)
+}
@@ -0,0 +1,69 @@
+package transportd
+
+import (
+	"net/http"
+	"testing"
+
+	"github.com/golang/mock/gomock"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestValidateSplit(t *testing.T) {
+	tests := []struct {
+		name    string
+		conf    *SplitConfig
+		wantErr bool
+	}{
+		{name: "disabled", conf: newSplitConfig(), wantErr: false},
+		{name: "equal weights", conf: &SplitConfig{Backends: []string{"a", "b"}}, wantErr: false},
+		{name: "weighted", conf: &SplitConfig{Backends: []string{"a", "b"}, Weights: []int{95, 5}}, wantErr: false},
+		{name: "weight count", conf: &SplitConfig{Backends: []string{"a", "b"}, Weights: []int{1}}, wantErr: true},
+		{name: "zero weight", conf: &SplitConfig{Backends: []string{"a", "b"}, Weights: []int{1, 0}}, wantErr: true},
+		{name: "duplicate", conf: &SplitConfig{Backends: []string{"a", "a"}}, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := validateSplit(tt.conf)
+			assert.Equal(t, tt.wantErr, err != nil)
+		})
+	}
+}
+
+func TestSplitTransportWeights(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	stable := NewMockRoundTripper(ctrl)
+	canary := NewMockRoundTripper(ctrl)
+	rt := newSplitTransport(
+		&SplitConfig{Backends: []string{"stable", "canary"}, Weights: []int{1, 0}},
+		[]http.RoundTripper{stable, canary},
+	)
+	req, _ := http.NewRequest(http.MethodGet, "http://localhost/", http.NoBody)
+	stable.EXPECT().RoundTrip(req).Return(&http.Response{}, nil).Times(10)
+	for x := 0; x < 10; x = x + 1 {
+		_, _ = rt.RoundTrip(req)
+	}
+}
+
+func TestSplitTransportSticky(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	stable := NewMockRoundTripper(ctrl)
+	canary := NewMockRoundTripper(ctrl)
+	rt := newSplitTransport(
+		&SplitConfig{Backends: []string{"stable", "canary"}, Header: "X-User", Cookie: "user"},
+		[]http.RoundTripper{stable, canary},
+	)
+	byHeader, _ := http.NewRequest(http.MethodGet, "http://localhost/", http.NoBody)
+	byHeader.Header.Set("X-User", "user-1")
+	byCookie, _ := http.NewRequest(http.MethodGet, "http://localhost/", http.NoBody)
+	byCookie.AddCookie(&http.Cookie{Name: "user", Value: "user-1"})
+
+	selected := rt.selectTransport(byHeader)
+	for x := 0; x < 10; x = x + 1 {
+		assert.Equal(t, selected, rt.selectTransport(byHeader))
+		assert.Equal(t, selected, rt.selectTransport(byCookie))
+	}
+}
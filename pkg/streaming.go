@@ -0,0 +1,101 @@
+package transportd
+
+import (
+	"context"
+	"mime"
+	"net/http"
+	"net/http/httputil"
+
+	"github.com/getkin/kin-openapi/openapi3"
+)
+
+const (
+	streamingSetting = "streaming"
+	// eventStreamType is the content type of Server-Sent Events.
+	eventStreamType = "text/event-stream"
+)
+
+var streamingCtxKey = ctxKey("__transportd_streaming")
+
+// StreamingFromContext reports whether the route being built is in streaming
+// mode. Components read this while they are constructed and, when it is set,
+// must not wait for a complete response body. Components that need the body
+// either pass the response through untouched or only inspect a bounded prefix.
+func StreamingFromContext(ctx context.Context) bool {
+	streaming, _ := ctx.Value(streamingCtxKey).(bool)
+	return streaming
+}
+
+// StreamingToContext marks whether the route being built is in streaming mode.
+func StreamingToContext(ctx context.Context, streaming bool) context.Context {
+	return context.WithValue(ctx, streamingCtxKey, streaming)
+}
+
+// streamingOperation reports whether the operation in the specification
+// declares a Server-Sent Events response. This is the default streaming mode
+// of the route.
+func streamingOperation(ctx context.Context, path string, method string) bool {
+	spec, _ := ctx.Value(ContextKeyOpenAPISpec).(*openapi3.T)
+	if spec == nil || spec.Paths[path] == nil {
+		return false
+	}
+	op := spec.Paths[path].GetOperation(method)
+	if op == nil {
+		return false
+	}
+	for _, resp := range op.Responses {
+		if resp == nil || resp.Value == nil {
+			continue
+		}
+		for contentType := range resp.Value.Content {
+			if mediaType, _, err := mime.ParseMediaType(contentType); err == nil && mediaType == eventStreamType {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// streamingTransport marks the client of a streaming route so that the
+// streamingProxy can find it.
+type streamingTransport struct {
+	Wrapped http.RoundTripper
+}
+
+func (t *streamingTransport) RoundTrip(r *http.Request) (*http.Response, error) {
+	return t.Wrapped.RoundTrip(r)
+}
+
+// streamingRouter is implemented by transports that know which requests
+// belong to a streaming route.
+type streamingRouter interface {
+	streaming(r *http.Request) bool
+}
+
+// streamingProxy serves requests for streaming routes with a reverse proxy
+// that writes each part of the body to the client as soon as it arrives
+// rather than waiting for its buffer to fill. All other requests use the
+// buffered proxy.
+type streamingProxy struct {
+	Buffered  *httputil.ReverseProxy
+	Streaming *httputil.ReverseProxy
+}
+
+// newStreamingProxy generates a streamingProxy from the settings of the given
+// reverse proxy.
+func newStreamingProxy(proxy *httputil.ReverseProxy) *streamingProxy {
+	streaming := *proxy
+	streaming.FlushInterval = -1
+	return &streamingProxy{
+		Buffered:  proxy,
+		Streaming: &streaming,
+	}
+}
+
+func (p *streamingProxy) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if router, ok := p.Buffered.Transport.(streamingRouter); ok && router.streaming(r) {
+		p.Streaming.ServeHTTP(w, r)
+		return
+	}
+	p.Buffered.ServeHTTP(w, r)
+}
@@ -0,0 +1,136 @@
+package transportd
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/http/httputil"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+const streamingSpec = `
+openapi: 3.0.0
+info:
+  version: 1.0.0
+  title: Streaming API
+paths:
+  /events:
+    get:
+      responses:
+        '200':
+          description: event stream
+          content:
+            text/event-stream; charset=utf-8:
+              schema:
+                type: string
+    post:
+      responses:
+        '204':
+          description: event published
+  /status:
+    get:
+      responses:
+        '200':
+          description: status
+          content:
+            application/json:
+              schema:
+                type: object
+`
+
+func TestStreamingOperation(t *testing.T) {
+	spec, _, err := newSpecification(context.Background(), []byte(streamingSpec))
+	assert.Nil(t, err)
+	ctx := context.WithValue(context.Background(), ContextKeyOpenAPISpec, spec)
+	assert.True(t, streamingOperation(ctx, "/events", http.MethodGet))
+	assert.False(t, streamingOperation(ctx, "/events", http.MethodPost))
+	assert.False(t, streamingOperation(ctx, "/status", http.MethodGet))
+	assert.False(t, streamingOperation(ctx, unknownKey, unknownKey))
+	assert.False(t, streamingOperation(context.Background(), "/events", http.MethodGet))
+}
+
+func TestStreamingContext(t *testing.T) {
+	assert.False(t, StreamingFromContext(context.Background()))
+	assert.True(t, StreamingFromContext(StreamingToContext(context.Background(), true)))
+}
+
+const streamingProxySpec = `
+openapi: 3.0.0
+info:
+  version: 1.0.0
+  title: Streaming API
+x-transportd:
+  backends:
+    - app
+  app:
+    host: "%s"
+paths:
+  /events:
+    get:
+      responses:
+        '200':
+          description: event stream
+          content:
+            text/event-stream:
+              schema:
+                type: string
+      x-transportd:
+        backend: app
+  /status:
+    get:
+      responses:
+        '200':
+          description: status
+      x-transportd:
+        backend: app
+`
+
+func TestStreamingProxyFlush(t *testing.T) {
+	release := make(chan struct{})
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// A known length would normally cause the proxy to buffer the body.
+		w.Header().Set("Content-Length", "10")
+		_, _ = w.Write([]byte("first"))
+		w.(http.Flusher).Flush()
+		<-release
+		_, _ = w.Write([]byte("later"))
+	}))
+	defer upstream.Close()
+
+	rt, err := NewTransport(context.Background(), []byte(fmt.Sprintf(streamingProxySpec, upstream.URL)))
+	if !assert.Nil(t, err) {
+		close(release)
+		return
+	}
+	reloadable := NewReloadableTransport(rt)
+	proxy := newStreamingProxy(&httputil.ReverseProxy{
+		Director:  func(*http.Request) {},
+		Transport: reloadable,
+	})
+	status, _ := http.NewRequest(http.MethodGet, "http://localhost/status", http.NoBody)
+	assert.False(t, reloadable.streaming(status))
+	server := httptest.NewServer(proxy)
+	defer server.Close()
+
+	client := &http.Client{Timeout: 5 * time.Second}
+	resp, err := client.Get(server.URL + "/events")
+	if !assert.Nil(t, err) {
+		close(release)
+		return
+	}
+	defer resp.Body.Close()
+	assert.Equal(t, int64(10), resp.ContentLength)
+	first := make([]byte, len("first"))
+	_, err = io.ReadFull(resp.Body, first)
+	close(release)
+	assert.Nil(t, err)
+	assert.Equal(t, "first", string(first))
+	rest, err := io.ReadAll(resp.Body)
+	assert.Nil(t, err)
+	assert.Equal(t, "later", string(rest))
+}
@@ -0,0 +1,99 @@
+package transportd
+
+import (
+	"context"
+	"fmt"
+	"hash/fnv"
+	"net"
+	"net/http"
+	"net/url"
+	"path"
+	"regexp"
+	"strings"
+)
+
+const (
+	unixScheme = "unix"
+	// unixHostSuffix marks the host names that stand in for unix sockets. The
+	// invalid top level domain is reserved so these never resolve in DNS.
+	unixHostSuffix = ".unix.invalid"
+	// unixHostHeader is the Host header sent to unix socket backends.
+	unixHostHeader = "localhost"
+)
+
+var unixHostUnsafeChar = regexp.MustCompile(`[^a-z0-9-]+`)
+
+// unixSockets maps the host names generated for the unix socket hosts of a
+// backend to the path of the socket. Each backend has its own mapping so that
+// it is discarded along with the backend on reload.
+type unixSockets map[string]string
+
+// parseUnixHost converts a host like unix:///var/run/app.sock, optionally
+// followed by a path prefix as in unix:///var/run/app.sock:/api, into an HTTP
+// URL with a host name that the backend dialer maps back to the socket. The
+// path of the socket is returned along with the URL.
+func parseUnixHost(u *url.URL) (*url.URL, string, error) {
+	if u.Host != "" {
+		return nil, "", fmt.Errorf("unix socket url %s must not have a host", u.String())
+	}
+	socket, prefix, _ := strings.Cut(u.Path, ":")
+	if !path.IsAbs(socket) {
+		return nil, "", fmt.Errorf("unix socket path must be absolute in %s", u.String())
+	}
+	if prefix != "" && !strings.HasPrefix(prefix, "/") {
+		return nil, "", fmt.Errorf("unix socket path prefix must start with / in %s", u.String())
+	}
+	h := fnv.New32a()
+	_, _ = h.Write([]byte(socket))
+	label := strings.Trim(unixHostUnsafeChar.ReplaceAllString(strings.ToLower(path.Base(socket)), "-"), "-")
+	host := fmt.Sprintf("%s-%08x%s", label, h.Sum32(), unixHostSuffix)
+	return &url.URL{Scheme: "http", Host: host, Path: strings.TrimSuffix(prefix, "/")}, socket, nil
+}
+
+// isUnixHost reports whether the host name stands in for a unix socket.
+func isUnixHost(host string) bool {
+	return strings.HasSuffix(host, unixHostSuffix)
+}
+
+// hostHeader is the Host header value for requests sent to the host.
+func hostHeader(u *url.URL) string {
+	if isUnixHost(u.Host) {
+		return unixHostHeader
+	}
+	return u.Host
+}
+
+// upstreamPath adds the path prefix of a unix socket host to the request path.
+func upstreamPath(u *url.URL, p string) string {
+	if isUnixHost(u.Host) {
+		return u.Path + p
+	}
+	return p
+}
+
+// dialUnix wraps a dial function so that the host names of unix socket
+// hosts connect to their socket.
+func dialUnix(sockets unixSockets, dial func(context.Context, string, string) (net.Conn, error)) func(context.Context, string, string) (net.Conn, error) {
+	return func(ctx context.Context, network string, addr string) (net.Conn, error) {
+		host, _, err := net.SplitHostPort(addr)
+		if err != nil || !isUnixHost(host) {
+			return dial(ctx, network, addr)
+		}
+		socket, ok := sockets[host]
+		if !ok {
+			return nil, fmt.Errorf("unknown unix socket host %s", host)
+		}
+		return dial(ctx, "unix", socket)
+	}
+}
+
+// proxyUnix wraps a proxy function so that requests to unix socket hosts are
+// never sent through a proxy. Proxies only reach TCP addresses.
+func proxyUnix(proxy func(*http.Request) (*url.URL, error)) func(*http.Request) (*url.URL, error) {
+	return func(r *http.Request) (*url.URL, error) {
+		if proxy == nil || isUnixHost(r.URL.Hostname()) {
+			return nil, nil
+		}
+		return proxy(r)
+	}
+}
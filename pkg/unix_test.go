@@ -0,0 +1,94 @@
+package transportd
+
+import (
+	"net"
+	"net/http"
+	"net/url"
+	"path/filepath"
+	"testing"
+
+	"github.com/asecurityteam/transport"
+	"github.com/golang/mock/gomock"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseUnixHost(t *testing.T) {
+	tests := []struct {
+		name       string
+		host       string
+		wantPrefix string
+		wantSocket string
+		wantErr    bool
+	}{
+		{name: "socket", host: "unix:///var/run/app.sock", wantSocket: "/var/run/app.sock"},
+		{name: "prefix", host: "unix:///var/run/app.sock:/api/", wantSocket: "/var/run/app.sock", wantPrefix: "/api"},
+		{name: "relative", host: "unix://var/run/app.sock", wantErr: true},
+		{name: "bad prefix", host: "unix:///var/run/app.sock:api", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			u, _ := url.Parse(tt.host)
+			result, socket, err := parseUnixHost(u)
+			assert.Equal(t, tt.wantErr, err != nil)
+			if err != nil {
+				return
+			}
+			assert.Nil(t, validateHost(result))
+			assert.True(t, isUnixHost(result.Host))
+			assert.Equal(t, tt.wantPrefix, result.Path)
+			assert.Equal(t, tt.wantSocket, socket)
+		})
+	}
+
+	a, _, _ := parseUnixHost(&url.URL{Scheme: unixScheme, Path: "/a/app.sock"})
+	b, _, _ := parseUnixHost(&url.URL{Scheme: unixScheme, Path: "/b/app.sock"})
+	assert.NotEqual(t, a.Host, b.Host, "different sockets shared a host name")
+}
+
+func TestUnixBackend(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	socket := filepath.Join(t.TempDir(), "app.sock")
+	listener, err := net.Listen("unix", socket)
+	assert.Nil(t, err)
+	server := &http.Server{Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) { // nolint:gosec
+		assert.Equal(t, "localhost", r.Host)
+		assert.Equal(t, "/api/resource", r.URL.Path)
+		w.WriteHeader(http.StatusNoContent)
+	})}
+	go func() { _ = server.Serve(listener) }()
+	defer server.Close()
+
+	hosts, sockets, err := parseHosts("unix://"+socket+":/api", nil)
+	assert.Nil(t, err)
+	backend := NewMockBackend(ctrl)
+	backend.EXPECT().Host().Return(hosts[0])
+	rt := &hostRewrite{
+		Backend: backend,
+		Wrapped: transport.New(connectionOptions(newConnectionConfig(), nil, sockets)...),
+	}
+	req, _ := http.NewRequest(http.MethodGet, "http://localhost/resource", http.NoBody)
+	resp, err := rt.RoundTrip(req)
+	assert.Nil(t, err)
+	if err == nil {
+		assert.Equal(t, http.StatusNoContent, resp.StatusCode)
+		_ = resp.Body.Close()
+	}
+}
+
+func TestProxyUnix(t *testing.T) {
+	proxyURL, _ := url.Parse("http://proxy:3128")
+	proxy := proxyUnix(http.ProxyURL(proxyURL))
+	host, _, _ := parseUnixHost(&url.URL{Scheme: unixScheme, Path: "/var/run/app.sock"})
+
+	req, _ := http.NewRequest(http.MethodGet, host.String(), http.NoBody)
+	result, err := proxy(req)
+	assert.Nil(t, err)
+	assert.Nil(t, result, "unix socket request was sent to a proxy")
+
+	req, _ = http.NewRequest(http.MethodGet, "http://localhost/", http.NoBody)
+	result, err = proxy(req)
+	assert.Nil(t, err)
+	assert.Equal(t, proxyURL, result)
+}
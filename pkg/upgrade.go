@@ -0,0 +1,49 @@
+package transportd
+
+import (
+	"net/http"
+	"strings"
+)
+
+const (
+	upgradeSetting = "upgrade"
+)
+
+// isUpgradeRequest reports whether the request asks to switch protocols, as
+// is done to open a WebSocket.
+func isUpgradeRequest(r *http.Request) bool {
+	if r.Header.Get("Upgrade") == "" {
+		return false
+	}
+	for _, value := range r.Header.Values("Connection") {
+		for _, token := range strings.Split(value, ",") {
+			if strings.EqualFold(strings.TrimSpace(token), "upgrade") {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// upgradeBypass skips a component for upgrade requests. Components that act
+// on the response, such as by reading the body, would break the connection
+// that is tunneled after a 101 Switching Protocols response.
+type upgradeBypass struct {
+	Wrapped http.RoundTripper
+	Next    http.RoundTripper
+}
+
+func (t *upgradeBypass) RoundTrip(r *http.Request) (*http.Response, error) {
+	if isUpgradeRequest(r) {
+		return t.Next.RoundTrip(r)
+	}
+	return t.Wrapped.RoundTrip(r)
+}
+
+// bypassUpgrades wraps a component decorator so that it only applies to
+// requests that are not upgrades.
+func bypassUpgrades(decorator func(http.RoundTripper) http.RoundTripper) func(http.RoundTripper) http.RoundTripper {
+	return func(next http.RoundTripper) http.RoundTripper {
+		return &upgradeBypass{Wrapped: decorator(next), Next: next}
+	}
+}
@@ -0,0 +1,175 @@
+package transportd
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/http/httputil"
+	"testing"
+	"time"
+
+	"github.com/asecurityteam/settings"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestIsUpgradeRequest(t *testing.T) {
+	tests := []struct {
+		name       string
+		connection []string
+		upgrade    string
+		want       bool
+	}{
+		{name: "plain", want: false},
+		{name: "websocket", connection: []string{"Upgrade"}, upgrade: "websocket", want: true},
+		{name: "token list", connection: []string{"keep-alive, upgrade"}, upgrade: "websocket", want: true},
+		{name: "multiple headers", connection: []string{"keep-alive", "Upgrade"}, upgrade: "h2c", want: true},
+		{name: "no upgrade header", connection: []string{"Upgrade"}, want: false},
+		{name: "no connection token", connection: []string{"keep-alive"}, upgrade: "websocket", want: false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req, _ := http.NewRequest(http.MethodGet, "http://localhost/", http.NoBody)
+			for _, value := range tt.connection {
+				req.Header.Add("Connection", value)
+			}
+			if tt.upgrade != "" {
+				req.Header.Set("Upgrade", tt.upgrade)
+			}
+			assert.Equal(t, tt.want, isUpgradeRequest(req))
+		})
+	}
+}
+
+// bufferingTransport reads the whole response body as response validation
+// does, which would break a tunneled connection.
+type bufferingTransport struct {
+	Wrapped http.RoundTripper
+	Calls   int
+}
+
+func (t *bufferingTransport) RoundTrip(r *http.Request) (*http.Response, error) {
+	t.Calls = t.Calls + 1
+	resp, err := t.Wrapped.RoundTrip(r)
+	if err != nil {
+		return nil, err
+	}
+	body, _ := io.ReadAll(resp.Body)
+	_ = resp.Body.Close()
+	resp.Body = io.NopCloser(bytes.NewReader(body))
+	return resp, nil
+}
+
+type bufferingConfig struct{}
+
+func (*bufferingConfig) Name() string {
+	return "buffering"
+}
+
+// bufferingComponent installs a bufferingTransport as a route component.
+type bufferingComponent struct {
+	Transport *bufferingTransport
+}
+
+func (*bufferingComponent) Settings() *bufferingConfig {
+	return &bufferingConfig{}
+}
+
+func (c *bufferingComponent) New(_ context.Context, _ *bufferingConfig) (func(http.RoundTripper) http.RoundTripper, error) {
+	return func(w http.RoundTripper) http.RoundTripper {
+		c.Transport.Wrapped = w
+		return c.Transport
+	}, nil
+}
+
+func TestUpgradeTunnel(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !isUpgradeRequest(r) {
+			_, _ = w.Write([]byte("plain"))
+			return
+		}
+		conn, rw, err := w.(http.Hijacker).Hijack()
+		if !assert.Nil(t, err) {
+			return
+		}
+		defer conn.Close()
+		_, _ = rw.WriteString("HTTP/1.1 101 Switching Protocols\r\nConnection: Upgrade\r\nUpgrade: echo\r\n\r\n")
+		_ = rw.Flush()
+		_, _ = io.Copy(conn, rw)
+	}))
+	defer upstream.Close()
+
+	ctx := context.Background()
+	bases, err := NewBaseTransports(ctx, settings.NewMapSource(map[string]interface{}{
+		ExtensionKey: map[string]interface{}{
+			backendsSetting: []string{"app"},
+			"app": map[string]interface{}{
+				hostSetting: upstream.URL,
+				bulkheadSetting: map[string]interface{}{
+					"maxconcurrent": 1,
+				},
+			},
+		},
+	}))
+	if !assert.Nil(t, err) {
+		return
+	}
+	bulkhead := bases.Load(ctx, "app").(*backendWrapper).RoundTripper.(*bulkheadTransport).Bulkhead
+	buffering := &bufferingComponent{Transport: &bufferingTransport{}}
+	cf := &ClientFactory{
+		Bases: bases,
+		Components: []NewComponent{func(context.Context, string, string, string) (interface{}, error) {
+			return buffering, nil
+		}},
+	}
+	client, err := cf.New(ctx, settings.NewMapSource(map[string]interface{}{
+		ExtensionKey: map[string]interface{}{
+			enabledSetting: []string{"buffering"},
+			backendSetting: "app",
+			upgradeSetting: true,
+		},
+	}), "/", http.MethodGet)
+	if !assert.Nil(t, err) {
+		return
+	}
+	proxy := httptest.NewServer(&httputil.ReverseProxy{
+		Director:  func(*http.Request) {},
+		Transport: client,
+	})
+	defer proxy.Close()
+
+	resp, err := http.Get(proxy.URL)
+	assert.Nil(t, err)
+	body, _ := io.ReadAll(resp.Body)
+	_ = resp.Body.Close()
+	assert.Equal(t, "plain", string(body))
+	assert.Equal(t, 1, buffering.Transport.Calls, "component was not applied to a plain request")
+
+	conn, err := net.Dial("tcp", proxy.Listener.Addr().String())
+	if !assert.Nil(t, err) {
+		return
+	}
+	_ = conn.SetDeadline(time.Now().Add(5 * time.Second))
+	_, _ = conn.Write([]byte("GET / HTTP/1.1\r\nHost: localhost\r\nConnection: Upgrade\r\nUpgrade: echo\r\n\r\n"))
+	reader := bufio.NewReader(conn)
+	resp, err = http.ReadResponse(reader, nil)
+	if !assert.Nil(t, err) {
+		_ = conn.Close()
+		return
+	}
+	assert.Equal(t, http.StatusSwitchingProtocols, resp.StatusCode)
+	_, _ = conn.Write([]byte("ping"))
+	echo := make([]byte, len("ping"))
+	_, err = io.ReadFull(reader, echo)
+	assert.Nil(t, err)
+	assert.Equal(t, "ping", string(echo))
+	assert.Equal(t, 1, buffering.Transport.Calls, "component was applied to an upgrade request")
+	assert.Equal(t, 1, bulkhead.InFlight(), "slot released while the tunnel was open")
+	_ = conn.Close()
+	assert.Eventually(t, func() bool {
+		return bulkhead.InFlight() == 0
+	}, time.Second, 10*time.Millisecond, "slot not released when the tunnel closed")
+}